@@ -1,15 +1,41 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"payment-gateway/db"
 	"payment-gateway/internal/api"
+	"payment-gateway/internal/gateways"
+	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/logging"
 	"payment-gateway/internal/redis"
+	"payment-gateway/internal/services"
+	"payment-gateway/internal/tracing"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+// how long shutdown waits after readiness fails before it stops accepting requests, so the orchestrator can take the instance out of rotation
+const defaultShutdownDelay = 5 * time.Second
+
+// how long in-flight requests may take to finish on shutdown before their connections are closed
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
+	// Write JSON log lines carrying the request and transaction IDs
+	logging.Init()
+
+	// Set up trace propagation and the span exporter before anything starts spans
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		fatal("could not initialize tracing", err)
+	}
+
 	// Initialize Redis connection
 	redis.InitRedis()
 
@@ -24,13 +50,122 @@ func main() {
 
 	db.InitializeDB(dbURL)
 
+	// Register the payment gateways and their routing rules
+	gatewayConfig := gateways.DefaultConfig
+	if path := os.Getenv("GATEWAYS_CONFIG"); path != "" {
+		config, err := gateways.LoadConfig(path)
+		if err != nil {
+			fatal("could not load gateway configuration", err)
+		}
+		gatewayConfig = config
+	}
+	if err := gateways.Configure(gatewayConfig); err != nil {
+		fatal("could not configure gateways", err)
+	}
+
+	// Set the rate limits of the transaction and callback routes
+	rateLimitConfig := services.DefaultRateLimitConfig
+	if path := os.Getenv("RATE_LIMITS_CONFIG"); path != "" {
+		config, err := services.LoadRateLimitConfig(path)
+		if err != nil {
+			fatal("could not load rate limit configuration", err)
+		}
+		rateLimitConfig = config
+	}
+	if err := services.ConfigureRateLimits(rateLimitConfig); err != nil {
+		fatal("could not configure rate limits", err)
+	}
+
+	// Load the FX rates file if one is configured, rates can also be updated later through the admin API
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		if err := services.LoadFXRatesFile(path); err != nil {
+			fatal("could not load FX rates", err)
+		}
+	}
+
+	// Set how often a webhook event is attempted before it is moved to dead
+	if value := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); value != "" {
+		maxAttempts, err := strconv.Atoi(value)
+		if err == nil {
+			err = services.ConfigureWebhooks(maxAttempts)
+		}
+		if err != nil {
+			fatal("could not configure webhooks", err)
+		}
+	}
+
+	// Plain http and private webhook endpoints are only allowed for local development
+	services.AllowInsecureWebhooks(os.Getenv("WEBHOOK_ALLOW_INSECURE") == "true")
+
+	shutdownDelay := durationSetting("SHUTDOWN_DELAY", defaultShutdownDelay)
+	shutdownTimeout := durationSetting("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+
+	// SIGTERM and SIGINT start the shutdown, a second signal ends the process right away
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// The background workers run until shutdown and finish the message they are working on
+	workers := newWorkerGroup()
+
+	// Start relaying queued transactions from the outbox to Kafka
+	workers.start(services.StartOutboxRelay)
+
+	// Start delivering transaction events to the merchants' webhook endpoints
+	workers.start(services.StartWebhookDispatcher)
+
+	// Consume gateway results published to Kafka in addition to the HTTP callback
+	workers.start(func(ctx context.Context) {
+		kafka.StartResultsConsumer(ctx, services.HandleGatewayResultMessage)
+	})
+
 	// Set up the HTTP server and routes
-	router := api.SetupRouter()
+	server := &http.Server{Addr: ":8080", Handler: api.SetupRouter()}
 
 	// Start the server on port 8080
-	log.Println("Starting server on port 8080...")
-	if err := http.ListenAndServe(":8080", router); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", slog.String("addr", server.Addr))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	select {
+	case err := <-serverErr:
+		fatal("could not start server", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("shutting down", slog.Duration("delay", shutdownDelay), slog.Duration("timeout", shutdownTimeout))
+
+	// Flush the Kafka writer before closing the stores the workers used, the spans of the shutdown are flushed last
+	shutdown(server, workers, []closer{
+		{name: "kafka writer", close: kafka.Close},
+		{name: "database", close: db.Close},
+		{name: "redis", close: redis.Close},
+		{name: "span exporter", close: func() error { return shutdownTracing(context.Background()) }},
+	}, shutdownDelay, shutdownTimeout)
+
+	slog.Info("shutdown complete")
+}
+
+// reads a duration such as 30s from the environment, the default is used when it isn't set
+func durationSetting(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		fatal("could not parse "+name, errors.New("must be a non-negative duration such as 30s"))
 	}
+	return duration
+}
 
+// logs the error that keeps the service from starting and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, slog.Any("error", err))
+	os.Exit(1)
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"payment-gateway/internal/services"
+	"sync"
+	"time"
+)
+
+// the background workers of the service, they run until they are stopped and finish the message they are working on
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// creates a group of workers that haven't been started yet
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+// runs a worker until the group is stopped
+func (g *workerGroup) start(run func(context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		run(g.ctx)
+	}()
+}
+
+// stops the workers and waits until every one of them returned
+func (g *workerGroup) stop() {
+	g.cancel()
+	g.wg.Wait()
+}
+
+// the part of the HTTP server shutdown drains
+type drainer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// a dependency closed at the end of shutdown
+type closer struct {
+	name  string
+	close func() error
+}
+
+// shuts the service down in order: readiness fails while the server keeps serving for delay, the server drains in-flight requests for up to timeout,
+// the workers stop once no request can queue more work for them and the dependencies are closed last in the given order so no worker uses a closed one
+func shutdown(server drainer, workers *workerGroup, closers []closer, delay time.Duration, timeout time.Duration) {
+	// Fail readiness first and keep serving while the orchestrator stops sending traffic
+	services.StartDraining()
+	time.Sleep(delay)
+
+	// Stop accepting connections and wait for in-flight requests, those still running at the deadline are cut off
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		slog.Error("failed to drain http requests", slog.Any("error", err))
+	}
+
+	workers.stop()
+
+	for _, dependency := range closers {
+		if err := dependency.close(); err != nil {
+			slog.Error("failed to close "+dependency.name, slog.Any("error", err))
+		}
+	}
+}
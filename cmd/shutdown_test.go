@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// records the steps of a shutdown in the order they happened
+type shutdownLog struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+// records a step
+func (l *shutdownLog) add(step string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.steps = append(l.steps, step)
+}
+
+// returns the recorded steps
+func (l *shutdownLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.steps...)
+}
+
+// a server recording its drain, the workers have to be running while requests drain as requests still queue work for them
+type fakeServer struct {
+	log     *shutdownLog
+	workers *workerGroup
+}
+
+// records the drain and whether the workers were still running
+func (s fakeServer) Shutdown(ctx context.Context) error {
+	if s.workers.ctx.Err() != nil {
+		s.log.add("http drained after the workers stopped")
+		return nil
+	}
+	s.log.add("http")
+	return nil
+}
+
+func TestShutdownOrder(t *testing.T) {
+	log := &shutdownLog{}
+	var closed, ranAfterClose atomic.Bool
+
+	workers := newWorkerGroup()
+	for _, name := range []string{"outbox relay", "webhook dispatcher", "results consumer"} {
+		name := name
+		workers.start(func(ctx context.Context) {
+			for {
+				if closed.Load() {
+					ranAfterClose.Store(true)
+				}
+
+				select {
+				case <-ctx.Done():
+					// the worker finishes the message it is working on before it returns
+					time.Sleep(10 * time.Millisecond)
+					if closed.Load() {
+						ranAfterClose.Store(true)
+					}
+					log.add(name + " stopped")
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		})
+	}
+
+	closeStep := func(name string) closer {
+		return closer{name: name, close: func() error {
+			closed.Store(true)
+			log.add(name)
+			return nil
+		}}
+	}
+
+	shutdown(fakeServer{log: log, workers: workers}, workers, []closer{closeStep("kafka writer"), closeStep("database"), closeStep("redis")}, 0, time.Second)
+
+	if ranAfterClose.Load() {
+		t.Fatalf("Expected no worker to run after a dependency was closed")
+	}
+
+	steps := log.get()
+	if len(steps) != 7 {
+		t.Fatalf("Expected 7 shutdown steps, got %v", steps)
+	}
+	if steps[0] != "http" {
+		t.Fatalf("Expected the http requests to drain first while the workers run, got %v", steps)
+	}
+	for _, step := range steps[1:4] {
+		if !strings.HasSuffix(step, " stopped") {
+			t.Fatalf("Expected the workers to stop after the http drain, got %v", steps)
+		}
+	}
+	if strings.Join(steps[4:], ",") != "kafka writer,database,redis" {
+		t.Fatalf("Expected the kafka writer to flush before the stores close, got %v", steps)
+	}
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"payment-gateway/internal/models"
+
+	_ "github.com/lib/pq"
+)
+
+// moves an authorized transaction to the status of a capture or void request and queues the gateway message in the same database transaction, the update only applies while the transaction is still authorized
+func UpdateAuthorization(ctx context.Context, scope Scope, transaction models.Transaction, message models.OutboxMessage) error {
+	tx, err := scope.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        UPDATE transactions
+        SET status = $2, amount = $3, settlement_amount = $4
+        WHERE transaction_id = $1 AND status = 'authorized' AND authorized_amount IS NOT NULL`
+
+	result, err := tx.ExecContext(ctx, query, transaction.TransactionID, transaction.Status, transaction.Amount.MinorUnits, transaction.SettlementAmount.MinorUnits)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return statusConflictOrNotFound(ctx, tx, transaction.TransactionID)
+	}
+
+	if err := insertOutboxMessage(ctx, tx, message); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -1,50 +1,89 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
+	"os"
 	"payment-gateway/internal/models"
 	"payment-gateway/internal/resilience"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 var db *sql.DB
 
+// returned when no transaction matches the given ID
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+var (
+	// keeps trying to reach the database for a minute while it is starting up next to the service
+	connectPolicy = resilience.Policy{
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   10 * time.Second,
+		MaxElapsed: time.Minute,
+	}
+
+	// retries reads a few times on connection errors, a missing row won't appear on retry
+	readPolicy = resilience.Policy{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Retryable: func(err error) bool {
+			return !errors.Is(err, sql.ErrNoRows)
+		},
+	}
+)
+
 // InitializeDB initializes the database connection
 func InitializeDB(dataSourceName string) {
 	var err error
 
-	// Retry connecting to the database in case of failure up to 5 times
-	err = resilience.RetryOperation(func() error {
-		db, err = sql.Open("postgres", dataSourceName)
-		if err != nil {
-			return err
-		}
+	db, err = sql.Open("postgres", dataSourceName)
+	if err != nil {
+		slog.Error("could not open the database", slog.Any("error", err))
+		os.Exit(1)
+	}
 
-		return db.Ping()
-	}, 5)
+	// Retry connecting to the database in case it isn't accepting connections yet
+	err = connectPolicy.Do(context.Background(), func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
 
 	if err != nil {
-		log.Fatalf("Could not connect to the database: %v", err)
+		slog.Error("could not connect to the database", slog.Any("error", err))
+		os.Exit(1)
 	}
 
-	log.Println("Successfully connected to the database.")
+	slog.Info("connected to the database")
+}
+
+// closes the connection pool once open queries finish, called on shutdown
+func Close() error {
+	return db.Close()
+}
+
+// checks the database accepts connections, used by the readiness check
+func Ping(ctx context.Context) error {
+	return db.PingContext(ctx)
 }
 
-// GetTransactionByID retrieves a transaction by its ID
-func GetTransactionByID(transactionID string) (models.Transaction, error) {
+// GetTransactionByID retrieves a transaction by its ID, transactions of other merchants than the scope's are reported as not found
+func GetTransactionByID(ctx context.Context, scope Scope, transactionID string) (models.Transaction, error) {
 	var transaction models.Transaction
 
-	query := `SELECT transaction_id, amount, type, status, data_format FROM transactions WHERE transaction_id = $1`
-	err := resilience.RetryOperation(func() error {
-		return db.QueryRow(query, transactionID).Scan(&transaction.TransactionID, &transaction.Amount, &transaction.Type, &transaction.Status, &transaction.DataFormat)
-	}, 3)
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE transaction_id = $1`
+	err := readPolicy.Do(ctx, func(ctx context.Context) error {
+		return scope.run(ctx, func(tx *sql.Tx) error {
+			return scanTransaction(tx.QueryRowContext(ctx, query, transactionID), &transaction)
+		})
+	})
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return transaction, fmt.Errorf("transaction not found")
+		if errors.Is(err, sql.ErrNoRows) {
+			return transaction, ErrTransactionNotFound
 		}
 		return transaction, err
 	}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"payment-gateway/internal/models"
+
+	_ "github.com/lib/pq"
+)
+
+// returned when there is no rate between two currencies
+var ErrFXRateNotFound = errors.New("fx rate not found")
+
+// inserts or replaces FX rates in one database transaction so a partly loaded rate file is never used
+func UpsertFXRates(ctx context.Context, rates []models.FXRate) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO fx_rates (base_currency, quote_currency, rate, updated_at)
+        VALUES ($1, $2, $3, NOW())
+        ON CONFLICT (base_currency, quote_currency) DO UPDATE SET rate = EXCLUDED.rate, updated_at = EXCLUDED.updated_at`
+
+	for _, rate := range rates {
+		if _, err := tx.ExecContext(ctx, query, rate.BaseCurrency, rate.QuoteCurrency, rate.Rate); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// retrieves the rate converting the base currency into the quote currency
+func GetFXRate(ctx context.Context, baseCurrency string, quoteCurrency string) (models.FXRate, error) {
+	var rate models.FXRate
+
+	query := `SELECT base_currency, quote_currency, rate, updated_at FROM fx_rates WHERE base_currency = $1 AND quote_currency = $2`
+	err := db.QueryRowContext(ctx, query, baseCurrency, quoteCurrency).Scan(&rate.BaseCurrency, &rate.QuoteCurrency, &rate.Rate, &rate.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return rate, ErrFXRateNotFound
+		}
+		return rate, err
+	}
+
+	return rate, nil
+}
+
+// retrieves all stored FX rates
+func ListFXRates(ctx context.Context) ([]models.FXRate, error) {
+	rows, err := db.QueryContext(ctx, `SELECT base_currency, quote_currency, rate, updated_at FROM fx_rates ORDER BY base_currency, quote_currency`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := []models.FXRate{}
+	for rows.Next() {
+		var rate models.FXRate
+		if err := rows.Scan(&rate.BaseCurrency, &rate.QuoteCurrency, &rate.Rate, &rate.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+
+	return rates, rows.Err()
+}
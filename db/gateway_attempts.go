@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"payment-gateway/internal/models"
+
+	_ "github.com/lib/pq"
+)
+
+// records an attempt to publish a transaction message to a gateway
+func RecordGatewayAttempt(ctx context.Context, transactionID string, attempt models.GatewayAttempt) error {
+	query := `
+        INSERT INTO gateway_attempts (transaction_id, gateway, status, error, created_at)
+        VALUES ($1, $2, $3, NULLIF($4, ''), NOW())`
+
+	_, err := db.ExecContext(ctx, query, transactionID, attempt.Gateway, attempt.Status, attempt.Error)
+	return err
+}
+
+// retrieves the gateway attempts of a transaction in the order they were made, attempts carry no merchant so they are joined to their transaction which the scope filters
+func GetGatewayAttempts(ctx context.Context, scope Scope, transactionID string) ([]models.GatewayAttempt, error) {
+	query := `
+        SELECT a.gateway, a.status, COALESCE(a.error, ''), a.created_at
+        FROM gateway_attempts a
+        JOIN transactions t ON t.transaction_id = a.transaction_id
+        WHERE a.transaction_id = $1
+        ORDER BY a.id`
+
+	var attempts []models.GatewayAttempt
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, transactionID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var attempt models.GatewayAttempt
+			if err := rows.Scan(&attempt.Gateway, &attempt.Status, &attempt.Error, &attempt.CreatedAt); err != nil {
+				return err
+			}
+			attempts = append(attempts, attempt)
+		}
+
+		return rows.Err()
+	})
+
+	return attempts, err
+}
+
+// moves a pending transaction and its outbox message to another gateway, the message is due right away so the relay picks it up on its next poll
+func RerouteTransaction(ctx context.Context, message models.OutboxMessage, lastError string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE transactions SET gateway = $2 WHERE transaction_id = $1 AND status = 'pending'`, message.TransactionID, message.Gateway)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrStatusConflict
+	}
+
+	query := `
+        UPDATE outbox
+        SET gateway = $2, payload = $3, attempts = attempts + 1, next_attempt_at = NOW(), last_error = $4
+        WHERE id = $1`
+
+	if _, err := tx.ExecContext(ctx, query, message.ID, message.Gateway, string(message.Payload), lastError); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"payment-gateway/internal/models"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// returned when no request has been recorded for the given idempotency key
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+// reserves an idempotency key for a new request creating the given transaction, returns false if the key has already been used.
+// A reservation older than expiry whose transaction was never created is taken over as its request is gone
+func ReserveIdempotencyKey(ctx context.Context, key string, requestHash string, transactionID string, expiry time.Duration) (bool, error) {
+	query := `
+        INSERT INTO idempotency_keys (idempotency_key, request_hash, transaction_id, created_at)
+        VALUES ($1, $2, $3, NOW())
+        ON CONFLICT (idempotency_key) DO UPDATE
+        SET request_hash = EXCLUDED.request_hash, transaction_id = EXCLUDED.transaction_id, created_at = NOW()
+        WHERE idempotency_keys.completed_at IS NULL
+          AND idempotency_keys.created_at < NOW() - $4 * INTERVAL '1 millisecond'
+          AND NOT EXISTS (SELECT 1 FROM transactions t WHERE t.transaction_id = idempotency_keys.transaction_id)`
+
+	result, err := db.ExecContext(ctx, query, key, requestHash, transactionID, expiry.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// retrieves the stored request and response for an idempotency key, a reservation that isn't completed is marked expired once it is older than expiry
+func GetIdempotencyRecord(ctx context.Context, key string, expiry time.Duration) (models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	var statusCode sql.NullInt64
+	var message, transactionID sql.NullString
+	var transaction []byte
+
+	query := `
+        SELECT idempotency_key, request_hash, status_code, message, transaction, created_at, transaction_id,
+               completed_at IS NULL AND created_at < NOW() - $2 * INTERVAL '1 millisecond'
+        FROM idempotency_keys
+        WHERE idempotency_key = $1`
+	err := db.QueryRowContext(ctx, query, key, expiry.Milliseconds()).Scan(&record.Key, &record.RequestHash, &statusCode, &message, &transaction, &record.CreatedAt, &transactionID, &record.Expired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return record, ErrIdempotencyKeyNotFound
+		}
+		return record, err
+	}
+
+	record.StatusCode = int(statusCode.Int64)
+	record.Message = message.String
+	record.TransactionID = transactionID.String
+
+	if len(transaction) > 0 {
+		record.Transaction = &models.Transaction{}
+		if err := json.Unmarshal(transaction, record.Transaction); err != nil {
+			return record, err
+		}
+	}
+
+	return record, nil
+}
+
+// stores the final response of the request that reserved the idempotency key
+func CompleteIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) error {
+	// left nil so the column is stored as NULL when the response carries no transaction
+	var transaction interface{}
+	if record.Transaction != nil {
+		data, err := json.Marshal(record.Transaction)
+		if err != nil {
+			return err
+		}
+		transaction = string(data)
+	}
+
+	query := `
+        UPDATE idempotency_keys
+        SET status_code = $1, message = $2, transaction = $3, completed_at = NOW()
+        WHERE idempotency_key = $4`
+
+	_, err := db.ExecContext(ctx, query, record.StatusCode, record.Message, transaction, record.Key)
+	return err
+}
+
+// removes a reserved key that never completed so the client can retry it
+func ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND completed_at IS NULL`
+
+	_, err := db.ExecContext(ctx, query, key)
+	return err
+}
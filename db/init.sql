@@ -5,11 +5,379 @@ BEGIN
         CREATE TABLE transactions (
             id SERIAL PRIMARY KEY,
             transaction_id VARCHAR(255) NOT NULL UNIQUE,
-            amount DECIMAL(10, 2) NOT NULL,
+            amount BIGINT NOT NULL, -- minor units of the currency
+            currency CHAR(3) NOT NULL,
             type VARCHAR(50) NOT NULL,
             status VARCHAR(50) NOT NULL,
             data_format VARCHAR(50) NOT NULL,
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
         );
     END IF;
-END $$;
\ No newline at end of file
+END $$;
+
+-- Stores the outcome of requests sent with an Idempotency-Key so client retries don't create duplicate transactions
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64) NOT NULL,
+    status_code INT,
+    message TEXT,
+    transaction JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+-- Transactional outbox written in the same database transaction as the transaction row and drained to Kafka by the relay worker
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    data_format VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (next_attempt_at) WHERE status = 'pending';
+
+-- Transaction statuses and the allowed moves between them, mirrors the state machine in internal/services/transaction_state.go
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_status_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_status_check
+    CHECK (status IN ('pending', 'processing', 'completed', 'failed', 'cancelled', 'refunded',
+                      'authorized', 'capture_pending', 'void_pending', 'voided'));
+
+CREATE TABLE IF NOT EXISTS transaction_status_transitions (
+    from_status VARCHAR(50) NOT NULL,
+    to_status VARCHAR(50) NOT NULL,
+    PRIMARY KEY (from_status, to_status)
+);
+
+INSERT INTO transaction_status_transitions (from_status, to_status) VALUES
+    ('pending', 'processing'),
+    ('pending', 'completed'),
+    ('pending', 'failed'),
+    ('pending', 'cancelled'),
+    ('processing', 'completed'),
+    ('processing', 'failed'),
+    ('processing', 'cancelled'),
+    ('completed', 'refunded')
+ON CONFLICT DO NOTHING;
+
+-- Rejects status updates that are not listed in transaction_status_transitions
+CREATE OR REPLACE FUNCTION enforce_transaction_status_transition() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.status = OLD.status THEN
+        RETURN NEW;
+    END IF;
+
+    IF NOT EXISTS (
+        SELECT 1 FROM transaction_status_transitions
+        WHERE from_status = OLD.status AND to_status = NEW.status
+    ) THEN
+        RAISE EXCEPTION 'invalid transaction status transition from % to %', OLD.status, NEW.status
+            USING ERRCODE = 'check_violation';
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS transactions_status_transition ON transactions;
+CREATE TRIGGER transactions_status_transition
+    BEFORE UPDATE OF status ON transactions
+    FOR EACH ROW EXECUTE FUNCTION enforce_transaction_status_transition();
+
+-- Accounts and the double-entry ledger, every posting writes a debit and a credit entry that sum to zero
+-- Money in transit with the payment gateways is held in one gateway_clearing_<currency> system account per currency
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS account_id VARCHAR(255);
+
+CREATE TABLE IF NOT EXISTS accounts (
+    account_id VARCHAR(255) PRIMARY KEY,
+    type VARCHAR(20) NOT NULL DEFAULT 'customer',
+    currency CHAR(3) NOT NULL,
+    balance BIGINT NOT NULL DEFAULT 0, -- minor units of the account currency
+    reserved BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- only system accounts such as the gateway clearing accounts may go negative
+    CONSTRAINT accounts_funds_check CHECK (type = 'system' OR (reserved >= 0 AND balance >= reserved))
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    account_id VARCHAR(255) NOT NULL REFERENCES accounts (account_id),
+    amount BIGINT NOT NULL, -- minor units, positive for credits and negative for debits
+    currency CHAR(3) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx ON ledger_entries (account_id);
+CREATE INDEX IF NOT EXISTS ledger_entries_transaction_idx ON ledger_entries (transaction_id);
+
+-- Migrates databases created before amounts were stored as integer minor units with an explicit currency,
+-- existing amounts were two decimal places without a currency so they are converted as USD cents
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'transactions' AND column_name = 'amount' AND data_type = 'numeric') THEN
+        ALTER TABLE transactions ALTER COLUMN amount TYPE BIGINT USING ROUND(amount * 100);
+        ALTER TABLE transactions ADD COLUMN IF NOT EXISTS currency CHAR(3);
+        UPDATE transactions SET currency = 'USD' WHERE currency IS NULL;
+        ALTER TABLE transactions ALTER COLUMN currency SET NOT NULL;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'accounts' AND column_name = 'balance' AND data_type = 'numeric') THEN
+        ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_funds_check;
+        ALTER TABLE accounts ALTER COLUMN balance TYPE BIGINT USING ROUND(balance * 100);
+        ALTER TABLE accounts ALTER COLUMN reserved TYPE BIGINT USING ROUND(reserved * 100);
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency CHAR(3);
+        UPDATE accounts SET currency = 'USD' WHERE currency IS NULL;
+        ALTER TABLE accounts ALTER COLUMN currency SET NOT NULL;
+        ALTER TABLE accounts ADD CONSTRAINT accounts_funds_check CHECK (type = 'system' OR (reserved >= 0 AND balance >= reserved));
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'ledger_entries' AND column_name = 'amount' AND data_type = 'numeric') THEN
+        ALTER TABLE ledger_entries ALTER COLUMN amount TYPE BIGINT USING ROUND(amount * 100);
+        ALTER TABLE ledger_entries ADD COLUMN IF NOT EXISTS currency CHAR(3);
+        UPDATE ledger_entries SET currency = 'USD' WHERE currency IS NULL;
+        ALTER TABLE ledger_entries ALTER COLUMN currency SET NOT NULL;
+    END IF;
+
+    -- the single clearing account became one clearing account per currency
+    IF EXISTS (SELECT 1 FROM accounts WHERE account_id = 'gateway_clearing') THEN
+        INSERT INTO accounts (account_id, type, currency, balance)
+            SELECT 'gateway_clearing_USD', 'system', 'USD', balance FROM accounts WHERE account_id = 'gateway_clearing'
+            ON CONFLICT DO NOTHING;
+        UPDATE ledger_entries SET account_id = 'gateway_clearing_USD' WHERE account_id = 'gateway_clearing';
+        DELETE FROM accounts WHERE account_id = 'gateway_clearing';
+    END IF;
+END $$;
+
+-- FX rates used to convert deposits into the settlement currency of their account, one row per currency pair
+CREATE TABLE IF NOT EXISTS fx_rates (
+    base_currency CHAR(3) NOT NULL,
+    quote_currency CHAR(3) NOT NULL,
+    rate NUMERIC(24, 12) NOT NULL CHECK (rate > 0), -- units of the quote currency bought by one unit of the base currency
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (base_currency, quote_currency)
+);
+
+-- The settlement amount is converted with the rate locked at creation so later callbacks never re-price a transaction
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS settlement_amount BIGINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS settlement_currency CHAR(3);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate NUMERIC(24, 12);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate_at TIMESTAMP;
+UPDATE transactions SET settlement_amount = amount, settlement_currency = currency WHERE settlement_amount IS NULL;
+ALTER TABLE transactions ALTER COLUMN settlement_amount SET NOT NULL;
+ALTER TABLE transactions ALTER COLUMN settlement_currency SET NOT NULL;
+
+-- Refunds are child transactions of the deposit they give money back for
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS parent_transaction_id VARCHAR(255) REFERENCES transactions (transaction_id);
+CREATE INDEX IF NOT EXISTS transactions_parent_idx ON transactions (parent_transaction_id) WHERE parent_transaction_id IS NOT NULL;
+
+-- Card-style deposits hold the authorized amount until they are captured, amount is the captured amount from then on
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS authorized_amount BIGINT;
+
+-- Authorizations follow a flow of their own, they are held before they are captured or voided and only complete through a capture,
+-- while other transactions can never be authorized. A transaction follows the authorization flow when authorized_amount is set
+ALTER TABLE transaction_status_transitions ADD COLUMN IF NOT EXISTS flow VARCHAR(20) NOT NULL DEFAULT 'payment';
+ALTER TABLE transaction_status_transitions DROP CONSTRAINT IF EXISTS transaction_status_transitions_pkey;
+ALTER TABLE transaction_status_transitions ADD PRIMARY KEY (flow, from_status, to_status);
+
+INSERT INTO transaction_status_transitions (flow, from_status, to_status) VALUES
+    ('authorization', 'pending', 'processing'),
+    ('authorization', 'pending', 'authorized'),
+    ('authorization', 'pending', 'failed'),
+    ('authorization', 'pending', 'cancelled'),
+    ('authorization', 'processing', 'authorized'),
+    ('authorization', 'processing', 'failed'),
+    ('authorization', 'processing', 'cancelled'),
+    ('authorization', 'authorized', 'capture_pending'),
+    ('authorization', 'authorized', 'void_pending'),
+    ('authorization', 'authorized', 'voided'),
+    ('authorization', 'authorized', 'failed'),
+    ('authorization', 'capture_pending', 'completed'),
+    ('authorization', 'capture_pending', 'failed'),
+    ('authorization', 'void_pending', 'voided'),
+    ('authorization', 'void_pending', 'authorized'),
+    ('authorization', 'void_pending', 'failed'),
+    ('authorization', 'completed', 'refunded')
+ON CONFLICT DO NOTHING;
+
+-- Rejects status updates that are not listed for the flow of the transaction, a transaction is only refunded once its completed refunds
+-- add up to its amount so the ledger has given the money back
+CREATE OR REPLACE FUNCTION enforce_transaction_status_transition() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.status = OLD.status THEN
+        RETURN NEW;
+    END IF;
+
+    IF NOT EXISTS (
+        SELECT 1 FROM transaction_status_transitions
+        WHERE flow = CASE WHEN NEW.authorized_amount IS NULL THEN 'payment' ELSE 'authorization' END
+          AND from_status = OLD.status AND to_status = NEW.status
+    ) THEN
+        RAISE EXCEPTION 'invalid transaction status transition from % to %', OLD.status, NEW.status
+            USING ERRCODE = 'check_violation';
+    END IF;
+
+    IF NEW.status = 'refunded' AND NEW.amount > (
+        SELECT COALESCE(SUM(amount), 0) FROM transactions
+        WHERE parent_transaction_id = NEW.transaction_id AND type = 'refund' AND status = 'completed'
+    ) THEN
+        RAISE EXCEPTION 'transaction % is refunded once its refunds complete', NEW.transaction_id
+            USING ERRCODE = 'check_violation';
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Transactions are sent to the gateway picked by the routing rules instead of a topic derived from the request format,
+-- rows created before that went to the gateway consuming the topic of their format
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS gateway VARCHAR(100);
+UPDATE transactions SET gateway = CASE WHEN data_format = 'application/json' THEN 'gateway_a' ELSE 'gateway_b' END WHERE gateway IS NULL;
+ALTER TABLE transactions ALTER COLUMN gateway SET NOT NULL;
+
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS gateway VARCHAR(100);
+UPDATE outbox SET gateway = CASE WHEN data_format = 'application/json' THEN 'gateway_a' ELSE 'gateway_b' END WHERE gateway IS NULL;
+ALTER TABLE outbox ALTER COLUMN gateway SET NOT NULL;
+
+-- Every attempt to publish a transaction message to a gateway, failed attempts make the relay fail over to the next eligible gateway
+CREATE TABLE IF NOT EXISTS gateway_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    gateway VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS gateway_attempts_transaction_idx ON gateway_attempts (transaction_id);
+
+-- Merchants calling the API, they authenticate with API keys of which only the SHA-256 hash is stored
+CREATE TABLE IF NOT EXISTS merchants (
+    merchant_id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Rotated keys get an expiry so they keep working for a grace period, revoked keys stop working right away
+CREATE TABLE IF NOT EXISTS merchant_api_keys (
+    id VARCHAR(255) PRIMARY KEY,
+    merchant_id VARCHAR(255) NOT NULL REFERENCES merchants (merchant_id),
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    prefix VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS merchant_api_keys_merchant_idx ON merchant_api_keys (merchant_id);
+
+-- Transactions record the merchant that created them, rows from before merchants existed have none
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS merchant_id VARCHAR(255) REFERENCES merchants (merchant_id);
+CREATE INDEX IF NOT EXISTS transactions_merchant_idx ON transactions (merchant_id) WHERE merchant_id IS NOT NULL;
+
+-- Accounts belong to the merchant that created them with its first deposit, clearing accounts belong to no merchant
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS merchant_id VARCHAR(255) REFERENCES merchants (merchant_id);
+
+-- Merchant requests run as payment_merchant with app.merchant_id set for the database transaction, row-level security limits
+-- that role to the rows of the merchant so a query missing its merchant filter can't read or change another merchant's data.
+-- The service role owns the tables and isn't subject to the policies, it serves gateway callbacks and the outbox relay.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'payment_merchant') THEN
+        CREATE ROLE payment_merchant NOLOGIN;
+    END IF;
+END $$;
+
+GRANT payment_merchant TO CURRENT_USER;
+
+GRANT SELECT, INSERT, UPDATE ON transactions, accounts TO payment_merchant;
+GRANT SELECT ON transaction_status_transitions, gateway_attempts TO payment_merchant;
+GRANT INSERT ON outbox, ledger_entries TO payment_merchant;
+GRANT USAGE ON ALL SEQUENCES IN SCHEMA public TO payment_merchant;
+
+ALTER TABLE transactions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE accounts ENABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS merchant_isolation ON transactions;
+CREATE POLICY merchant_isolation ON transactions TO payment_merchant
+    USING (merchant_id = current_setting('app.merchant_id', true))
+    WITH CHECK (merchant_id = current_setting('app.merchant_id', true));
+
+-- ledger postings of a merchant's transaction move money through the clearing accounts as well
+DROP POLICY IF EXISTS merchant_isolation ON accounts;
+CREATE POLICY merchant_isolation ON accounts TO payment_merchant
+    USING (merchant_id = current_setting('app.merchant_id', true) OR type = 'system')
+    WITH CHECK (merchant_id = current_setting('app.merchant_id', true) OR type = 'system');
+
+-- Idempotency keys are stored prefixed with the merchant ID so merchants choosing the same key never share a response
+ALTER TABLE idempotency_keys ALTER COLUMN idempotency_key TYPE VARCHAR(300);
+
+-- The transaction the request holding a key creates, a retry after the reservation expired answers with it instead of creating another one
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS transaction_id VARCHAR(255);
+
+-- Webhook endpoints merchants are sent transaction status changes at, the secret signs every event and is stored in clear as it is needed to sign
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id VARCHAR(255) PRIMARY KEY,
+    merchant_id VARCHAR(255) NOT NULL REFERENCES merchants (merchant_id),
+    url TEXT NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    disabled_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_endpoints_merchant_idx ON webhook_endpoints (merchant_id) WHERE disabled_at IS NULL;
+
+-- Webhook events are queued in the same database transaction as the status change and delivered like the outbox,
+-- an event that runs out of attempts is dead until the merchant redelivers it
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_id VARCHAR(255) NOT NULL,
+    endpoint_id VARCHAR(255) NOT NULL REFERENCES webhook_endpoints (id),
+    merchant_id VARCHAR(255) NOT NULL REFERENCES merchants (merchant_id),
+    transaction_id VARCHAR(255) NOT NULL REFERENCES transactions (transaction_id),
+    event_type VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_events_due_idx ON webhook_events (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_events_merchant_idx ON webhook_events (merchant_id, id);
+
+GRANT SELECT, INSERT, UPDATE ON webhook_endpoints, webhook_events TO payment_merchant;
+GRANT USAGE ON ALL SEQUENCES IN SCHEMA public TO payment_merchant;
+
+ALTER TABLE webhook_endpoints ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_events ENABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS merchant_isolation ON webhook_endpoints;
+CREATE POLICY merchant_isolation ON webhook_endpoints TO payment_merchant
+    USING (merchant_id = current_setting('app.merchant_id', true))
+    WITH CHECK (merchant_id = current_setting('app.merchant_id', true));
+
+DROP POLICY IF EXISTS merchant_isolation ON webhook_events;
+CREATE POLICY merchant_isolation ON webhook_events TO payment_merchant
+    USING (merchant_id = current_setting('app.merchant_id', true))
+    WITH CHECK (merchant_id = current_setting('app.merchant_id', true));
+
+-- The W3C trace context of the request that queued a message so the relay continues its trace, stored as a JSON object of headers
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS trace_context TEXT;
+
+-- The X-Request-ID of the request that queued a message so the relay's log lines and the Kafka message carry it
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS request_id VARCHAR(128);
+
+-- The claim of the relay holding a message, a relay only renews the lease of messages no other relay claimed since
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS lease_id VARCHAR(36);
+
+-- The claim of the dispatcher holding a webhook event, leased like outbox messages
+ALTER TABLE webhook_events ADD COLUMN IF NOT EXISTS lease_id VARCHAR(36);
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"payment-gateway/internal/models"
+
+	_ "github.com/lib/pq"
+)
+
+// returns the system account money in the given currency moves through while it is in transit with the payment gateways
+func clearingAccountID(currency string) string {
+	return "gateway_clearing_" + currency
+}
+
+var (
+	// returned when an account doesn't have enough available funds for a withdrawal
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	// returned when no account matches the given ID
+	ErrAccountNotFound = errors.New("account not found")
+
+	// returned when a transaction is in a different currency than its account
+	ErrCurrencyMismatch = errors.New("transaction currency does not match the account currency")
+)
+
+// retrieves the currency of an account, accounts of other merchants than the scope's are reported as not found
+func GetAccountCurrency(ctx context.Context, scope Scope, accountID string) (string, error) {
+	var currency string
+
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `SELECT currency FROM accounts WHERE account_id = $1 AND type = 'customer'`, accountID).Scan(&currency)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrAccountNotFound
+		}
+		return "", err
+	}
+
+	return currency, nil
+}
+
+// retrieves the balance of an account, accounts of other merchants than the scope's are reported as not found
+func GetAccountBalance(ctx context.Context, scope Scope, accountID string) (models.AccountBalance, error) {
+	var balance models.AccountBalance
+	var currency string
+
+	query := `SELECT account_id, currency, balance, reserved FROM accounts WHERE account_id = $1 AND type = 'customer'`
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, query, accountID).Scan(&balance.AccountID, &currency, &balance.Balance.MinorUnits, &balance.Reserved.MinorUnits)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return balance, ErrAccountNotFound
+		}
+		return balance, err
+	}
+
+	balance.Balance.Currency = currency
+	balance.Reserved.Currency = currency
+	balance.Available = models.Money{MinorUnits: balance.Balance.MinorUnits - balance.Reserved.MinorUnits, Currency: currency}
+
+	return balance, nil
+}
+
+// prepares the account of a new transaction, deposits make sure the account exists while withdrawals and refunds reserve their amount up front
+func prepareLedger(ctx context.Context, tx *sql.Tx, transaction models.Transaction) error {
+	if transaction.AccountID == "" {
+		return nil
+	}
+
+	switch transaction.Type {
+	case "deposit":
+		return ensureAccount(ctx, tx, transaction.AccountID, transaction.MerchantID, transaction.SettlementAmount.Currency)
+	case "withdrawal", "refund":
+		return reserveFunds(ctx, tx, transaction.AccountID, transaction.SettlementAmount)
+	default:
+		return nil
+	}
+}
+
+// creates the account for the merchant in the settlement currency of its first deposit and checks later deposits settle in the same currency, an account of another merchant isn't visible and is reported as not found
+func ensureAccount(ctx context.Context, tx *sql.Tx, accountID string, merchantID string, currency string) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO accounts (account_id, currency, merchant_id) VALUES ($1, $2, NULLIF($3, '')) ON CONFLICT DO NOTHING`, accountID, currency, merchantID); err != nil {
+		return err
+	}
+
+	var accountCurrency string
+	if err := tx.QueryRowContext(ctx, `SELECT currency FROM accounts WHERE account_id = $1 AND type = 'customer'`, accountID).Scan(&accountCurrency); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrAccountNotFound
+		}
+		return err
+	}
+
+	if accountCurrency != currency {
+		return ErrCurrencyMismatch
+	}
+
+	return nil
+}
+
+// reserves funds for a withdrawal if the account has enough available, the account row stays locked until the caller commits
+func reserveFunds(ctx context.Context, tx *sql.Tx, accountID string, amount models.Money) error {
+	var currency string
+	var available int64
+
+	query := `SELECT currency, balance - reserved FROM accounts WHERE account_id = $1 AND type = 'customer' FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, accountID).Scan(&currency, &available); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInsufficientFunds
+		}
+		return err
+	}
+
+	if currency != amount.Currency {
+		return ErrCurrencyMismatch
+	}
+
+	if available < amount.MinorUnits {
+		return ErrInsufficientFunds
+	}
+
+	_, err := tx.ExecContext(ctx, `UPDATE accounts SET reserved = reserved + $2, updated_at = NOW() WHERE account_id = $1`, accountID, amount.MinorUnits)
+	return err
+}
+
+// applies the ledger effect of a status change in the same database transaction as the status update
+func applyLedger(ctx context.Context, tx *sql.Tx, transaction models.Transaction, status string) error {
+	if transaction.AccountID == "" {
+		return nil
+	}
+
+	switch {
+	case transaction.Type == "deposit" && status == models.StatusCompleted:
+		return postEntries(ctx, tx, transaction.TransactionID, clearingAccountID(transaction.SettlementAmount.Currency), transaction.AccountID, transaction.SettlementAmount, 0)
+	case (transaction.Type == "withdrawal" || transaction.Type == "refund") && status == models.StatusCompleted:
+		return postEntries(ctx, tx, transaction.TransactionID, transaction.AccountID, clearingAccountID(transaction.SettlementAmount.Currency), transaction.SettlementAmount, transaction.SettlementAmount.MinorUnits)
+	case (transaction.Type == "withdrawal" || transaction.Type == "refund") && (status == models.StatusFailed || status == models.StatusCancelled || status == models.StatusVoided):
+		return releaseFunds(ctx, tx, transaction.AccountID, transaction.SettlementAmount)
+	default:
+		return nil
+	}
+}
+
+// moves the amount from one account to another writing a debit and a credit entry, the reserved amount of the debited account is consumed as well
+func postEntries(ctx context.Context, tx *sql.Tx, transactionID string, debitAccountID string, creditAccountID string, amount models.Money, reserved int64) error {
+	clearing := `INSERT INTO accounts (account_id, type, currency) VALUES ($1, 'system', $2) ON CONFLICT DO NOTHING`
+	if _, err := tx.ExecContext(ctx, clearing, clearingAccountID(amount.Currency), amount.Currency); err != nil {
+		return err
+	}
+
+	entries := `
+        INSERT INTO ledger_entries (transaction_id, account_id, amount, currency, created_at)
+        VALUES ($1, $2, $3, $6, NOW()), ($1, $4, $5, $6, NOW())`
+
+	if _, err := tx.ExecContext(ctx, entries, transactionID, debitAccountID, -amount.MinorUnits, creditAccountID, amount.MinorUnits, amount.Currency); err != nil {
+		return err
+	}
+
+	debit := `UPDATE accounts SET balance = balance - $2, reserved = reserved - $3, updated_at = NOW() WHERE account_id = $1`
+	if _, err := tx.ExecContext(ctx, debit, debitAccountID, amount.MinorUnits, reserved); err != nil {
+		return err
+	}
+
+	credit := `UPDATE accounts SET balance = balance + $2, updated_at = NOW() WHERE account_id = $1`
+	_, err := tx.ExecContext(ctx, credit, creditAccountID, amount.MinorUnits)
+	return err
+}
+
+// releases the funds reserved for a withdrawal or refund that didn't go through
+func releaseFunds(ctx context.Context, tx *sql.Tx, accountID string, amount models.Money) error {
+	query := `UPDATE accounts SET reserved = reserved - $2, updated_at = NOW() WHERE account_id = $1`
+
+	_, err := tx.ExecContext(ctx, query, accountID, amount.MinorUnits)
+	return err
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"payment-gateway/internal/models"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+var (
+	// returned when no merchant matches the given ID
+	ErrMerchantNotFound = errors.New("merchant not found")
+
+	// returned when no API key of the merchant matches the given ID
+	ErrAPIKeyNotFound = errors.New("api key not found")
+
+	// returned when an API key is unknown, revoked or expired
+	ErrInvalidAPIKey = errors.New("invalid api key")
+)
+
+// the columns every API key query reads, in the order scanAPIKey expects them
+const apiKeyColumns = `id, merchant_id, prefix, created_at, expires_at, revoked_at`
+
+// reads a row selected with apiKeyColumns into an API key
+func scanAPIKey(row rowScanner, key *models.APIKey) error {
+	var expiresAt, revokedAt sql.NullTime
+
+	if err := row.Scan(&key.ID, &key.MerchantID, &key.Prefix, &key.CreatedAt, &expiresAt, &revokedAt); err != nil {
+		return err
+	}
+
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+
+	return nil
+}
+
+// creates a merchant together with its first API key
+func CreateMerchant(ctx context.Context, merchant models.Merchant, key models.APIKey, keyHash string) (models.Merchant, models.APIKey, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return merchant, key, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO merchants (merchant_id, name, created_at) VALUES ($1, $2, NOW()) RETURNING created_at`
+	if err := tx.QueryRowContext(ctx, query, merchant.MerchantID, merchant.Name).Scan(&merchant.CreatedAt); err != nil {
+		return merchant, key, err
+	}
+
+	if err := insertAPIKey(ctx, tx, &key, keyHash); err != nil {
+		return merchant, key, err
+	}
+
+	return merchant, key, tx.Commit()
+}
+
+// stores the hash of a new API key filling in its creation time
+func insertAPIKey(ctx context.Context, tx *sql.Tx, key *models.APIKey, keyHash string) error {
+	query := `
+        INSERT INTO merchant_api_keys (id, merchant_id, key_hash, prefix, created_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        RETURNING created_at`
+
+	return tx.QueryRowContext(ctx, query, key.ID, key.MerchantID, keyHash, key.Prefix).Scan(&key.CreatedAt)
+}
+
+// issues a new API key for a merchant, its active keys keep working for the grace period and expire afterwards
+func RotateAPIKey(ctx context.Context, key models.APIKey, keyHash string, gracePeriod time.Duration) (models.APIKey, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return key, err
+	}
+	defer tx.Rollback()
+
+	// the merchant row is locked so concurrent rotations expire each other's keys in order
+	var merchantID string
+	err = tx.QueryRowContext(ctx, `SELECT merchant_id FROM merchants WHERE merchant_id = $1 FOR UPDATE`, key.MerchantID).Scan(&merchantID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return key, ErrMerchantNotFound
+		}
+		return key, err
+	}
+
+	expire := `
+        UPDATE merchant_api_keys
+        SET expires_at = NOW() + make_interval(secs => $2)
+        WHERE merchant_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW() + make_interval(secs => $2))`
+
+	if _, err := tx.ExecContext(ctx, expire, key.MerchantID, gracePeriod.Seconds()); err != nil {
+		return key, err
+	}
+
+	if err := insertAPIKey(ctx, tx, &key, keyHash); err != nil {
+		return key, err
+	}
+
+	return key, tx.Commit()
+}
+
+// revokes an API key of a merchant right away
+func RevokeAPIKey(ctx context.Context, merchantID string, keyID string) (models.APIKey, error) {
+	var key models.APIKey
+
+	query := `
+        UPDATE merchant_api_keys
+        SET revoked_at = COALESCE(revoked_at, NOW())
+        WHERE id = $1 AND merchant_id = $2
+        RETURNING ` + apiKeyColumns
+
+	if err := scanAPIKey(db.QueryRowContext(ctx, query, keyID, merchantID), &key); err != nil {
+		if err == sql.ErrNoRows {
+			return key, ErrAPIKeyNotFound
+		}
+		return key, err
+	}
+
+	return key, nil
+}
+
+// retrieves the API keys of a merchant newest first, including the revoked and expired ones
+func ListAPIKeys(ctx context.Context, merchantID string) ([]models.APIKey, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM merchants WHERE merchant_id = $1)`, merchantID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrMerchantNotFound
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM merchant_api_keys WHERE merchant_id = $1 ORDER BY created_at DESC, id`, merchantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var key models.APIKey
+		if err := scanAPIKey(rows, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// retrieves the merchant owning an active API key by the hash of the key
+func GetMerchantByAPIKey(ctx context.Context, keyHash string) (models.Merchant, error) {
+	var merchant models.Merchant
+
+	query := `
+        SELECT m.merchant_id, m.name, m.created_at
+        FROM merchant_api_keys k
+        JOIN merchants m ON m.merchant_id = k.merchant_id
+        WHERE k.key_hash = $1 AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > NOW())`
+
+	err := db.QueryRowContext(ctx, query, keyHash).Scan(&merchant.MerchantID, &merchant.Name, &merchant.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return merchant, ErrInvalidAPIKey
+		}
+		return merchant, err
+	}
+
+	return merchant, nil
+}
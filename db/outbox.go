@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"payment-gateway/internal/models"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+// adds a message to the outbox as part of the caller's database transaction
+func insertOutboxMessage(ctx context.Context, tx *sql.Tx, message models.OutboxMessage) error {
+	query := `
+        INSERT INTO outbox (transaction_id, data_format, gateway, payload, trace_context, request_id, status, created_at, next_attempt_at)
+        VALUES ($1, $2, $3, $4, $5, $6, 'pending', NOW(), NOW())`
+
+	traceContext, err := json.Marshal(message.TraceContext)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query, message.TransactionID, message.DataFormat, message.Gateway, string(message.Payload), string(traceContext), message.RequestID)
+	return err
+}
+
+// claims up to limit pending outbox messages that are due, claimed messages are hidden from other relays for the lease duration and carry the ID of the claim
+func ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMessage, error) {
+	query := `
+        UPDATE outbox
+        SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond', lease_id = $3
+        WHERE id IN (
+            SELECT id FROM outbox
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, transaction_id, data_format, gateway, payload, trace_context, request_id, attempts, created_at, lease_id`
+
+	rows, err := db.QueryContext(ctx, query, limit, lease.Milliseconds(), uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.OutboxMessage
+	for rows.Next() {
+		var message models.OutboxMessage
+		var payload string
+		var traceContext, requestID sql.NullString
+		if err := rows.Scan(&message.ID, &message.TransactionID, &message.DataFormat, &message.Gateway, &payload, &traceContext, &requestID, &message.Attempts, &message.CreatedAt, &message.LeaseID); err != nil {
+			return nil, err
+		}
+		message.Payload = []byte(payload)
+		message.RequestID = requestID.String
+
+		// messages queued before trace context was stored have none, their relay starts a new trace
+		if traceContext.Valid {
+			if err := json.Unmarshal([]byte(traceContext.String), &message.TraceContext); err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+// extends the lease of a claimed outbox message, returns false when the message was claimed by another relay or isn't pending anymore
+func RenewOutboxLease(ctx context.Context, message models.OutboxMessage, lease time.Duration) (bool, error) {
+	query := `
+        UPDATE outbox
+        SET next_attempt_at = NOW() + $3 * INTERVAL '1 millisecond'
+        WHERE id = $1 AND lease_id = $2 AND status = 'pending'`
+
+	result, err := db.ExecContext(ctx, query, message.ID, message.LeaseID, lease.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+
+	renewed, err := result.RowsAffected()
+	return renewed == 1, err
+}
+
+// marks an outbox message as published so it is never sent again
+func MarkOutboxMessagePublished(ctx context.Context, id int64) error {
+	query := `
+        UPDATE outbox
+        SET status = 'published', published_at = NOW(), attempts = attempts + 1, last_error = NULL
+        WHERE id = $1`
+
+	_, err := db.ExecContext(ctx, query, id)
+	return err
+}
+
+// records a failed publish attempt and schedules the next one after the given delay
+func RescheduleOutboxMessage(ctx context.Context, id int64, delay time.Duration, lastError string) error {
+	query := `
+        UPDATE outbox
+        SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond', last_error = $3
+        WHERE id = $1`
+
+	_, err := db.ExecContext(ctx, query, id, delay.Milliseconds(), lastError)
+	return err
+}
+
+// gives up on an outbox message after it ran out of attempts
+func MarkOutboxMessageFailed(ctx context.Context, id int64, lastError string) error {
+	query := `
+        UPDATE outbox
+        SET status = 'failed', attempts = attempts + 1, last_error = $2
+        WHERE id = $1`
+
+	_, err := db.ExecContext(ctx, query, id, lastError)
+	return err
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"payment-gateway/internal/models"
+
+	_ "github.com/lib/pq"
+)
+
+var (
+	// returned when the transaction isn't a completed deposit
+	ErrNotRefundable = errors.New("only completed deposits can be refunded")
+
+	// returned when a refund is larger than what is left to refund of its deposit
+	ErrRefundExceedsRemaining = errors.New("refund exceeds the remaining refundable amount")
+)
+
+// implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// retrieves the amount and settlement amount already refunded of a deposit, refunds that are still open count as well so their money can't be given back twice
+func GetRefundedAmounts(ctx context.Context, scope Scope, parentTransactionID string) (amount int64, settlementAmount int64, err error) {
+	err = scope.run(ctx, func(tx *sql.Tx) error {
+		amount, settlementAmount, err = refundedAmounts(ctx, tx, parentTransactionID)
+		return err
+	})
+	return amount, settlementAmount, err
+}
+
+// sums the open and completed refunds of a deposit with either the connection pool or a database transaction
+func refundedAmounts(ctx context.Context, q queryRower, parentTransactionID string) (int64, int64, error) {
+	var amount, settlementAmount int64
+
+	query := `
+        SELECT COALESCE(SUM(amount), 0), COALESCE(SUM(settlement_amount), 0)
+        FROM transactions
+        WHERE parent_transaction_id = $1 AND type = 'refund' AND status NOT IN ('failed', 'cancelled')`
+
+	err := q.QueryRowContext(ctx, query, parentTransactionID).Scan(&amount, &settlementAmount)
+	return amount, settlementAmount, err
+}
+
+// locks the deposit of a new refund and checks the refund fits in what is left to refund, the lock is held until the caller commits
+func checkRefundable(ctx context.Context, tx *sql.Tx, refund models.Transaction) error {
+	var transactionType, status, currency string
+	var amount, settlementAmount int64
+
+	query := `SELECT type, status, currency, amount, settlement_amount FROM transactions WHERE transaction_id = $1 FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, refund.ParentTransactionID).Scan(&transactionType, &status, &currency, &amount, &settlementAmount); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTransactionNotFound
+		}
+		return err
+	}
+
+	if transactionType != "deposit" || status != models.StatusCompleted {
+		return ErrNotRefundable
+	}
+
+	if currency != refund.Amount.Currency {
+		return ErrCurrencyMismatch
+	}
+
+	refundedAmount, refundedSettlementAmount, err := refundedAmounts(ctx, tx, refund.ParentTransactionID)
+	if err != nil {
+		return err
+	}
+
+	if refund.Amount.MinorUnits > amount-refundedAmount || refund.SettlementAmount.MinorUnits > settlementAmount-refundedSettlementAmount {
+		return ErrRefundExceedsRemaining
+	}
+
+	return nil
+}
+
+// marks the deposit refunded once its completed refunds add up to the whole deposit and queues the webhook events of that change
+func completeRefund(ctx context.Context, tx *sql.Tx, parentTransactionID string) error {
+	query := `
+        UPDATE transactions
+        SET status = 'refunded'
+        WHERE transaction_id = $1 AND status = 'completed' AND amount <= (
+            SELECT COALESCE(SUM(amount), 0) FROM transactions
+            WHERE parent_transaction_id = $1 AND type = 'refund' AND status = 'completed'
+        )
+        RETURNING ` + transactionColumns
+
+	var parent models.Transaction
+	if err := scanTransaction(tx.QueryRowContext(ctx, query, parentTransactionID), &parent); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	return insertWebhookEvents(ctx, tx, parent)
+}
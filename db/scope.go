@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// the role merchant scoped database transactions switch to, unlike the service role it is subject to the row-level security policies in init.sql
+const merchantRole = "payment_merchant"
+
+// the tenant a database call runs for, a merchant scope only sees the rows of its merchant even if a query forgets to filter on it
+type Scope struct {
+	merchantID string
+	system     bool
+}
+
+// scopes calls to the rows of one merchant, an empty merchant ID sees no rows at all
+func MerchantScope(merchantID string) Scope {
+	return Scope{merchantID: merchantID}
+}
+
+// scopes calls to the rows of every merchant, used for gateway callbacks, the outbox relay and operators only
+var SystemScope = Scope{system: true}
+
+// checks if a row of the merchant is visible in the scope, used for data read from outside the database such as the cache
+func (s Scope) Includes(merchantID string) bool {
+	return s.system || (s.merchantID != "" && s.merchantID == merchantID)
+}
+
+// begins a database transaction limited to the rows the scope may see, the role and merchant are reset when it ends
+func (s Scope) begin(ctx context.Context) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.system {
+		return tx, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `SET LOCAL ROLE `+merchantRole); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT set_config('app.merchant_id', $1, true)`, s.merchantID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// runs queries in a database transaction of the scope and commits it if they succeed
+func (s Scope) run(ctx context.Context, queries func(tx *sql.Tx) error) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := queries(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
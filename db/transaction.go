@@ -1,28 +1,146 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"payment-gateway/internal/models"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-// Saves a transaction
-func SaveTransaction(transaction models.Transaction) error {
+// returned when a transaction is not in a status the update can be applied to
+var ErrStatusConflict = errors.New("transaction status does not allow this update")
+
+// the columns every transaction query reads, in the order scanTransaction expects them
+const transactionColumns = `id, transaction_id, amount, currency, settlement_amount, settlement_currency, fx_rate, fx_rate_at,
+        type, status, data_format, created_at, COALESCE(account_id, ''), COALESCE(parent_transaction_id, ''), authorized_amount, gateway, COALESCE(merchant_id, '')`
+
+// implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// reads a row selected with transactionColumns into a transaction
+func scanTransaction(row rowScanner, transaction *models.Transaction) error {
+	var fxRate sql.NullString
+	var fxRateAt sql.NullTime
+	var authorizedAmount sql.NullInt64
+
+	err := row.Scan(&transaction.ID, &transaction.TransactionID, &transaction.Amount.MinorUnits, &transaction.Amount.Currency,
+		&transaction.SettlementAmount.MinorUnits, &transaction.SettlementAmount.Currency, &fxRate, &fxRateAt,
+		&transaction.Type, &transaction.Status, &transaction.DataFormat, &transaction.CreatedAt, &transaction.AccountID,
+		&transaction.ParentTransactionID, &authorizedAmount, &transaction.Gateway, &transaction.MerchantID)
+	if err != nil {
+		return err
+	}
+
+	transaction.FXRate = fxRate.String
+	if fxRateAt.Valid {
+		transaction.FXRateAt = &fxRateAt.Time
+	}
+	if authorizedAmount.Valid {
+		transaction.AuthorizedAmount = &models.Money{MinorUnits: authorizedAmount.Int64, Currency: transaction.Amount.Currency}
+	}
+
+	return nil
+}
+
+// Saves a transaction together with its outbox message in one database transaction so the message can't be lost if the service crashes before publishing, a merchant scope can only save transactions of its merchant
+func SaveTransaction(ctx context.Context, scope Scope, transaction models.Transaction, message models.OutboxMessage) error {
+	tx, err := scope.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a refund locks its deposit so concurrent refunds can't give back more than was deposited
+	if transaction.Type == "refund" {
+		if err := checkRefundable(ctx, tx, transaction); err != nil {
+			return err
+		}
+	}
+
+	// the account is prepared first so a withdrawal without enough funds is rejected before anything is written
+	if err := prepareLedger(ctx, tx, transaction); err != nil {
+		return err
+	}
+
+	// left nil so the column is stored as NULL for transactions that aren't authorizations
+	var authorizedAmount interface{}
+	if transaction.AuthorizedAmount != nil {
+		authorizedAmount = transaction.AuthorizedAmount.MinorUnits
+	}
+
 	query := `
-        INSERT INTO transactions (transaction_id, amount, type, status, created_at, data_format)
-        VALUES ($1, $2, $3, $4, NOW(), $5)`
+        INSERT INTO transactions (transaction_id, amount, currency, settlement_amount, settlement_currency, fx_rate, fx_rate_at, type, status, created_at, data_format, account_id, parent_transaction_id, authorized_amount, gateway, merchant_id)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::NUMERIC, $7, $8, $9, NOW(), $10, NULLIF($11, ''), NULLIF($12, ''), $13, $14, NULLIF($15, ''))`
 
-	_, err := db.Exec(query, transaction.TransactionID, transaction.Amount, transaction.Type, transaction.Status, transaction.DataFormat)
-	return err
+	if _, err := tx.ExecContext(ctx, query, transaction.TransactionID, transaction.Amount.MinorUnits, transaction.Amount.Currency,
+		transaction.SettlementAmount.MinorUnits, transaction.SettlementAmount.Currency, transaction.FXRate, transaction.FXRateAt,
+		transaction.Type, transaction.Status, transaction.DataFormat, transaction.AccountID, transaction.ParentTransactionID, authorizedAmount, transaction.Gateway, transaction.MerchantID); err != nil {
+		return err
+	}
+
+	if err := insertOutboxMessage(ctx, tx, message); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// updates the status of a transaction based on the transaction ID
-func UpdateTransactionStatus(transactionID string, status string) error {
+// updates the status of a transaction based on the transaction ID together with its ledger postings and webhook events and returns the updated transaction, the update only applies while the transaction is in one of the given statuses so concurrent callbacks can't skip the state machine or post twice
+func UpdateTransactionStatus(ctx context.Context, scope Scope, transactionID string, status string, paymentFromStatuses []string, authorizationFromStatuses []string) (models.Transaction, error) {
+	var transaction models.Transaction
+
+	tx, err := scope.begin(ctx)
+	if err != nil {
+		return transaction, err
+	}
+	defer tx.Rollback()
+
 	query := `
         UPDATE transactions
         SET status = $1
-        WHERE transaction_id = $2`
+        WHERE transaction_id = $2
+          AND status = ANY(CASE WHEN authorized_amount IS NULL THEN $3::VARCHAR[] ELSE $4::VARCHAR[] END)
+        RETURNING ` + transactionColumns
+
+	err = scanTransaction(tx.QueryRowContext(ctx, query, status, transactionID, pq.Array(paymentFromStatuses), pq.Array(authorizationFromStatuses)), &transaction)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return transaction, statusConflictOrNotFound(ctx, tx, transactionID)
+		}
+		return transaction, err
+	}
+
+	if err := applyLedger(ctx, tx, transaction, status); err != nil {
+		return transaction, err
+	}
+
+	if err := insertWebhookEvents(ctx, tx, transaction); err != nil {
+		return transaction, err
+	}
+
+	if transaction.Type == "refund" && status == models.StatusCompleted {
+		if err := completeRefund(ctx, tx, transaction.ParentTransactionID); err != nil {
+			return transaction, err
+		}
+	}
+
+	return transaction, tx.Commit()
+}
+
+// tells apart a transaction that doesn't exist in the scope of the database transaction from one that is in an unexpected status after a conditional update matched nothing
+func statusConflictOrNotFound(ctx context.Context, tx *sql.Tx, transactionID string) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = $1)`, transactionID).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrTransactionNotFound
+	}
 
-	_, err := db.Exec(query, status, transactionID)
-	return err
+	return ErrStatusConflict
 }
@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"payment-gateway/internal/models"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+var (
+	// returned when no active webhook endpoint of the merchant matches the given ID
+	ErrWebhookEndpointNotFound = errors.New("webhook endpoint not found")
+
+	// returned when no webhook event of the merchant matches the given ID
+	ErrWebhookEventNotFound = errors.New("webhook event not found")
+)
+
+// the columns every webhook event query reads, in the order scanWebhookEvent expects them
+const webhookEventColumns = `e.id, e.event_id, e.endpoint_id, e.transaction_id, e.event_type, e.status, e.attempts, COALESCE(e.last_error, ''), e.created_at, e.next_attempt_at, e.delivered_at`
+
+// reads a row selected with webhookEventColumns into a webhook event, the next attempt is only kept while the event is pending
+func scanWebhookEvent(row rowScanner, event *models.WebhookEvent, extra ...interface{}) error {
+	var nextAttemptAt, deliveredAt sql.NullTime
+
+	dest := []interface{}{&event.ID, &event.EventID, &event.EndpointID, &event.TransactionID, &event.Type, &event.Status, &event.Attempts, &event.LastError, &event.CreatedAt, &nextAttemptAt, &deliveredAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+
+	if nextAttemptAt.Valid && event.Status == models.WebhookEventPending {
+		event.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		event.DeliveredAt = &deliveredAt.Time
+	}
+
+	return nil
+}
+
+// registers a webhook endpoint of the merchant filling in its creation time
+func CreateWebhookEndpoint(ctx context.Context, scope Scope, endpoint models.WebhookEndpoint) (models.WebhookEndpoint, error) {
+	query := `
+        INSERT INTO webhook_endpoints (id, merchant_id, url, secret, created_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        RETURNING created_at`
+
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, query, endpoint.ID, endpoint.MerchantID, endpoint.URL, endpoint.Secret).Scan(&endpoint.CreatedAt)
+	})
+	return endpoint, err
+}
+
+// retrieves the active webhook endpoints in the scope oldest first, without their secrets
+func ListWebhookEndpoints(ctx context.Context, scope Scope) ([]models.WebhookEndpoint, error) {
+	endpoints := []models.WebhookEndpoint{}
+
+	query := `SELECT id, merchant_id, url, created_at FROM webhook_endpoints WHERE disabled_at IS NULL ORDER BY created_at, id`
+
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var endpoint models.WebhookEndpoint
+			if err := rows.Scan(&endpoint.ID, &endpoint.MerchantID, &endpoint.URL, &endpoint.CreatedAt); err != nil {
+				return err
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		return rows.Err()
+	})
+	return endpoints, err
+}
+
+// disables a webhook endpoint, its pending events are moved to dead as they can't be delivered anymore
+func DeleteWebhookEndpoint(ctx context.Context, scope Scope, endpointID string) (models.WebhookEndpoint, error) {
+	var endpoint models.WebhookEndpoint
+
+	query := `
+        UPDATE webhook_endpoints
+        SET disabled_at = NOW()
+        WHERE id = $1 AND disabled_at IS NULL
+        RETURNING id, merchant_id, url, created_at`
+
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, query, endpointID).Scan(&endpoint.ID, &endpoint.MerchantID, &endpoint.URL, &endpoint.CreatedAt); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrWebhookEndpointNotFound
+			}
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `UPDATE webhook_events SET status = 'dead', last_error = 'endpoint deleted' WHERE endpoint_id = $1 AND status = 'pending'`, endpointID)
+		return err
+	})
+	return endpoint, err
+}
+
+// queues an event about the new status of a transaction for every active webhook endpoint of its merchant as part of the caller's database transaction
+func insertWebhookEvents(ctx context.Context, tx *sql.Tx, transaction models.Transaction) error {
+	if transaction.MerchantID == "" {
+		return nil
+	}
+
+	event := models.WebhookPayload{
+		EventID:     uuid.New().String(),
+		Type:        "transaction." + transaction.Status,
+		CreatedAt:   time.Now().UTC(),
+		Transaction: transaction,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO webhook_events (event_id, endpoint_id, merchant_id, transaction_id, event_type, payload, status, created_at, next_attempt_at)
+        SELECT $1, id, merchant_id, $3, $4, $5, 'pending', NOW(), NOW()
+        FROM webhook_endpoints
+        WHERE merchant_id = $2 AND disabled_at IS NULL`
+
+	_, err = tx.ExecContext(ctx, query, event.EventID, transaction.MerchantID, transaction.TransactionID, event.Type, string(payload))
+	return err
+}
+
+// claims up to limit pending webhook events that are due together with the URL and secret of their endpoint, claimed events are hidden from other dispatchers for the lease duration
+// and carry the ID of the claim
+func ClaimWebhookEvents(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookEvent, error) {
+	query := `
+        UPDATE webhook_events e
+        SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond', lease_id = $3
+        FROM webhook_endpoints w
+        WHERE w.id = e.endpoint_id AND e.id IN (
+            SELECT id FROM webhook_events
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING ` + webhookEventColumns + `, e.payload, w.url, w.secret, e.lease_id`
+
+	rows, err := db.QueryContext(ctx, query, limit, lease.Milliseconds(), uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.WebhookEvent
+	for rows.Next() {
+		var event models.WebhookEvent
+		var payload string
+		if err := scanWebhookEvent(rows, &event, &payload, &event.EndpointURL, &event.EndpointSecret, &event.LeaseID); err != nil {
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// extends the lease of a claimed webhook event, returns false when the event was claimed by another dispatcher or isn't pending anymore
+func RenewWebhookEventLease(ctx context.Context, event models.WebhookEvent, lease time.Duration) (bool, error) {
+	query := `
+        UPDATE webhook_events
+        SET next_attempt_at = NOW() + $3 * INTERVAL '1 millisecond'
+        WHERE id = $1 AND lease_id = $2 AND status = 'pending'`
+
+	result, err := db.ExecContext(ctx, query, event.ID, event.LeaseID, lease.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+
+	renewed, err := result.RowsAffected()
+	return renewed == 1, err
+}
+
+// marks a webhook event as delivered so it is only sent again when redelivered
+func MarkWebhookEventDelivered(ctx context.Context, id int64) error {
+	query := `
+        UPDATE webhook_events
+        SET status = 'delivered', delivered_at = NOW(), attempts = attempts + 1, last_error = NULL
+        WHERE id = $1`
+
+	_, err := db.ExecContext(ctx, query, id)
+	return err
+}
+
+// records a failed delivery attempt and schedules the next one after the given delay
+func RescheduleWebhookEvent(ctx context.Context, id int64, delay time.Duration, lastError string) error {
+	query := `
+        UPDATE webhook_events
+        SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond', last_error = $3
+        WHERE id = $1`
+
+	_, err := db.ExecContext(ctx, query, id, delay.Milliseconds(), lastError)
+	return err
+}
+
+// moves a webhook event to the dead-letter state after it ran out of attempts
+func MarkWebhookEventDead(ctx context.Context, id int64, lastError string) error {
+	query := `
+        UPDATE webhook_events
+        SET status = 'dead', attempts = attempts + 1, last_error = $2
+        WHERE id = $1`
+
+	_, err := db.ExecContext(ctx, query, id, lastError)
+	return err
+}
+
+// retrieves the webhook events in the scope newest first, optionally only those in the given status or of the given transaction
+func ListWebhookEvents(ctx context.Context, scope Scope, status string, transactionID string, limit int) ([]models.WebhookEvent, error) {
+	events := []models.WebhookEvent{}
+
+	query := `
+        SELECT ` + webhookEventColumns + `
+        FROM webhook_events e
+        WHERE ($1 = '' OR e.status = $1) AND ($2 = '' OR e.transaction_id = $2)
+        ORDER BY e.id DESC
+        LIMIT $3`
+
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, status, transactionID, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var event models.WebhookEvent
+			if err := scanWebhookEvent(rows, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return rows.Err()
+	})
+	return events, err
+}
+
+// queues a webhook event for delivery again right away with a fresh set of attempts, events of deleted endpoints can't be redelivered
+func RedeliverWebhookEvent(ctx context.Context, scope Scope, id int64) (models.WebhookEvent, error) {
+	var event models.WebhookEvent
+
+	query := `
+        UPDATE webhook_events e
+        SET status = 'pending', attempts = 0, next_attempt_at = NOW(), last_error = NULL, delivered_at = NULL
+        FROM webhook_endpoints w
+        WHERE e.id = $1 AND w.id = e.endpoint_id AND w.disabled_at IS NULL
+        RETURNING ` + webhookEventColumns
+
+	err := scope.run(ctx, func(tx *sql.Tx) error {
+		if err := scanWebhookEvent(tx.QueryRowContext(ctx, query, id), &event); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrWebhookEventNotFound
+			}
+			return err
+		}
+		return nil
+	})
+	return event, err
+}
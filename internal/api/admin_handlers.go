@@ -0,0 +1,218 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/resilience"
+	"payment-gateway/internal/services"
+
+	"github.com/gorilla/mux"
+)
+
+// replaces the FX rates of the given currency pairs, pairs that aren't sent keep their current rate
+func UpdateFXRatesHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.FXRatesRequest
+
+	if err := services.DecodeRequest(r, &request); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, "Invalid request format", r.Header.Get("Content-Type"))
+		return
+	}
+
+	if err := services.ValidateFXRates(request.Rates); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, err.Error(), r.Header.Get("Content-Type"))
+		return
+	}
+
+	if err := services.SaveFXRates(r.Context(), request.Rates); err != nil {
+		if services.RespondIfOverloaded(w, err, r.Header.Get("Content-Type")) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to save fx rates", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to save FX rates", r.Header.Get("Content-Type"))
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "FX rates updated successfully",
+	}, r.Header.Get("Content-Type"))
+}
+
+// returns all stored FX rates
+func ListFXRatesHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+
+	rates, err := services.ListFXRates(r.Context())
+	if err != nil {
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to retrieve fx rates", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve FX rates", contentType)
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "FX rates retrieved successfully",
+		Data:       models.FXRatesRequest{Rates: rates},
+	}, contentType)
+}
+
+// returns the state and counts of every gateway circuit breaker
+func ListCircuitBreakersHandler(w http.ResponseWriter, r *http.Request) {
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Circuit breakers retrieved successfully",
+		Data:       models.CircuitBreakersResponse{Breakers: services.ListCircuitBreakers()},
+	}, services.NegotiateContentType(r))
+}
+
+// forces a gateway circuit breaker open or closed during incidents, auto hands it back to its own state machine
+func OverrideCircuitBreakerHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.CircuitBreakerOverrideRequest
+	contentType := r.Header.Get("Content-Type")
+
+	if err := services.DecodeRequest(r, &request); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, "Invalid request format", contentType)
+		return
+	}
+
+	status, err := services.OverrideCircuitBreaker(r.Context(), mux.Vars(r)["name"], request.Override)
+	if err != nil {
+		switch {
+		case errors.Is(err, resilience.ErrInvalidOverride):
+			services.RespondWithError(w, http.StatusBadRequest, err.Error(), contentType)
+		case errors.Is(err, resilience.ErrBreakerNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		default:
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to override circuit breaker", contentType)
+		}
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Circuit breaker updated successfully",
+		Data:       status,
+	}, contentType)
+}
+
+// creates a merchant and returns its first API key, the key is only shown in this response
+func CreateMerchantHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.MerchantRequest
+	contentType := r.Header.Get("Content-Type")
+
+	if err := services.DecodeRequest(r, &request); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, "Invalid request format", contentType)
+		return
+	}
+
+	if err := services.ValidateMerchantRequest(request); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, err.Error(), contentType)
+		return
+	}
+
+	credentials, err := services.CreateMerchant(r.Context(), request)
+	if err != nil {
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to create merchant", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to create merchant", contentType)
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusCreated,
+		Message:    "Merchant created successfully",
+		Data:       credentials,
+	}, contentType)
+}
+
+// issues a new API key for a merchant, an optional grace period keeps the previous keys working while the merchant switches over
+func RotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.RotateAPIKeyRequest
+	contentType := r.Header.Get("Content-Type")
+
+	if err := decodeOptionalRequest(r, &request); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, "Invalid request format", contentType)
+		return
+	}
+
+	key, err := services.RotateAPIKey(r.Context(), mux.Vars(r)["id"], request)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrMerchantNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		case errors.Is(err, services.ErrInvalidGracePeriod):
+			services.RespondWithError(w, http.StatusBadRequest, err.Error(), contentType)
+		default:
+			slog.ErrorContext(r.Context(), "failed to rotate api key", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to rotate API key", contentType)
+		}
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusCreated,
+		Message:    "API key rotated successfully",
+		Data:       key,
+	}, contentType)
+}
+
+// revokes an API key of a merchant, requests with it are refused from then on
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+	vars := mux.Vars(r)
+
+	key, err := services.RevokeAPIKey(r.Context(), vars["id"], vars["key"])
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrAPIKeyNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		default:
+			slog.ErrorContext(r.Context(), "failed to revoke api key", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke API key", contentType)
+		}
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "API key revoked successfully",
+		Data:       key,
+	}, contentType)
+}
+
+// lists the API keys of a merchant with their prefixes, the keys themselves are never returned again
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+
+	keys, err := services.ListAPIKeys(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrMerchantNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		default:
+			slog.ErrorContext(r.Context(), "failed to retrieve api keys", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve API keys", contentType)
+		}
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "API keys retrieved successfully",
+		Data:       models.APIKeysResponse{APIKeys: keys},
+	}, contentType)
+}
@@ -1,30 +1,39 @@
 package api
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"log"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
 	"payment-gateway/db"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/middleware"
 	"payment-gateway/internal/models"
-	"payment-gateway/internal/security"
 	"payment-gateway/internal/services"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 // handles deposit requests
 func DepositHandler(w http.ResponseWriter, r *http.Request) {
-	handleTransaction(w, r, "deposit")
+	handleTransaction(w, r, "deposit", false)
+}
+
+// handles card-style deposits that only hold the amount until they are captured or voided
+func AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	handleTransaction(w, r, "deposit", true)
 }
 
 // handles withdrawal requests
 func WithdrawalHandler(w http.ResponseWriter, r *http.Request) {
-	handleTransaction(w, r, "withdrawal")
+	handleTransaction(w, r, "withdrawal", false)
 }
 
-// processes both deposit and withdrawal requests in same logic
-func handleTransaction(w http.ResponseWriter, r *http.Request, transactionType string) {
+// processes deposit, withdrawal and authorization requests in same logic
+func handleTransaction(w http.ResponseWriter, r *http.Request, transactionType string, authorize bool) {
 	var request models.TransactionRequest
 
 	// Decode the request based on content type
@@ -37,7 +46,8 @@ func handleTransaction(w http.ResponseWriter, r *http.Request, transactionType s
 	}
 
 	// Validate the transaction request (data fields)
-	if err := services.ValidateTransactionRequest(request); err != nil {
+	amount, err := services.ValidateTransactionRequest(request)
+	if err != nil {
 		services.RespondWithTransaction(w, models.APIResponse{
 			StatusCode: http.StatusBadRequest,
 			Message:    err.Error(),
@@ -45,60 +55,325 @@ func handleTransaction(w http.ResponseWriter, r *http.Request, transactionType s
 		return
 	}
 
-	// Generate a unique transaction ID and create a transaction object
+	// The transaction belongs to the merchant whose API key authenticated the request
+	merchantID := ""
+	if merchant, ok := middleware.MerchantFromContext(r.Context()); ok {
+		merchantID = merchant.MerchantID
+	}
+
+	// Generate a unique transaction ID, it is recorded with the Idempotency-Key so a retry after a crash finds the transaction
 	transactionID := uuid.New().String()
+	r = r.WithContext(logging.WithTransaction(r.Context(), transactionID))
+
+	// Replay the stored response when the client retries a request with the same Idempotency-Key, keys are stored per merchant
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	requestHash := ""
+	if idempotencyKey != "" {
+		if err := services.ValidateIdempotencyKey(idempotencyKey); err != nil {
+			services.RespondWithTransaction(w, models.APIResponse{
+				StatusCode: http.StatusBadRequest,
+				Message:    err.Error(),
+			}, r.Header.Get("Content-Type"))
+			return
+		}
+
+		operation := transactionType
+		if authorize {
+			operation = models.MessageTypeAuthorize
+		}
+
+		idempotencyKey = services.MerchantIdempotencyKey(merchantID, idempotencyKey)
+		requestHash = services.HashRequest(operation, request)
+		replay, err := services.BeginIdempotentRequest(r.Context(), idempotencyKey, requestHash, transactionID)
+		if err != nil {
+			if services.RespondIfOverloaded(w, err, r.Header.Get("Content-Type")) {
+				return
+			}
 
+			statusCode := http.StatusInternalServerError
+			message := "Failed to check idempotency key"
+			if errors.Is(err, services.ErrIdempotencyKeyConflict) || errors.Is(err, services.ErrIdempotencyKeyInProgress) {
+				statusCode = http.StatusConflict
+				message = err.Error()
+			} else {
+				slog.ErrorContext(r.Context(), "failed to check idempotency key", slog.Any("error", err))
+			}
+
+			services.RespondWithTransaction(w, models.APIResponse{
+				StatusCode: statusCode,
+				Message:    message,
+			}, r.Header.Get("Content-Type"))
+			return
+		}
+
+		if replay != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			services.RespondWithTransaction(w, *replay, r.Header.Get("Content-Type"))
+			return
+		}
+
+		// Free the key when the request fails so the client can retry it, storing the response below clears the key first.
+		// It is freed even when the client went away so its retry isn't stuck behind the key
+		defer func() {
+			if idempotencyKey == "" {
+				return
+			}
+			if err := services.ReleaseIdempotentRequest(context.WithoutCancel(r.Context()), idempotencyKey); err != nil {
+				slog.ErrorContext(r.Context(), "failed to release idempotency key", slog.Any("error", err))
+			}
+		}()
+	}
+
+	// Create a transaction object with the ID generated before the idempotency check
 	transaction := models.Transaction{
 		TransactionID: transactionID,
-		Amount:        request.Amount,
+		Amount:        amount,
 		Type:          transactionType,
-		Status:        "pending",
+		Status:        models.StatusPending,
 		DataFormat:    r.Header.Get("Content-Type"),
+		AccountID:     request.AccountID,
+		MerchantID:    merchantID,
+	}
+
+	// An authorization keeps the held amount aside, the captured amount may be lower
+	if authorize {
+		authorizedAmount := amount
+		transaction.AuthorizedAmount = &authorizedAmount
+	}
+
+	// Convert the amount into the currency the account settles in, the rate is locked on the transaction so the ledger posts the same amount on completion
+	settlementCurrency, err := services.ResolveSettlementCurrency(r.Context(), merchantScope(r), request, amount)
+	if err == nil {
+		err = services.ApplySettlement(r.Context(), &transaction, settlementCurrency)
 	}
+	if err != nil {
+		if errors.Is(err, services.ErrFXRateNotFound) || errors.Is(err, services.ErrSettlementAmountTooSmall) {
+			services.RespondWithTransaction(w, models.APIResponse{
+				StatusCode: http.StatusUnprocessableEntity,
+				Message:    err.Error(),
+			}, r.Header.Get("Content-Type"))
+			return
+		}
 
-	// Save transaction in the database and Redis concurrently
-	if err := services.SaveTransaction(transaction); err != nil {
+		if services.RespondIfOverloaded(w, err, r.Header.Get("Content-Type")) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to convert transaction amount", slog.Any("error", err))
 		services.RespondWithTransaction(w, models.APIResponse{
 			StatusCode: http.StatusInternalServerError,
-			Message:    "Failed to save transaction",
+			Message:    "Failed to convert transaction amount",
 		}, r.Header.Get("Content-Type"))
 		return
 	}
 
-	// Serialize transaction data for Kafka
-	transactionData, err := json.Marshal(transaction)
+	// Pick the gateway from the routing rules so the response shows where the transaction was sent
+	transaction.Gateway, err = services.RouteTransaction(transaction)
 	if err != nil {
 		services.RespondWithTransaction(w, models.APIResponse{
-			StatusCode: http.StatusInternalServerError,
-			Message:    "Failed to serialize transaction data",
+			StatusCode: http.StatusUnprocessableEntity,
+			Message:    err.Error(),
 		}, r.Header.Get("Content-Type"))
 		return
 	}
+	r = r.WithContext(logging.WithGateway(r.Context(), transaction.Gateway))
 
-	// Mask the transaction data before sending it to Kafka for better security
-	maskedData := security.MaskData(transactionData)
+	// Save transaction in the database and Redis concurrently, the outbox relay publishes it to Kafka afterwards so the request doesn't depend on the broker
+	if err := services.SaveTransaction(r.Context(), transaction); err != nil {
+		if errors.Is(err, db.ErrInsufficientFunds) || errors.Is(err, db.ErrCurrencyMismatch) || errors.Is(err, db.ErrAccountNotFound) {
+			services.RespondWithTransaction(w, models.APIResponse{
+				StatusCode: http.StatusUnprocessableEntity,
+				Message:    err.Error(),
+			}, r.Header.Get("Content-Type"))
+			return
+		}
 
-	// Publish transaction to Kafka
-	ctx := context.Background()
-	if err := services.PublishTransaction(ctx, transaction.TransactionID, []byte(maskedData), r.Header.Get("Content-Type")); err != nil {
-		log.Printf("failed to publish transaction to Kafka: %v", err)
-
-		// Mark the transaction as failed after the circuit breaker threshold to prevent any duplicate processing
-		db.UpdateTransactionStatus(transaction.TransactionID, "failed")
+		if services.RespondIfOverloaded(w, err, r.Header.Get("Content-Type")) {
+			return
+		}
 
 		services.RespondWithTransaction(w, models.APIResponse{
 			StatusCode: http.StatusInternalServerError,
-			Message:    "Failed to process request due to publishing error",
+			Message:    "Failed to save transaction",
 		}, r.Header.Get("Content-Type"))
 		return
 	}
 
+	response := models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    services.TransactionCreatedMessage,
+		Data:       transaction,
+	}
+
+	// Store the response for retries with the same Idempotency-Key, the key stays reserved even if this fails so a retry can't create a second transaction.
+	// The transaction exists by now so the response is stored even when the client went away
+	if idempotencyKey != "" {
+		if err := services.CompleteIdempotentRequest(context.WithoutCancel(r.Context()), idempotencyKey, requestHash, response); err != nil {
+			slog.ErrorContext(r.Context(), "failed to store idempotent response", slog.Any("error", err))
+		}
+		idempotencyKey = ""
+	}
+
 	// Success Response
+	services.RespondWithTransaction(w, response, r.Header.Get("Content-Type"))
+}
+
+// refunds a completed deposit fully or partially, each refund is a child transaction tracked through its own callbacks
+func RefundHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.TransactionRequest
+	contentType := r.Header.Get("Content-Type")
+
+	// An empty body refunds the remaining amount
+	if err := decodeOptionalRequest(r, &request); err != nil {
+		services.RespondWithError(w, http.StatusUnsupportedMediaType, "Invalid request format", contentType)
+		return
+	}
+
+	r = r.WithContext(logging.WithTransaction(r.Context(), mux.Vars(r)["id"]))
+	parent, err := services.GetRefundableTransaction(r.Context(), merchantScope(r), mux.Vars(r)["id"])
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrTransactionNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		case errors.Is(err, db.ErrNotRefundable):
+			services.RespondWithError(w, http.StatusUnprocessableEntity, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		default:
+			slog.ErrorContext(r.Context(), "failed to retrieve transaction to refund", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve transaction", contentType)
+		}
+		return
+	}
+
+	amount, err := services.ValidateRefundRequest(request, parent)
+	if err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, err.Error(), contentType)
+		return
+	}
+
+	// The deposit is locked while the refund is saved so concurrent refunds can't exceed the deposit
+	refund, err := services.CreateRefund(r.Context(), parent, amount)
+	if err != nil {
+		if errors.Is(err, db.ErrRefundExceedsRemaining) || errors.Is(err, db.ErrNotRefundable) || errors.Is(err, db.ErrInsufficientFunds) {
+			services.RespondWithError(w, http.StatusUnprocessableEntity, err.Error(), contentType)
+			return
+		}
+
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to create refund", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to create refund", contentType)
+		return
+	}
+
 	services.RespondWithTransaction(w, models.APIResponse{
 		StatusCode: http.StatusOK,
-		Message:    "Transaction processed successfully",
+		Message:    "Refund processed successfully",
+		Data:       refund,
+	}, contentType)
+}
+
+// captures an authorization fully or partially, the gateway reports the result through a callback
+func CaptureHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.TransactionRequest
+	contentType := r.Header.Get("Content-Type")
+
+	// An empty body captures the whole authorized amount
+	if err := decodeOptionalRequest(r, &request); err != nil {
+		services.RespondWithError(w, http.StatusUnsupportedMediaType, "Invalid request format", contentType)
+		return
+	}
+
+	r = r.WithContext(logging.WithTransaction(r.Context(), mux.Vars(r)["id"]))
+	authorization, ok := getAuthorization(w, r)
+	if !ok {
+		return
+	}
+
+	amount, err := services.ValidateCaptureRequest(request, authorization)
+	if err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, err.Error(), contentType)
+		return
+	}
+
+	transaction, err := services.CaptureTransaction(r.Context(), authorization, amount)
+	respondWithAuthorizationUpdate(w, r, transaction, err, "Capture processed successfully")
+}
+
+// voids an authorization releasing its hold, the gateway reports the result through a callback
+func VoidHandler(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(logging.WithTransaction(r.Context(), mux.Vars(r)["id"]))
+	authorization, ok := getAuthorization(w, r)
+	if !ok {
+		return
+	}
+
+	transaction, err := services.VoidTransaction(r.Context(), authorization)
+	respondWithAuthorizationUpdate(w, r, transaction, err, "Void processed successfully")
+}
+
+// retrieves the authorization of a capture or void request and responds with the error if it can't be used
+func getAuthorization(w http.ResponseWriter, r *http.Request) (models.Transaction, bool) {
+	contentType := r.Header.Get("Content-Type")
+
+	authorization, err := services.GetAuthorizedTransaction(r.Context(), merchantScope(r), mux.Vars(r)["id"])
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrTransactionNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		case errors.Is(err, services.ErrNotAuthorized):
+			services.RespondWithError(w, http.StatusConflict, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		default:
+			slog.ErrorContext(r.Context(), "failed to retrieve authorization", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve transaction", contentType)
+		}
+		return authorization, false
+	}
+
+	return authorization, true
+}
+
+// responds to a capture or void request, an authorization that changed meanwhile is reported as a conflict
+func respondWithAuthorizationUpdate(w http.ResponseWriter, r *http.Request, transaction models.Transaction, err error, message string) {
+	contentType := r.Header.Get("Content-Type")
+
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidTransition) || errors.Is(err, db.ErrTransactionNotFound) {
+			services.RespondWithError(w, http.StatusConflict, err.Error(), contentType)
+			return
+		}
+
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to update authorization", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to update authorization", contentType)
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    message,
 		Data:       transaction,
-	}, r.Header.Get("Content-Type"))
+	}, contentType)
+}
+
+// decodes the request body if there is one, used by operations whose fields are all optional
+func decodeOptionalRequest(r *http.Request, request interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	return services.DecodePayload(bytes.NewReader(body), r.Header.Get("Content-Type"), request)
 }
 
 // handles callbacks from payment gateways
@@ -113,18 +388,43 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		}, r.Header.Get("Content-Type"))
 		return
 	}
+	r = r.WithContext(logging.WithTransaction(r.Context(), transactionRequest.TransactionID))
+
+	// Validate the callback request against the gateway SignatureMiddleware verified, illegal status transitions are reported as a conflict
+	gatewayID, _ := middleware.GatewayFromContext(r.Context())
+	if err := services.ValidateCallbackRequest(r.Context(), gatewayID, transactionRequest); err != nil {
+		if services.RespondIfOverloaded(w, err, r.Header.Get("Content-Type")) {
+			return
+		}
+
+		statusCode := http.StatusBadRequest
+		if errors.Is(err, services.ErrInvalidTransition) {
+			statusCode = http.StatusConflict
+		} else if errors.Is(err, services.ErrWrongGateway) {
+			statusCode = http.StatusForbidden
+		}
 
-	// Validate the callback request
-	if err := services.ValidateCallbackRequest(transactionRequest); err != nil {
 		services.RespondWithTransaction(w, models.APIResponse{
-			StatusCode: http.StatusBadRequest,
+			StatusCode: statusCode,
 			Message:    err.Error(),
 		}, r.Header.Get("Content-Type"))
 		return
 	}
 
-	// Update the transaction status in the database and Redis concurrently
-	if err := services.UpdateTransactionStatus(transactionRequest.TransactionID, transactionRequest.Status); err != nil {
+	// Update the transaction status in the database and Redis, the transition is checked again in case another callback changed it meanwhile
+	if err := services.UpdateTransactionStatus(r.Context(), transactionRequest.TransactionID, transactionRequest.Status); err != nil {
+		if errors.Is(err, services.ErrInvalidTransition) {
+			services.RespondWithTransaction(w, models.APIResponse{
+				StatusCode: http.StatusConflict,
+				Message:    err.Error(),
+			}, r.Header.Get("Content-Type"))
+			return
+		}
+
+		if services.RespondIfOverloaded(w, err, r.Header.Get("Content-Type")) {
+			return
+		}
+
 		services.RespondWithTransaction(w, models.APIResponse{
 			StatusCode: http.StatusInternalServerError,
 			Message:    "Failed to process request",
@@ -139,3 +439,66 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		Data:       transactionRequest,
 	}, r.Header.Get("Content-Type"))
 }
+
+// returns a single transaction so merchants can check its status without waiting for a callback
+func GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+	transactionID := mux.Vars(r)["id"]
+	r = r.WithContext(logging.WithTransaction(r.Context(), transactionID))
+
+	transaction, err := services.GetTransactionWithAttempts(r.Context(), merchantScope(r), transactionID)
+	if err != nil {
+		if errors.Is(err, db.ErrTransactionNotFound) {
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+			return
+		}
+
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to retrieve transaction", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve transaction", contentType)
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Transaction retrieved successfully",
+		Data:       transaction,
+	}, contentType)
+}
+
+// returns the current balance of an account
+func GetAccountBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+	accountID := mux.Vars(r)["id"]
+
+	balance, err := services.GetAccountBalance(r.Context(), merchantScope(r), accountID)
+	if err != nil {
+		if errors.Is(err, db.ErrAccountNotFound) {
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+			return
+		}
+
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to retrieve account balance", slog.String("account_id", accountID), slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve account balance", contentType)
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Account balance retrieved successfully",
+		Data:       balance,
+	}, contentType)
+}
+
+// returns the database scope of the merchant authenticated for the request, requests without a merchant see no transactions or accounts
+func merchantScope(r *http.Request) db.Scope {
+	merchant, _ := middleware.MerchantFromContext(r.Context())
+	return db.MerchantScope(merchant.MerchantID)
+}
@@ -2,16 +2,64 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"payment-gateway/db"
+	"payment-gateway/internal/gateways"
+	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/middleware"
 	"payment-gateway/internal/models"
 	"payment-gateway/internal/redis"
+	"payment-gateway/internal/security"
+	"payment-gateway/internal/services"
+	"strconv"
 	"testing"
+
+	"github.com/google/uuid"
+)
+
+// the merchant the tests call the API as and its API key
+var (
+	testMerchant models.Merchant
+	testAPIKey   string
+)
+
+// the gateway the test transactions are routed to and the secret it signs its callbacks with
+const (
+	testGateway       = "gateway_a"
+	testGatewaySecret = "test-secret"
 )
 
+// serves the router as the test merchant by adding its API key to requests that don't carry one
+func newMerchantServer() *httptest.Server {
+	router := SetupRouter()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(security.APIKeyHeader) == "" {
+			r.Header.Set(security.APIKeyHeader, testAPIKey)
+		}
+		router.ServeHTTP(w, r)
+	}))
+}
+
+// serves the callback handler behind the signature check and signs every request as the test gateway
+func newCallbackServer() *httptest.Server {
+	os.Setenv("GATEWAY_SECRETS", testGateway+"="+testGatewaySecret)
+	handler := middleware.SignatureMiddleware(http.HandlerFunc(CallbackHandler))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.Header.Set(security.GatewayIDHeader, testGateway)
+		r.Header.Set(security.SignatureHeader, security.CreateSignature(string(body), testGatewaySecret))
+		handler.ServeHTTP(w, r)
+	}))
+}
+
 func TestMain(m *testing.M) {
 	redis.InitRedis()
 
@@ -24,6 +72,16 @@ func TestMain(m *testing.M) {
 	dbURL := "postgres://" + dbUser + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName + "?sslmode=disable"
 	db.InitializeDB(dbURL)
 
+	if err := gateways.Configure(gateways.DefaultConfig); err != nil {
+		log.Fatalf("Could not configure gateways: %v", err)
+	}
+
+	credentials, err := services.CreateMerchant(context.Background(), models.MerchantRequest{Name: "Test Merchant"})
+	if err != nil {
+		log.Fatalf("Could not create test merchant: %v", err)
+	}
+	testMerchant, testAPIKey = credentials.Merchant, credentials.APIKey.Key
+
 	code := m.Run()
 	os.Exit(code)
 }
@@ -35,7 +93,9 @@ func TestValidDepositJSON(t *testing.T) {
 	defer server.Close()
 
 	reqBody := models.TransactionRequest{
-		Amount: 100.0,
+		Amount:    "100.00",
+		Currency:  "USD",
+		AccountID: uuid.New().String(),
 	}
 	reqBodyBytes, _ := json.Marshal(reqBody)
 
@@ -53,6 +113,8 @@ func TestValidDepositSOAP(t *testing.T) {
 	reqBody := `<?xml version="1.0" encoding="UTF-8"?>
 <transaction>
     <amount>100.0</amount>
+    <currency>USD</currency>
+    <account_id>` + uuid.New().String() + `</account_id>
 </transaction>`
 	res, err := http.Post(server.URL+"/deposit", "text/xml", bytes.NewBuffer([]byte(reqBody)))
 	if err != nil || res.StatusCode != http.StatusOK {
@@ -95,13 +157,43 @@ func TestInvalidDepositMissingAmountSOAP(t *testing.T) {
 }
 
 // Test WithdrawalHandler
+
+// deposits the amount into a new account and completes the deposit so withdrawals have funds to draw from
+func fundAccount(t *testing.T, amount int64) string {
+	return completeDeposit(t, amount).AccountID
+}
+
+// creates a completed deposit into a new account
+func completeDeposit(t *testing.T, amount int64) models.Transaction {
+	deposit := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: amount, Currency: "USD"},
+		Type:          "deposit",
+		Status:        models.StatusPending,
+		DataFormat:    "application/json",
+		AccountID:     uuid.New().String(),
+		MerchantID:    testMerchant.MerchantID,
+	}
+	if err := services.SaveTransaction(context.Background(), deposit); err != nil {
+		t.Fatalf("Expected no error saving deposit, got %v", err)
+	}
+	if err := services.UpdateTransactionStatus(context.Background(), deposit.TransactionID, models.StatusCompleted); err != nil {
+		t.Fatalf("Expected no error completing deposit, got %v", err)
+	}
+	return deposit
+}
+
 func TestValidWithdrawalJSON(t *testing.T) {
 	handler := http.HandlerFunc(WithdrawalHandler)
 	server := httptest.NewServer(handler)
 	defer server.Close()
 
+	accountID := fundAccount(t, 10000)
+
 	reqBody := models.TransactionRequest{
-		Amount: 50.0,
+		Amount:    "50.00",
+		Currency:  "USD",
+		AccountID: accountID,
 	}
 	reqBodyBytes, _ := json.Marshal(reqBody)
 
@@ -116,9 +208,13 @@ func TestValidWithdrawalSOAP(t *testing.T) {
 	server := httptest.NewServer(handler)
 	defer server.Close()
 
+	accountID := fundAccount(t, 10000)
+
 	reqBody := `<?xml version="1.0" encoding="UTF-8"?>
 <transaction>
     <amount>50.0</amount>
+    <currency>USD</currency>
+    <account_id>` + accountID + `</account_id>
 </transaction>`
 	res, err := http.Post(server.URL+"/withdrawal", "text/xml", bytes.NewBuffer([]byte(reqBody)))
 	if err != nil || res.StatusCode != http.StatusOK {
@@ -161,15 +257,32 @@ func TestInvalidWithdrawalMissingAmountSOAP(t *testing.T) {
 }
 
 // Test CallbackHandler
+
+// creates a pending transaction so callbacks have a real transaction to move through the state machine
+func createPendingTransaction(t *testing.T) string {
+	transaction := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 1000, Currency: "USD"},
+		Type:          "deposit",
+		Status:        models.StatusPending,
+		DataFormat:    "application/json",
+		MerchantID:    testMerchant.MerchantID,
+		Gateway:       testGateway,
+	}
+	if err := services.SaveTransaction(context.Background(), transaction); err != nil {
+		t.Fatalf("Expected no error saving transaction, got %v", err)
+	}
+	return transaction.TransactionID
+}
+
 func TestValidCallbackJSON(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
-	redis.SetTransactionStatus("trans1", "pending")
+	transactionID := createPendingTransaction(t)
 
 	reqBody := models.TransactionRequest{
-		TransactionID: "trans1",
+		TransactionID: transactionID,
 		Status:        "completed",
 	}
 	reqBodyBytes, _ := json.Marshal(reqBody)
@@ -181,15 +294,14 @@ func TestValidCallbackJSON(t *testing.T) {
 }
 
 func TestValidCallbackSOAP(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
-	redis.SetTransactionStatus("trans1", "pending")
+	transactionID := createPendingTransaction(t)
 
 	reqBody := `<?xml version="1.0" encoding="UTF-8"?>
 <transaction>
-    <transaction_id>trans1</transaction_id>
+    <transaction_id>` + transactionID + `</transaction_id>
     <status>completed</status>
 </transaction>`
 	res, err := http.Post(server.URL+"/callback", "text/xml", bytes.NewBuffer([]byte(reqBody)))
@@ -199,8 +311,7 @@ func TestValidCallbackSOAP(t *testing.T) {
 }
 
 func TestInvalidCallbackMissingTransactionID(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
 	reqBody := models.TransactionRequest{
@@ -218,8 +329,7 @@ func TestInvalidCallbackMissingTransactionID(t *testing.T) {
 }
 
 func TestInvalidCallbackMissingTransactionIDSOAP(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
 	reqBody := `<?xml version="1.0" encoding="UTF-8"?>
@@ -236,8 +346,7 @@ func TestInvalidCallbackMissingTransactionIDSOAP(t *testing.T) {
 }
 
 func TestInvalidCallbackTransactionNotFound(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
 	reqBody := models.TransactionRequest{
@@ -256,8 +365,7 @@ func TestInvalidCallbackTransactionNotFound(t *testing.T) {
 }
 
 func TestInvalidCallbackTransactionNotFoundSOAP(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
 	reqBody := `<?xml version="1.0" encoding="UTF-8"?>
@@ -275,11 +383,10 @@ func TestInvalidCallbackTransactionNotFoundSOAP(t *testing.T) {
 }
 
 func TestInvalidCallbackMissingStatus(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
-	redis.SetTransactionStatus("trans1", "pending")
+	redis.SetTransactionStatus(context.Background(), "trans1", "pending")
 
 	reqBody := models.TransactionRequest{
 		TransactionID: "trans1",
@@ -296,11 +403,10 @@ func TestInvalidCallbackMissingStatus(t *testing.T) {
 }
 
 func TestInvalidCallbackMissingStatusSOAP(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
-	redis.SetTransactionStatus("trans1", "pending")
+	redis.SetTransactionStatus(context.Background(), "trans1", "pending")
 
 	reqBody := `<?xml version="1.0" encoding="UTF-8"?>
 <transaction>
@@ -322,7 +428,8 @@ func TestInvalidContentTypeDeposit(t *testing.T) {
 	defer server.Close()
 
 	reqBody := models.TransactionRequest{
-		Amount: 100.0,
+		Amount:   "100.00",
+		Currency: "USD",
 	}
 	reqBodyBytes, _ := json.Marshal(reqBody)
 
@@ -338,7 +445,8 @@ func TestInvalidContentTypeWithdrawal(t *testing.T) {
 	defer server.Close()
 
 	reqBody := models.TransactionRequest{
-		Amount: 50.0,
+		Amount:   "50.00",
+		Currency: "USD",
 	}
 	reqBodyBytes, _ := json.Marshal(reqBody)
 
@@ -349,8 +457,7 @@ func TestInvalidContentTypeWithdrawal(t *testing.T) {
 }
 
 func TestInvalidContentTypeCallback(t *testing.T) {
-	handler := http.HandlerFunc(CallbackHandler)
-	server := httptest.NewServer(handler)
+	server := newCallbackServer()
 	defer server.Close()
 
 	reqBody := models.TransactionRequest{
@@ -364,3 +471,1425 @@ func TestInvalidContentTypeCallback(t *testing.T) {
 		t.Fatalf("Expected status 415 Unsupported Media Type, got %v", res.Status)
 	}
 }
+
+// Test GetTransactionHandler
+func TestGetTransactionJSON(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	transaction := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 2550, Currency: "USD"},
+		Type:          "deposit",
+		Status:        "pending",
+		DataFormat:    "application/json",
+		MerchantID:    testMerchant.MerchantID,
+	}
+	if err := services.SaveTransaction(context.Background(), transaction); err != nil {
+		t.Fatalf("Expected no error saving transaction, got %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/transactions/"+transaction.TransactionID, nil)
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("Expected a JSON body, got %v", err)
+	}
+	if response.Data.TransactionID != transaction.TransactionID || response.Data.Amount != transaction.Amount {
+		t.Fatalf("Expected transaction %s, got %+v", transaction.TransactionID, response.Data)
+	}
+}
+
+func TestGetTransactionSOAP(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	transaction := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 2550, Currency: "USD"},
+		Type:          "withdrawal",
+		Status:        "pending",
+		DataFormat:    "text/xml",
+		MerchantID:    testMerchant.MerchantID,
+	}
+	if err := services.SaveTransaction(context.Background(), transaction); err != nil {
+		t.Fatalf("Expected no error saving transaction, got %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/transactions/"+transaction.TransactionID, nil)
+	req.Header.Set("Accept", "text/xml")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/xml" {
+		t.Fatalf("Expected text/xml response, got %s", contentType)
+	}
+}
+
+func TestGetTransactionNotFound(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/transactions/nonexistent-transaction")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404 Not Found, got %v", res.Status)
+	}
+}
+
+func TestGetTransactionUnsupportedAccept(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/transactions/any", nil)
+	req.Header.Set("Accept", "text/csv")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("Expected status 406 Not Acceptable, got %v", res.Status)
+	}
+}
+
+// Test Idempotency-Key handling
+func postWithIdempotencyKey(t *testing.T, url string, key string, body []byte) *http.Response {
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return res
+}
+
+func TestIdempotentDepositReplay(t *testing.T) {
+	handler := http.HandlerFunc(DepositHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	key := uuid.New().String()
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "100.00", Currency: "USD", AccountID: uuid.New().String()})
+
+	var first, second struct {
+		Data models.Transaction `json:"data"`
+	}
+
+	res := postWithIdempotencyKey(t, server.URL+"/deposit", key, reqBodyBytes)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	json.NewDecoder(res.Body).Decode(&first)
+	res.Body.Close()
+
+	res = postWithIdempotencyKey(t, server.URL+"/deposit", key, reqBodyBytes)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK on replay, got %v", res.Status)
+	}
+	json.NewDecoder(res.Body).Decode(&second)
+	res.Body.Close()
+
+	if res.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("Expected the retry to be marked as replayed")
+	}
+	if first.Data.TransactionID == "" || first.Data.TransactionID != second.Data.TransactionID {
+		t.Fatalf("Expected the same transaction on replay, got %s and %s", first.Data.TransactionID, second.Data.TransactionID)
+	}
+}
+
+func TestIdempotentDepositConflict(t *testing.T) {
+	handler := http.HandlerFunc(DepositHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	key := uuid.New().String()
+	accountID := uuid.New().String()
+	firstBody, _ := json.Marshal(models.TransactionRequest{Amount: "100.00", Currency: "USD", AccountID: accountID})
+	secondBody, _ := json.Marshal(models.TransactionRequest{Amount: "200.00", Currency: "USD", AccountID: accountID})
+
+	res := postWithIdempotencyKey(t, server.URL+"/deposit", key, firstBody)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+
+	res = postWithIdempotencyKey(t, server.URL+"/deposit", key, secondBody)
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status 409 Conflict, got %v", res.Status)
+	}
+}
+
+func TestIdempotentDepositReplayIgnoresFormatting(t *testing.T) {
+	handler := http.HandlerFunc(DepositHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	key := uuid.New().String()
+	accountID := uuid.New().String()
+	firstBody := []byte(`{"amount": 100.00, "currency": "USD", "account_id": "` + accountID + `"}`)
+	secondBody := []byte(`{
+		"account_id": "` + accountID + `",
+		"currency":   "USD",
+		"amount":     "100"
+	}`)
+
+	res := postWithIdempotencyKey(t, server.URL+"/deposit", key, firstBody)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	res.Body.Close()
+
+	res = postWithIdempotencyKey(t, server.URL+"/deposit", key, secondBody)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK on replay, got %v", res.Status)
+	}
+	res.Body.Close()
+
+	if res.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("Expected the reformatted retry to be replayed")
+	}
+}
+
+// Test callback signature verification
+func postSignedCallback(t *testing.T, url string, gatewayID string, signature string, body []byte) *http.Response {
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(security.GatewayIDHeader, gatewayID)
+	req.Header.Set(security.SignatureHeader, signature)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return res
+}
+
+func TestSignedCallback(t *testing.T) {
+	os.Setenv("GATEWAY_SECRETS", testGateway+"="+testGatewaySecret)
+	server := newMerchantServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{TransactionID: transactionID, Status: "completed"})
+	signature := security.CreateSignature(string(reqBodyBytes), testGatewaySecret)
+
+	res := postSignedCallback(t, server.URL+"/callback", testGateway, signature, reqBodyBytes)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+}
+
+func TestCallbackFromAnotherGateway(t *testing.T) {
+	os.Setenv("GATEWAY_SECRETS", testGateway+"="+testGatewaySecret+",gateway_b=other-secret")
+	server := newMerchantServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{TransactionID: transactionID, Status: "completed"})
+	signature := security.CreateSignature(string(reqBodyBytes), "other-secret")
+
+	res := postSignedCallback(t, server.URL+"/callback", "gateway_b", signature, reqBodyBytes)
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status 403 Forbidden, got %v", res.Status)
+	}
+
+	status, err := services.GetTransactionStatus(context.Background(), transactionID)
+	if err != nil || status != models.StatusPending {
+		t.Fatalf("Expected the transaction to stay pending, got %s (%v)", status, err)
+	}
+}
+
+func TestGatewayResultFromAnotherGateway(t *testing.T) {
+	transactionID := createPendingTransaction(t)
+
+	payload, _ := json.Marshal(models.TransactionRequest{TransactionID: transactionID, Status: "completed"})
+	if err := services.HandleGatewayResultMessage(context.Background(), "gateway_b", payload, "application/json"); !kafka.IsPermanent(err) || !errors.Is(err, services.ErrWrongGateway) {
+		t.Fatalf("Expected the result to be dropped as from the wrong gateway, got %v", err)
+	}
+
+	status, err := services.GetTransactionStatus(context.Background(), transactionID)
+	if err != nil || status != models.StatusPending {
+		t.Fatalf("Expected the transaction to stay pending, got %s (%v)", status, err)
+	}
+}
+
+func TestCallbackInvalidSignature(t *testing.T) {
+	os.Setenv("GATEWAY_SECRETS", testGateway+"="+testGatewaySecret)
+	server := newMerchantServer()
+	defer server.Close()
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{TransactionID: "trans1", Status: "completed"})
+	signature := security.CreateSignature(string(reqBodyBytes), "wrong-secret")
+
+	res := postSignedCallback(t, server.URL+"/callback", testGateway, signature, reqBodyBytes)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 Unauthorized, got %v", res.Status)
+	}
+}
+
+func TestCallbackBodyTooLarge(t *testing.T) {
+	os.Setenv("GATEWAY_SECRETS", testGateway+"="+testGatewaySecret)
+	server := newMerchantServer()
+	defer server.Close()
+
+	reqBodyBytes := bytes.Repeat([]byte(" "), 2<<20)
+
+	res := postSignedCallback(t, server.URL+"/callback", testGateway, "unchecked", reqBodyBytes)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status 413 Request Entity Too Large, got %v", res.Status)
+	}
+}
+
+func TestCallbackUnknownGateway(t *testing.T) {
+	os.Setenv("GATEWAY_SECRETS", testGateway+"="+testGatewaySecret)
+	server := newMerchantServer()
+	defer server.Close()
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{TransactionID: "trans1", Status: "completed"})
+	signature := security.CreateSignature(string(reqBodyBytes), testGatewaySecret)
+
+	res := postSignedCallback(t, server.URL+"/callback", "unknown_gateway", signature, reqBodyBytes)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 Unauthorized, got %v", res.Status)
+	}
+}
+
+// Test the transaction status state machine
+func postCallback(t *testing.T, url string, transactionID string, status string) *http.Response {
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{TransactionID: transactionID, Status: status})
+
+	res, err := http.Post(url, "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return res
+}
+
+func TestCallbackIllegalTransition(t *testing.T) {
+	server := newCallbackServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	if res := postCallback(t, server.URL+"/callback", transactionID, "failed"); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+
+	if res := postCallback(t, server.URL+"/callback", transactionID, "pending"); res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status 409 Conflict for failed to pending, got %v", res.Status)
+	}
+}
+
+func TestCallbackAlreadyCompleted(t *testing.T) {
+	server := newCallbackServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	if res := postCallback(t, server.URL+"/callback", transactionID, "completed"); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+
+	if res := postCallback(t, server.URL+"/callback", transactionID, "completed"); res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status 409 Conflict for a second completion, got %v", res.Status)
+	}
+}
+
+func TestCallbackAuthorizedDeposit(t *testing.T) {
+	server := newCallbackServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	if res := postCallback(t, server.URL+"/callback", transactionID, "authorized"); res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status 409 Conflict for authorizing a deposit, got %v", res.Status)
+	}
+}
+
+func TestGatewayCannotRefund(t *testing.T) {
+	server := newCallbackServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+	if res := postCallback(t, server.URL+"/callback", transactionID, "completed"); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+
+	// only completed refunds give the money back and refund the deposit
+	if res := postCallback(t, server.URL+"/callback", transactionID, "refunded"); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 Bad Request for a refunded callback, got %v", res.Status)
+	}
+
+	payload, _ := json.Marshal(models.TransactionRequest{TransactionID: transactionID, Status: "refunded"})
+	if err := services.HandleGatewayResultMessage(context.Background(), testGateway, payload, "application/json"); !kafka.IsPermanent(err) || !errors.Is(err, services.ErrInvalidStatus) {
+		t.Fatalf("Expected a refunded result to be dropped, got %v", err)
+	}
+
+	status, err := services.GetTransactionStatus(context.Background(), transactionID)
+	if err != nil || status != models.StatusCompleted {
+		t.Fatalf("Expected the deposit to stay completed, got %s (%v)", status, err)
+	}
+}
+
+func TestAuthorizationCompletedWithoutCapture(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "100.00", Currency: "USD", AccountID: uuid.New().String()})
+	res, err := http.Post(server.URL+"/authorize", "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+
+	err = services.UpdateTransactionStatus(context.Background(), response.Data.TransactionID, models.StatusCompleted)
+	if !errors.Is(err, services.ErrInvalidTransition) {
+		t.Fatalf("Expected an invalid transition completing an authorization without a capture, got %v", err)
+	}
+}
+
+func TestCallbackUnknownStatus(t *testing.T) {
+	server := newCallbackServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	if res := postCallback(t, server.URL+"/callback", transactionID, "approved"); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 Bad Request for an unknown status, got %v", res.Status)
+	}
+}
+
+// Test account balances and the ledger
+func getBalance(t *testing.T, url string) models.AccountBalance {
+	res, err := http.Get(url)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.AccountBalance `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("Expected a JSON body, got %v", err)
+	}
+	return response.Data
+}
+
+func TestWithdrawalInsufficientFunds(t *testing.T) {
+	handler := http.HandlerFunc(WithdrawalHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	accountID := fundAccount(t, 4000)
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "50.00", Currency: "USD", AccountID: accountID})
+	res, err := http.Post(server.URL+"/withdrawal", "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 Unprocessable Entity, got %v", res.Status)
+	}
+}
+
+func TestWithdrawalReservesAndPostsFunds(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	accountID := fundAccount(t, 10000)
+
+	withdrawal := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 3000, Currency: "USD"},
+		Type:          "withdrawal",
+		Status:        models.StatusPending,
+		DataFormat:    "application/json",
+		AccountID:     accountID,
+		MerchantID:    testMerchant.MerchantID,
+	}
+	if err := services.SaveTransaction(context.Background(), withdrawal); err != nil {
+		t.Fatalf("Expected no error saving withdrawal, got %v", err)
+	}
+
+	balance := getBalance(t, server.URL+"/accounts/"+accountID+"/balance")
+	if balance.Balance.MinorUnits != 10000 || balance.Reserved.MinorUnits != 3000 || balance.Available.MinorUnits != 7000 {
+		t.Fatalf("Expected 30 reserved out of 100, got %+v", balance)
+	}
+
+	if err := services.UpdateTransactionStatus(context.Background(), withdrawal.TransactionID, models.StatusCompleted); err != nil {
+		t.Fatalf("Expected no error completing withdrawal, got %v", err)
+	}
+
+	balance = getBalance(t, server.URL+"/accounts/"+accountID+"/balance")
+	if balance.Balance.MinorUnits != 7000 || balance.Reserved.MinorUnits != 0 || balance.Available.MinorUnits != 7000 {
+		t.Fatalf("Expected a balance of 70 with nothing reserved, got %+v", balance)
+	}
+}
+
+func TestFailedWithdrawalReleasesFunds(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	accountID := fundAccount(t, 10000)
+
+	withdrawal := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 3000, Currency: "USD"},
+		Type:          "withdrawal",
+		Status:        models.StatusPending,
+		DataFormat:    "application/json",
+		AccountID:     accountID,
+		MerchantID:    testMerchant.MerchantID,
+	}
+	if err := services.SaveTransaction(context.Background(), withdrawal); err != nil {
+		t.Fatalf("Expected no error saving withdrawal, got %v", err)
+	}
+	if err := services.UpdateTransactionStatus(context.Background(), withdrawal.TransactionID, models.StatusFailed); err != nil {
+		t.Fatalf("Expected no error failing withdrawal, got %v", err)
+	}
+
+	balance := getBalance(t, server.URL+"/accounts/"+accountID+"/balance")
+	if balance.Balance.MinorUnits != 10000 || balance.Reserved.MinorUnits != 0 {
+		t.Fatalf("Expected the reservation to be released, got %+v", balance)
+	}
+}
+
+func TestBalanceAccountNotFound(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/accounts/nonexistent-account/balance")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404 Not Found, got %v", res.Status)
+	}
+}
+
+// Test amounts in minor units
+func TestDepositTooManyDecimalPlaces(t *testing.T) {
+	handler := http.HandlerFunc(DepositHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reqBody := `{"amount": 10.005, "currency": "USD", "account_id": "` + uuid.New().String() + `"}`
+	res, err := http.Post(server.URL+"/deposit", "application/json", bytes.NewBuffer([]byte(reqBody)))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 Bad Request, got %v", res.Status)
+	}
+}
+
+func TestDepositMissingCurrency(t *testing.T) {
+	handler := http.HandlerFunc(DepositHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "100.00", AccountID: uuid.New().String()})
+	res, err := http.Post(server.URL+"/deposit", "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 Bad Request, got %v", res.Status)
+	}
+}
+
+func TestDepositLargeAmount(t *testing.T) {
+	handler := http.HandlerFunc(DepositHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reqBody := `{"amount": "250000000.99", "currency": "USD", "account_id": "` + uuid.New().String() + `"}`
+	res, err := http.Post(server.URL+"/deposit", "application/json", bytes.NewBuffer([]byte(reqBody)))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+	if response.Data.Amount.MinorUnits != 25000000099 {
+		t.Fatalf("Expected 25000000099 minor units, got %+v", response.Data.Amount)
+	}
+}
+
+// Test currency conversion into the settlement currency
+func TestDepositConvertedWithLockedRate(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	if err := services.SaveFXRates(context.Background(), []models.FXRate{{BaseCurrency: "EUR", QuoteCurrency: "USD", Rate: "1.085"}}); err != nil {
+		t.Fatalf("Expected no error saving rates, got %v", err)
+	}
+
+	accountID := fundAccount(t, 1000)
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "10.25", Currency: "EUR", AccountID: accountID})
+	res, err := http.Post(server.URL+"/deposit", "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+
+	// 10.25 EUR * 1.085 = 11.12125 USD, rounded half to even
+	if response.Data.SettlementAmount != (models.Money{MinorUnits: 1112, Currency: "USD"}) || response.Data.FXRate == "" {
+		t.Fatalf("Expected 11.12 USD at a locked rate, got %+v", response.Data)
+	}
+
+	// A later rate change doesn't re-price the pending deposit
+	if err := services.SaveFXRates(context.Background(), []models.FXRate{{BaseCurrency: "EUR", QuoteCurrency: "USD", Rate: "2"}}); err != nil {
+		t.Fatalf("Expected no error saving rates, got %v", err)
+	}
+	if err := services.UpdateTransactionStatus(context.Background(), response.Data.TransactionID, models.StatusCompleted); err != nil {
+		t.Fatalf("Expected no error completing deposit, got %v", err)
+	}
+
+	balance := getBalance(t, server.URL+"/accounts/"+accountID+"/balance")
+	if balance.Balance.MinorUnits != 2112 {
+		t.Fatalf("Expected a balance of 21.12 USD, got %+v", balance)
+	}
+}
+
+func TestDepositMissingFXRate(t *testing.T) {
+	handler := http.HandlerFunc(DepositHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "100", Currency: "KRW", SettlementCurrency: "OMR", AccountID: uuid.New().String()})
+	res, err := http.Post(server.URL+"/deposit", "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 Unprocessable Entity, got %v", res.Status)
+	}
+}
+
+// Test refunds of completed deposits
+
+// posts a JSON body to a transaction operation such as a refund or capture and returns the transaction in the response
+func postOperation(t *testing.T, url string, body string) (*http.Response, models.Transaction) {
+	res, err := http.Post(url, "application/json", bytes.NewBuffer([]byte(body)))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+	return res, response.Data
+}
+
+func TestFullRefund(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	deposit := completeDeposit(t, 10000)
+
+	res, refund := postOperation(t, server.URL+"/transactions/"+deposit.TransactionID+"/refunds", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	if refund.Type != "refund" || refund.ParentTransactionID != deposit.TransactionID || refund.Amount.MinorUnits != 10000 {
+		t.Fatalf("Expected a refund of the whole deposit, got %+v", refund)
+	}
+
+	balance := getBalance(t, server.URL+"/accounts/"+deposit.AccountID+"/balance")
+	if balance.Reserved.MinorUnits != 10000 {
+		t.Fatalf("Expected the refund to be reserved, got %+v", balance)
+	}
+
+	if err := services.UpdateTransactionStatus(context.Background(), refund.TransactionID, models.StatusCompleted); err != nil {
+		t.Fatalf("Expected no error completing refund, got %v", err)
+	}
+
+	balance = getBalance(t, server.URL+"/accounts/"+deposit.AccountID+"/balance")
+	if balance.Balance.MinorUnits != 0 || balance.Reserved.MinorUnits != 0 {
+		t.Fatalf("Expected an empty account, got %+v", balance)
+	}
+
+	parent, err := services.GetTransactionByID(context.Background(), db.SystemScope, deposit.TransactionID)
+	if err != nil || parent.Status != models.StatusRefunded {
+		t.Fatalf("Expected the deposit to be refunded, got %+v (%v)", parent, err)
+	}
+}
+
+func TestPartialRefundsCappedAtRemaining(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	deposit := completeDeposit(t, 10000)
+	url := server.URL + "/transactions/" + deposit.TransactionID + "/refunds"
+
+	res, refund := postOperation(t, url, `{"amount": "60.00", "currency": "USD"}`)
+	if res.StatusCode != http.StatusOK || refund.Amount.MinorUnits != 6000 {
+		t.Fatalf("Expected a refund of 60.00, got %v %+v", res.Status, refund)
+	}
+
+	res, _ = postOperation(t, url, `{"amount": "50.00"}`)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 Unprocessable Entity, got %v", res.Status)
+	}
+
+	// A failed refund no longer counts against the deposit
+	if err := services.UpdateTransactionStatus(context.Background(), refund.TransactionID, models.StatusFailed); err != nil {
+		t.Fatalf("Expected no error failing refund, got %v", err)
+	}
+
+	res, _ = postOperation(t, url, `{"amount": "100.00"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+}
+
+func TestRefundPendingDeposit(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	res, _ := postOperation(t, server.URL+"/transactions/"+transactionID+"/refunds", "")
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 Unprocessable Entity, got %v", res.Status)
+	}
+}
+
+// Test authorize, capture and void
+func authorizeDeposit(t *testing.T, url string) models.Transaction {
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "100.00", Currency: "USD", AccountID: uuid.New().String()})
+	res, err := http.Post(url+"/authorize", "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+	if response.Data.AuthorizedAmount == nil || response.Data.AuthorizedAmount.MinorUnits != 10000 {
+		t.Fatalf("Expected an authorization of 100.00, got %+v", response.Data)
+	}
+
+	if err := services.UpdateTransactionStatus(context.Background(), response.Data.TransactionID, models.StatusAuthorized); err != nil {
+		t.Fatalf("Expected no error authorizing, got %v", err)
+	}
+	return response.Data
+}
+
+func TestPartialCapture(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	authorization := authorizeDeposit(t, server.URL)
+
+	res, capture := postOperation(t, server.URL+"/transactions/"+authorization.TransactionID+"/capture", `{"amount": "60.00"}`)
+	if res.StatusCode != http.StatusOK || capture.Status != models.StatusCapturePending || capture.Amount.MinorUnits != 6000 {
+		t.Fatalf("Expected a pending capture of 60.00, got %v %+v", res.Status, capture)
+	}
+
+	if err := services.UpdateTransactionStatus(context.Background(), authorization.TransactionID, models.StatusCompleted); err != nil {
+		t.Fatalf("Expected no error completing capture, got %v", err)
+	}
+
+	balance := getBalance(t, server.URL+"/accounts/"+authorization.AccountID+"/balance")
+	if balance.Balance.MinorUnits != 6000 {
+		t.Fatalf("Expected only the captured 60.00 to be credited, got %+v", balance)
+	}
+}
+
+func TestCaptureMoreThanAuthorized(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	authorization := authorizeDeposit(t, server.URL)
+
+	res, _ := postOperation(t, server.URL+"/transactions/"+authorization.TransactionID+"/capture", `{"amount": "100.01"}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 Bad Request, got %v", res.Status)
+	}
+}
+
+func TestVoidAuthorization(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	authorization := authorizeDeposit(t, server.URL)
+	url := server.URL + "/transactions/" + authorization.TransactionID
+
+	res, void := postOperation(t, url+"/void", "")
+	if res.StatusCode != http.StatusOK || void.Status != models.StatusVoidPending {
+		t.Fatalf("Expected a pending void, got %v %+v", res.Status, void)
+	}
+
+	// A voided authorization can't be captured anymore
+	res, _ = postOperation(t, url+"/capture", "")
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status 409 Conflict, got %v", res.Status)
+	}
+}
+
+func TestCaptureWithoutAuthorization(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	transactionID := createPendingTransaction(t)
+
+	res, _ := postOperation(t, server.URL+"/transactions/"+transactionID+"/capture", "")
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status 409 Conflict, got %v", res.Status)
+	}
+}
+
+// Test the circuit breaker admin API
+func TestOverrideCircuitBreaker(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	os.Setenv("ADMIN_API_TOKEN", "test-admin-token")
+	defer os.Unsetenv("ADMIN_API_TOKEN")
+
+	override := func(token string, body string) *http.Response {
+		req, _ := http.NewRequest("PUT", server.URL+"/admin/circuit-breakers/gateway_b", bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(security.AdminTokenHeader, token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return res
+	}
+
+	if res := override("wrong-token", `{"override": "open"}`); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 Unauthorized, got %v", res.Status)
+	}
+
+	if res := override("test-admin-token", `{"override": "open"}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer override("test-admin-token", `{"override": "auto"}`)
+
+	req, _ := http.NewRequest("GET", server.URL+"/admin/circuit-breakers", nil)
+	req.Header.Set(security.AdminTokenHeader, "test-admin-token")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.CircuitBreakersResponse `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+
+	for _, breaker := range response.Data.Breakers {
+		if breaker.Name == "gateway_b" && breaker.State == "open" {
+			return
+		}
+	}
+	t.Fatalf("Expected gateway_b to be open, got %+v", response.Data.Breakers)
+}
+
+// Test rate limiting
+func TestDepositRateLimited(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	credentials, err := services.CreateMerchant(context.Background(), models.MerchantRequest{Name: "Rate Limited Merchant"})
+	if err != nil {
+		t.Fatalf("Expected no error creating merchant, got %v", err)
+	}
+
+	err = services.ConfigureRateLimits(services.RateLimitConfig{
+		Merchants: map[string]map[string]services.RateLimit{
+			credentials.Merchant.MerchantID: {"/deposit": {Requests: 2, Window: "1m"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer services.ConfigureRateLimits(services.RateLimitConfig{})
+
+	deposit := func() *http.Response {
+		reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "10.00", Currency: "USD", AccountID: uuid.New().String()})
+		req, _ := http.NewRequest("POST", server.URL+"/deposit", bytes.NewBuffer(reqBodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(security.APIKeyHeader, credentials.APIKey.Key)
+		// an unverified gateway ID must not move the merchant to another bucket
+		req.Header.Set(security.GatewayIDHeader, uuid.New().String())
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for i := 0; i < 2; i++ {
+		res := deposit()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 OK, got %v", res.Status)
+		}
+		if res.Header.Get("RateLimit-Limit") != "2" || res.Header.Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Fatalf("Expected rate limit headers, got %v", res.Header)
+		}
+	}
+
+	res := deposit()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429 Too Many Requests, got %v", res.Status)
+	}
+	if res.Header.Get("Retry-After") == "" || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON response with Retry-After, got %v", res.Header)
+	}
+}
+
+// Test merchant authentication and API keys
+func TestDepositRequiresAPIKey(t *testing.T) {
+	server := httptest.NewServer(SetupRouter())
+	defer server.Close()
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "10.00", Currency: "USD", AccountID: uuid.New().String()})
+
+	for _, key := range []string{"", "pgk_unknown"} {
+		req, _ := http.NewRequest("POST", server.URL+"/deposit", bytes.NewBuffer(reqBodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(security.APIKeyHeader, key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401 Unauthorized for key %q, got %v", key, res.Status)
+		}
+	}
+}
+
+func TestDepositRecordsMerchant(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "10.00", Currency: "USD", AccountID: uuid.New().String()})
+	res, err := http.Post(server.URL+"/deposit", "application/json", bytes.NewBuffer(reqBodyBytes))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+
+	stored, err := db.GetTransactionByID(context.Background(), db.SystemScope, response.Data.TransactionID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if stored.MerchantID != testMerchant.MerchantID {
+		t.Fatalf("Expected merchant %s, got %q", testMerchant.MerchantID, stored.MerchantID)
+	}
+}
+
+func TestMerchantsCantSeeEachOthersData(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	other, err := services.CreateMerchant(context.Background(), models.MerchantRequest{Name: "Other Merchant"})
+	if err != nil {
+		t.Fatalf("Expected no error creating merchant, got %v", err)
+	}
+
+	deposit := completeDeposit(t, 10000)
+	authorization := authorizeDeposit(t, server.URL)
+
+	// the cache is filled by the owner first so the other merchant can't be served from it either
+	res, err := http.Get(server.URL + "/transactions/" + deposit.TransactionID)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK for the owner, got %v", res.Status)
+	}
+	res.Body.Close()
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/transactions/" + deposit.TransactionID},
+		{"GET", "/accounts/" + deposit.AccountID + "/balance"},
+		{"POST", "/transactions/" + deposit.TransactionID + "/refunds"},
+		{"POST", "/transactions/" + authorization.TransactionID + "/capture"},
+		{"POST", "/transactions/" + authorization.TransactionID + "/void"},
+	}
+
+	for _, request := range requests {
+		req, _ := http.NewRequest(request.method, server.URL+request.path, nil)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(security.APIKeyHeader, other.APIKey.Key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected status 404 Not Found for %s %s, got %v", request.method, request.path, res.Status)
+		}
+	}
+
+	// depositing into an account of another merchant is refused
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "10.00", Currency: "USD", AccountID: deposit.AccountID})
+	req, _ := http.NewRequest("POST", server.URL+"/deposit", bytes.NewBuffer(reqBodyBytes))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(security.APIKeyHeader, other.APIKey.Key)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 Unprocessable Entity, got %v", res.Status)
+	}
+}
+
+func TestIdempotencyKeysArePerMerchant(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	other, err := services.CreateMerchant(context.Background(), models.MerchantRequest{Name: "Other Merchant"})
+	if err != nil {
+		t.Fatalf("Expected no error creating merchant, got %v", err)
+	}
+
+	key := uuid.New().String()
+	reqBodyBytes, _ := json.Marshal(models.TransactionRequest{Amount: "10.00", Currency: "USD", AccountID: uuid.New().String()})
+
+	res := postWithIdempotencyKey(t, server.URL+"/deposit", key, reqBodyBytes)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/deposit", bytes.NewBuffer(reqBodyBytes))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	req.Header.Set(security.APIKeyHeader, other.APIKey.Key)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("Expected a new transaction for the other merchant, got %v replayed %q", res.Status, res.Header.Get("Idempotent-Replayed"))
+	}
+}
+
+func TestRotateAndRevokeAPIKeys(t *testing.T) {
+	server := httptest.NewServer(SetupRouter())
+	defer server.Close()
+
+	os.Setenv("ADMIN_API_TOKEN", "test-admin-token")
+	defer os.Unsetenv("ADMIN_API_TOKEN")
+
+	admin := func(method string, path string, body string, data interface{}) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(security.AdminTokenHeader, "test-admin-token")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		defer res.Body.Close()
+
+		response := struct {
+			Data interface{} `json:"data"`
+		}{Data: data}
+		json.NewDecoder(res.Body).Decode(&response)
+		return res
+	}
+
+	authenticated := func(key string) bool {
+		req, _ := http.NewRequest("GET", server.URL+"/accounts/"+uuid.New().String()+"/balance", nil)
+		req.Header.Set(security.APIKeyHeader, key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode != http.StatusUnauthorized
+	}
+
+	var credentials models.MerchantCredentials
+	if res := admin("POST", "/admin/merchants", `{"name": "Acme"}`, &credentials); res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 Created, got %v", res.Status)
+	}
+	if credentials.APIKey.Key == "" || !authenticated(credentials.APIKey.Key) {
+		t.Fatalf("Expected a working API key, got %+v", credentials.APIKey)
+	}
+
+	// the previous key keeps working during the grace period
+	var rotated models.APIKey
+	path := "/admin/merchants/" + credentials.Merchant.MerchantID + "/api-keys"
+	if res := admin("POST", path, `{"grace_period": "1h"}`, &rotated); res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 Created, got %v", res.Status)
+	}
+	if !authenticated(rotated.Key) || !authenticated(credentials.APIKey.Key) {
+		t.Fatalf("Expected both keys to work during the grace period")
+	}
+
+	// without a grace period the previous keys stop working right away
+	var replaced models.APIKey
+	if res := admin("POST", path, "", &replaced); res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 Created, got %v", res.Status)
+	}
+	if authenticated(rotated.Key) || authenticated(credentials.APIKey.Key) || !authenticated(replaced.Key) {
+		t.Fatalf("Expected only the latest key to work")
+	}
+
+	if res := admin("DELETE", path+"/"+replaced.ID, "", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	if authenticated(replaced.Key) {
+		t.Fatalf("Expected the revoked key to be refused")
+	}
+
+	var keys models.APIKeysResponse
+	if res := admin("GET", path, "", &keys); res.StatusCode != http.StatusOK || len(keys.APIKeys) != 3 {
+		t.Fatalf("Expected 3 keys, got %v %+v", res.Status, keys)
+	}
+	for _, key := range keys.APIKeys {
+		if key.Key != "" {
+			t.Fatalf("Expected listed keys to leave out the key itself, got %+v", key)
+		}
+	}
+}
+
+// Test merchant webhooks
+
+// sends a request to the router as the given merchant and decodes the data of the response
+func merchantRequest(t *testing.T, server *httptest.Server, key string, method string, path string, body string, data interface{}) *http.Response {
+	req, _ := http.NewRequest(method, server.URL+path, bytes.NewBuffer([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(security.APIKeyHeader, key)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer res.Body.Close()
+
+	response := struct {
+		Data interface{} `json:"data"`
+	}{Data: data}
+	json.NewDecoder(res.Body).Decode(&response)
+	return res
+}
+
+// completes a pending deposit of the merchant so a status change event is queued
+func completeMerchantDeposit(t *testing.T, merchantID string) models.Transaction {
+	deposit := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 1000, Currency: "USD"},
+		Type:          "deposit",
+		Status:        models.StatusPending,
+		DataFormat:    "application/json",
+		AccountID:     uuid.New().String(),
+		MerchantID:    merchantID,
+	}
+	if err := services.SaveTransaction(context.Background(), deposit); err != nil {
+		t.Fatalf("Expected no error saving deposit, got %v", err)
+	}
+	if err := services.UpdateTransactionStatus(context.Background(), deposit.TransactionID, models.StatusCompleted); err != nil {
+		t.Fatalf("Expected no error completing deposit, got %v", err)
+	}
+	return deposit
+}
+
+func TestWebhookDeliveredSigned(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	credentials, err := services.CreateMerchant(context.Background(), models.MerchantRequest{Name: "Webhook Merchant"})
+	if err != nil {
+		t.Fatalf("Expected no error creating merchant, got %v", err)
+	}
+	key := credentials.APIKey.Key
+
+	// the receiver listens on plain http on the loopback address
+	services.AllowInsecureWebhooks(true)
+	defer services.AllowInsecureWebhooks(false)
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	var endpoint models.WebhookEndpoint
+	if res := merchantRequest(t, server, key, "POST", "/webhooks/endpoints", `{"url": "`+receiver.URL+`"}`, &endpoint); res.StatusCode != http.StatusCreated || endpoint.Secret == "" {
+		t.Fatalf("Expected status 201 Created with a secret, got %v %+v", res.Status, endpoint)
+	}
+
+	deposit := completeMerchantDeposit(t, credentials.Merchant.MerchantID)
+
+	if err := services.DispatchWebhooks(context.Background()); err != nil {
+		t.Fatalf("Expected no error dispatching webhooks, got %v", err)
+	}
+
+	req, body := <-received, <-bodies
+	signature := security.SignWebhook(req.Header.Get(security.WebhookTimestampHeader), body, endpoint.Secret)
+	if req.Header.Get(security.SignatureHeader) != signature {
+		t.Fatalf("Expected the event to be signed with the endpoint secret")
+	}
+
+	var payload models.WebhookPayload
+	json.Unmarshal(body, &payload)
+	if payload.Type != "transaction.completed" || payload.Transaction.TransactionID != deposit.TransactionID || payload.EventID != req.Header.Get(security.WebhookIDHeader) {
+		t.Fatalf("Expected a transaction.completed event of %s, got %+v", deposit.TransactionID, payload)
+	}
+
+	var events models.WebhookEventsResponse
+	merchantRequest(t, server, key, "GET", "/webhooks/events?transaction_id="+deposit.TransactionID, "", &events)
+	if len(events.Events) != 1 || events.Events[0].Status != models.WebhookEventDelivered {
+		t.Fatalf("Expected 1 delivered event, got %+v", events)
+	}
+
+	// other merchants can't see the events
+	var others models.WebhookEventsResponse
+	merchantRequest(t, server, testAPIKey, "GET", "/webhooks/events?transaction_id="+deposit.TransactionID, "", &others)
+	if len(others.Events) != 0 {
+		t.Fatalf("Expected no events for another merchant, got %+v", others)
+	}
+}
+
+func TestWebhookDeadLetterAndRedeliver(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	if err := services.ConfigureWebhooks(1); err != nil {
+		t.Fatalf("Expected no error configuring webhooks, got %v", err)
+	}
+	defer services.ConfigureWebhooks(services.DefaultWebhookMaxAttempts)
+
+	credentials, err := services.CreateMerchant(context.Background(), models.MerchantRequest{Name: "Webhook Merchant"})
+	if err != nil {
+		t.Fatalf("Expected no error creating merchant, got %v", err)
+	}
+	key := credentials.APIKey.Key
+
+	services.AllowInsecureWebhooks(true)
+	defer services.AllowInsecureWebhooks(false)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	var endpoint models.WebhookEndpoint
+	if res := merchantRequest(t, server, key, "POST", "/webhooks/endpoints", `{"url": "`+receiver.URL+`"}`, &endpoint); res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 Created, got %v", res.Status)
+	}
+
+	deposit := completeMerchantDeposit(t, credentials.Merchant.MerchantID)
+
+	if err := services.DispatchWebhooks(context.Background()); err != nil {
+		t.Fatalf("Expected no error dispatching webhooks, got %v", err)
+	}
+
+	var events models.WebhookEventsResponse
+	merchantRequest(t, server, key, "GET", "/webhooks/events?status=dead", "", &events)
+	if len(events.Events) != 1 || events.Events[0].TransactionID != deposit.TransactionID || events.Events[0].Attempts != 1 {
+		t.Fatalf("Expected the event to be dead after 1 attempt, got %+v", events)
+	}
+
+	// another merchant can't redeliver the event
+	path := "/webhooks/events/" + strconv.FormatInt(events.Events[0].ID, 10) + "/redeliver"
+	if res := merchantRequest(t, server, testAPIKey, "POST", path, "", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status 404 Not Found, got %v", res.Status)
+	}
+
+	var redelivered models.WebhookEvent
+	if res := merchantRequest(t, server, key, "POST", path, "", &redelivered); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status 202 Accepted, got %v", res.Status)
+	}
+	if redelivered.Status != models.WebhookEventPending || redelivered.Attempts != 0 {
+		t.Fatalf("Expected a pending event with no attempts, got %+v", redelivered)
+	}
+
+	// a deleted endpoint takes its pending events with it
+	if res := merchantRequest(t, server, key, "DELETE", "/webhooks/endpoints/"+endpoint.ID, "", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	merchantRequest(t, server, key, "GET", "/webhooks/events?status=pending", "", &events)
+	if len(events.Events) != 0 {
+		t.Fatalf("Expected no pending events after deleting the endpoint, got %+v", events)
+	}
+}
+
+func TestCreateWebhookEndpointInvalidURL(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	for _, url := range []string{"", "example.com/hooks", "ftp://example.com/hooks"} {
+		if res := merchantRequest(t, server, testAPIKey, "POST", "/webhooks/endpoints", `{"url": "`+url+`"}`, nil); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status 400 Bad Request for %q, got %v", url, res.Status)
+		}
+	}
+}
+
+func TestCreateWebhookEndpointPrivateURL(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	for _, url := range []string{"http://example.com/hooks", "https://localhost/hooks", "https://127.0.0.1:6379/", "https://10.0.0.5/hooks", "https://169.254.169.254/latest/meta-data", "https://[::1]/hooks"} {
+		if res := merchantRequest(t, server, testAPIKey, "POST", "/webhooks/endpoints", `{"url": "`+url+`"}`, nil); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status 400 Bad Request for %q, got %v", url, res.Status)
+		}
+	}
+}
+
+// Test the metrics endpoint
+func TestMetricsEndpoint(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/transactions/" + uuid.New().String())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get(server.URL + "/metrics")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	for _, metric := range []string{
+		`payment_gateway_http_requests_total{code="404",method="GET",route="/transactions/{id}"}`,
+		`payment_gateway_http_request_duration_seconds_bucket{code="404",method="GET",route="/transactions/{id}"`,
+		`payment_gateway_postgres_call_duration_seconds_count{result="error"}`,
+		`payment_gateway_redis_command_duration_seconds_count{command="get",result="ok"}`,
+	} {
+		if !bytes.Contains(body, []byte(metric)) {
+			t.Fatalf("Expected metrics to contain %s", metric)
+		}
+	}
+}
+
+func TestRequestIDEchoed(t *testing.T) {
+	server := newMerchantServer()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name      string
+		requestID string
+		generated bool
+	}{
+		{name: "caller's ID", requestID: "req-" + uuid.New().String()},
+		{name: "no ID", generated: true},
+		{name: "ID with spaces", requestID: "req with spaces", generated: true},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"/transactions/"+uuid.New().String(), nil)
+		if tc.requestID != "" {
+			req.Header.Set("X-Request-ID", tc.requestID)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", tc.name, err)
+		}
+		res.Body.Close()
+
+		requestID := res.Header.Get("X-Request-ID")
+		if tc.generated {
+			if _, err := uuid.Parse(requestID); err != nil {
+				t.Fatalf("%s: expected a generated request ID, got %q", tc.name, requestID)
+			}
+		} else if requestID != tc.requestID {
+			t.Fatalf("%s: expected request ID %q, got %q", tc.name, tc.requestID, requestID)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	server := httptest.NewServer(SetupRouter())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/healthz")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %v", res.Status)
+	}
+	res.Body.Close()
+}
+
+func TestReadyzReportsEachDependency(t *testing.T) {
+	server := httptest.NewServer(SetupRouter())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/readyz")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Data models.ReadinessReport `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("Expected a JSON body, got %v", err)
+	}
+
+	for _, name := range []string{"postgres", "redis", "kafka"} {
+		if _, ok := response.Data.Dependencies[name]; !ok {
+			t.Fatalf("Expected a check of %s, got %+v", name, response.Data.Dependencies)
+		}
+	}
+
+	for _, name := range []string{"postgres", "redis"} {
+		if response.Data.Dependencies[name].Status != models.HealthOK {
+			t.Fatalf("Expected %s to be ok, got %+v", name, response.Data.Dependencies[name])
+		}
+	}
+
+	if response.Data.Status == models.HealthNotReady && res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 when not ready, got %v", res.Status)
+	}
+	if response.Data.Status != models.HealthNotReady && res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 OK when %s, got %v", response.Data.Status, res.Status)
+	}
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/services"
+)
+
+// reports that the process is alive, dependencies aren't checked so an outage elsewhere doesn't get the service restarted
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "ok",
+	}, "application/json")
+}
+
+// reports whether the service can take traffic with the check of every dependency, 503 Service Unavailable when one is down
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := services.CheckReadiness(r.Context())
+
+	statusCode := http.StatusOK
+	if report.Status == models.HealthNotReady {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: statusCode,
+		Message:    report.Status,
+		Data:       report,
+	}, "application/json")
+}
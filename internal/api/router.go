@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"payment-gateway/internal/metrics"
 	"payment-gateway/internal/middleware"
 
 	"github.com/gorilla/mux"
@@ -11,10 +12,56 @@ import (
 func SetupRouter() *mux.Router {
 	router := mux.NewRouter()
 
-	// Apply the data format middleware to all routes and for future improvement we can apply verify_signature middleware on the callback route
-	router.Handle("/deposit", middleware.DataFormatMiddleware(http.HandlerFunc(DepositHandler))).Methods("POST")
-	router.Handle("/withdrawal", middleware.DataFormatMiddleware(http.HandlerFunc(WithdrawalHandler))).Methods("POST")
-	router.Handle("/callback", middleware.DataFormatMiddleware(http.HandlerFunc(CallbackHandler))).Methods("POST")
+	// Trace every matched request, continuing the caller's trace when it sends a traceparent header
+	router.Use(middleware.TracingMiddleware)
+
+	// Tag every matched request with an X-Request-ID so its log lines can be found
+	router.Use(middleware.RequestIDMiddleware)
+
+	// Count and time every matched request
+	router.Use(middleware.MetricsMiddleware)
+
+	// Merchant routes need an API key and are rate limited per merchant
+	merchant := func(handler http.HandlerFunc) http.Handler {
+		return middleware.MerchantAuthMiddleware(middleware.RateLimitMiddleware(handler))
+	}
+
+	// Apply the data format middleware to all routes and verify the gateway signature on the callback route, callbacks are rate limited per gateway
+	router.Handle("/deposit", middleware.DataFormatMiddleware(merchant(DepositHandler))).Methods("POST")
+	router.Handle("/withdrawal", middleware.DataFormatMiddleware(merchant(WithdrawalHandler))).Methods("POST")
+	router.Handle("/authorize", middleware.DataFormatMiddleware(merchant(AuthorizeHandler))).Methods("POST")
+	router.Handle("/transactions/{id}/capture", middleware.DataFormatMiddleware(merchant(CaptureHandler))).Methods("POST")
+	router.Handle("/transactions/{id}/void", middleware.DataFormatMiddleware(merchant(VoidHandler))).Methods("POST")
+	router.Handle("/transactions/{id}/refunds", middleware.DataFormatMiddleware(merchant(RefundHandler))).Methods("POST")
+	router.Handle("/callback", middleware.DataFormatMiddleware(middleware.SignatureMiddleware(middleware.GatewayRateLimitMiddleware(http.HandlerFunc(CallbackHandler))))).Methods("POST")
+
+	// Read routes have no body so the response format is negotiated from the Accept header instead
+	router.Handle("/transactions/{id}", middleware.AcceptFormatMiddleware(merchant(GetTransactionHandler))).Methods("GET")
+	router.Handle("/accounts/{id}/balance", middleware.AcceptFormatMiddleware(merchant(GetAccountBalanceHandler))).Methods("GET")
+
+	// Merchants register the endpoints their transaction events are sent to and can list and redeliver those events
+	router.Handle("/webhooks/endpoints", middleware.DataFormatMiddleware(merchant(CreateWebhookEndpointHandler))).Methods("POST")
+	router.Handle("/webhooks/endpoints", middleware.AcceptFormatMiddleware(merchant(ListWebhookEndpointsHandler))).Methods("GET")
+	router.Handle("/webhooks/endpoints/{id}", middleware.AcceptFormatMiddleware(merchant(DeleteWebhookEndpointHandler))).Methods("DELETE")
+	router.Handle("/webhooks/events", middleware.AcceptFormatMiddleware(merchant(ListWebhookEventsHandler))).Methods("GET")
+	router.Handle("/webhooks/events/{id}/redeliver", middleware.AcceptFormatMiddleware(merchant(RedeliverWebhookEventHandler))).Methods("POST")
+
+	// Prometheus scrapes the service metrics
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	// Liveness and readiness probes of the orchestrator
+	router.Handle("/healthz", http.HandlerFunc(HealthzHandler)).Methods("GET")
+	router.Handle("/readyz", http.HandlerFunc(ReadyzHandler)).Methods("GET")
+
+	// Admin routes are only reachable with the admin token
+	router.Handle("/admin/fx-rates", middleware.AdminAuthMiddleware(middleware.DataFormatMiddleware(http.HandlerFunc(UpdateFXRatesHandler)))).Methods("POST")
+	router.Handle("/admin/fx-rates", middleware.AdminAuthMiddleware(middleware.AcceptFormatMiddleware(http.HandlerFunc(ListFXRatesHandler)))).Methods("GET")
+	router.Handle("/admin/circuit-breakers", middleware.AdminAuthMiddleware(middleware.AcceptFormatMiddleware(http.HandlerFunc(ListCircuitBreakersHandler)))).Methods("GET")
+	router.Handle("/admin/circuit-breakers/{name}", middleware.AdminAuthMiddleware(middleware.DataFormatMiddleware(http.HandlerFunc(OverrideCircuitBreakerHandler)))).Methods("PUT")
+	router.Handle("/admin/merchants", middleware.AdminAuthMiddleware(middleware.DataFormatMiddleware(http.HandlerFunc(CreateMerchantHandler)))).Methods("POST")
+	router.Handle("/admin/merchants/{id}/api-keys", middleware.AdminAuthMiddleware(middleware.AcceptFormatMiddleware(http.HandlerFunc(ListAPIKeysHandler)))).Methods("GET")
+	router.Handle("/admin/merchants/{id}/api-keys", middleware.AdminAuthMiddleware(middleware.DataFormatMiddleware(http.HandlerFunc(RotateAPIKeyHandler)))).Methods("POST")
+	router.Handle("/admin/merchants/{id}/api-keys/{key}", middleware.AdminAuthMiddleware(middleware.AcceptFormatMiddleware(http.HandlerFunc(RevokeAPIKeyHandler)))).Methods("DELETE")
 
 	return router
 }
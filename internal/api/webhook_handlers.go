@@ -0,0 +1,149 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"payment-gateway/db"
+	"payment-gateway/internal/middleware"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/services"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// registers a webhook endpoint of the merchant, the signing secret is only shown in this response
+func CreateWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.WebhookEndpointRequest
+	contentType := r.Header.Get("Content-Type")
+
+	if err := services.DecodeRequest(r, &request); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, "Invalid request format", contentType)
+		return
+	}
+
+	if err := services.ValidateWebhookEndpointRequest(r.Context(), request); err != nil {
+		services.RespondWithError(w, http.StatusBadRequest, err.Error(), contentType)
+		return
+	}
+
+	merchant, _ := middleware.MerchantFromContext(r.Context())
+	endpoint, err := services.CreateWebhookEndpoint(r.Context(), merchant.MerchantID, request)
+	if err != nil {
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to create webhook endpoint", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to create webhook endpoint", contentType)
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusCreated,
+		Message:    "Webhook endpoint created successfully",
+		Data:       endpoint,
+	}, contentType)
+}
+
+// lists the webhook endpoints of the merchant without their secrets
+func ListWebhookEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+
+	endpoints, err := services.ListWebhookEndpoints(r.Context(), merchantScope(r))
+	if err != nil {
+		if services.RespondIfOverloaded(w, err, contentType) {
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "failed to retrieve webhook endpoints", slog.Any("error", err))
+		services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve webhook endpoints", contentType)
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Webhook endpoints retrieved successfully",
+		Data:       models.WebhookEndpointsResponse{Endpoints: endpoints},
+	}, contentType)
+}
+
+// removes a webhook endpoint of the merchant, no further events are sent to it
+func DeleteWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+
+	endpoint, err := services.DeleteWebhookEndpoint(r.Context(), merchantScope(r), mux.Vars(r)["id"])
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrWebhookEndpointNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		default:
+			slog.ErrorContext(r.Context(), "failed to delete webhook endpoint", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to delete webhook endpoint", contentType)
+		}
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Webhook endpoint deleted successfully",
+		Data:       endpoint,
+	}, contentType)
+}
+
+// lists the latest webhook events of the merchant, the status and transaction_id query parameters narrow them down
+func ListWebhookEventsHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+	query := r.URL.Query()
+
+	events, err := services.ListWebhookEvents(r.Context(), merchantScope(r), query.Get("status"), query.Get("transaction_id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidWebhookEventStatus):
+			services.RespondWithError(w, http.StatusBadRequest, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		default:
+			slog.ErrorContext(r.Context(), "failed to retrieve webhook events", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve webhook events", contentType)
+		}
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Webhook events retrieved successfully",
+		Data:       models.WebhookEventsResponse{Events: events},
+	}, contentType)
+}
+
+// queues a webhook event of the merchant for delivery again, including events that were delivered or are dead
+func RedeliverWebhookEventHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := services.NegotiateContentType(r)
+
+	eventID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		services.RespondWithError(w, http.StatusNotFound, db.ErrWebhookEventNotFound.Error(), contentType)
+		return
+	}
+
+	event, err := services.RedeliverWebhookEvent(r.Context(), merchantScope(r), eventID)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrWebhookEventNotFound):
+			services.RespondWithError(w, http.StatusNotFound, err.Error(), contentType)
+		case services.RespondIfOverloaded(w, err, contentType):
+		default:
+			slog.ErrorContext(r.Context(), "failed to redeliver webhook event", slog.Any("error", err))
+			services.RespondWithError(w, http.StatusInternalServerError, "Failed to redeliver webhook event", contentType)
+		}
+		return
+	}
+
+	services.RespondWithTransaction(w, models.APIResponse{
+		StatusCode: http.StatusAccepted,
+		Message:    "Webhook event queued for redelivery",
+		Data:       event,
+	}, contentType)
+}
@@ -0,0 +1,151 @@
+package gateways
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"payment-gateway/internal/resilience"
+	"time"
+)
+
+// the gateways and routing rules of the service
+type Config struct {
+	Gateways []GatewayConfig           `json:"gateways"`
+	Rules    []Rule                    `json:"rules"`
+	Failover map[string]FailoverPolicy `json:"failover,omitempty"` // by transaction type
+}
+
+// a Kafka gateway and the topic it consumes
+type GatewayConfig struct {
+	ID       string         `json:"id"`
+	Topic    string         `json:"topic"`
+	Breaker  BreakerConfig  `json:"breaker,omitempty"`
+	Bulkhead BulkheadConfig `json:"bulkhead,omitempty"`
+}
+
+// the concurrency limits of publishing to a gateway, anything left out uses resilience.DefaultBulkheadSettings
+type BulkheadConfig struct {
+	MaxConcurrent int    `json:"max_concurrent,omitempty"`
+	MaxQueue      int    `json:"max_queue,omitempty"`
+	MaxWait       string `json:"max_wait,omitempty"` // a Go duration such as 1s
+}
+
+// converts the configuration into bulkhead settings
+func (c BulkheadConfig) settings() (resilience.BulkheadSettings, error) {
+	settings := resilience.DefaultBulkheadSettings
+
+	if c.MaxConcurrent > 0 {
+		settings.MaxConcurrent = c.MaxConcurrent
+	}
+	if c.MaxQueue > 0 {
+		settings.MaxQueue = c.MaxQueue
+	}
+	if c.MaxWait != "" {
+		maxWait, err := time.ParseDuration(c.MaxWait)
+		if err != nil {
+			return settings, fmt.Errorf("invalid bulkhead max wait: %v", err)
+		}
+		settings.MaxWait = maxWait
+	}
+
+	return settings, nil
+}
+
+// returns the name of the bulkhead limiting calls to a gateway
+func BulkheadName(gatewayID string) string {
+	return "gateway:" + gatewayID
+}
+
+// the circuit breaker settings of a gateway, anything left out uses resilience.DefaultBreakerSettings
+type BreakerConfig struct {
+	MaxRequests         uint32 `json:"max_requests,omitempty"`
+	Interval            string `json:"interval,omitempty"` // a Go duration such as 5s
+	Timeout             string `json:"timeout,omitempty"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures,omitempty"`
+}
+
+// converts the configuration into breaker settings
+func (c BreakerConfig) settings() (resilience.BreakerSettings, error) {
+	settings := resilience.BreakerSettings{
+		MaxRequests:         c.MaxRequests,
+		ConsecutiveFailures: c.ConsecutiveFailures,
+	}
+
+	if c.Interval != "" {
+		interval, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return settings, fmt.Errorf("invalid breaker interval: %v", err)
+		}
+		settings.Interval = interval
+	}
+
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return settings, fmt.Errorf("invalid breaker timeout: %v", err)
+		}
+		settings.Timeout = timeout
+	}
+
+	return settings, nil
+}
+
+// used when no configuration file is set, both mock gateways are registered and everything is routed to gateway A without failover
+var DefaultConfig = Config{
+	Gateways: []GatewayConfig{
+		{ID: "gateway_a", Topic: "transactions.json"},
+		{ID: "gateway_b", Topic: "transactions.soap"},
+	},
+	Rules: []Rule{
+		{Gateway: "gateway_a"},
+	},
+}
+
+// reads the configuration from a JSON file
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid gateway configuration: %v", err)
+	}
+
+	return config, nil
+}
+
+// registers the configured gateways with their circuit breakers and bulkheads and sets their routing rules
+func Configure(config Config) error {
+	for _, gateway := range config.Gateways {
+		if gateway.ID == "" || gateway.Topic == "" {
+			return fmt.Errorf("gateways need an id and a topic")
+		}
+
+		breakerSettings, err := gateway.Breaker.settings()
+		if err != nil {
+			return fmt.Errorf("gateway %s: %v", gateway.ID, err)
+		}
+
+		bulkheadSettings, err := gateway.Bulkhead.settings()
+		if err != nil {
+			return fmt.Errorf("gateway %s: %v", gateway.ID, err)
+		}
+
+		Register(NewKafkaGateway(gateway.ID, gateway.Topic))
+		resilience.ConfigureBreaker(gateway.ID, breakerSettings)
+		resilience.ConfigureBulkhead(BulkheadName(gateway.ID), bulkheadSettings)
+	}
+
+	if len(config.Rules) == 0 {
+		return fmt.Errorf("at least one routing rule is required")
+	}
+
+	if err := SetRules(config.Rules); err != nil {
+		return err
+	}
+
+	return SetFailoverPolicies(config.Failover)
+}
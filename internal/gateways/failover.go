@@ -0,0 +1,80 @@
+package gateways
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// returned when a transaction has no other gateway left to fail over to
+var ErrNoFailover = errors.New("no gateway left to fail over to")
+
+// how far a transaction type may fail over, every rule matching the transaction after the first one offers another gateway
+type FailoverPolicy struct {
+	MaxGateways int `json:"max_gateways"` // including the primary, 0 or 1 disables failover
+}
+
+var (
+	failoverMu       sync.RWMutex
+	failoverPolicies = map[string]FailoverPolicy{}
+)
+
+// replaces the failover policies, transaction types without a policy never fail over
+func SetFailoverPolicies(policies map[string]FailoverPolicy) error {
+	for transactionType, policy := range policies {
+		if policy.MaxGateways < 0 {
+			return fmt.Errorf("failover policy of %s: max gateways must not be negative", transactionType)
+		}
+	}
+
+	failoverMu.Lock()
+	defer failoverMu.Unlock()
+
+	failoverPolicies = policies
+	return nil
+}
+
+// returns the gateways eligible for the request in the order of the rules matching it, as many as the failover policy of its transaction type allows
+func Candidates(request RouteRequest) []Gateway {
+	failoverMu.RLock()
+	limit := failoverPolicies[request.TransactionType].MaxGateways
+	failoverMu.RUnlock()
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	var candidates []Gateway
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if len(candidates) == limit {
+			break
+		}
+		if seen[rule.Gateway] || !rule.matches(request) {
+			continue
+		}
+
+		gateway, err := Get(rule.Gateway)
+		if err != nil {
+			continue
+		}
+		seen[rule.Gateway] = true
+		candidates = append(candidates, gateway)
+	}
+
+	return candidates
+}
+
+// returns the next eligible gateway that hasn't been tried yet
+func Failover(request RouteRequest, tried []string) (Gateway, error) {
+	for _, gateway := range Candidates(request) {
+		if !contains(tried, gateway.ID()) {
+			return gateway, nil
+		}
+	}
+
+	return nil, ErrNoFailover
+}
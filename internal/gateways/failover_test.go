@@ -0,0 +1,46 @@
+package gateways
+
+import (
+	"errors"
+	"payment-gateway/internal/models"
+	"testing"
+)
+
+func TestFailover(t *testing.T) {
+	Register(NewKafkaGateway("gateway_a", "transactions.json"))
+	Register(NewKafkaGateway("gateway_b", "transactions.soap"))
+	Register(NewKafkaGateway("gateway_c", "transactions.c"))
+
+	err := SetRules([]Rule{
+		{Gateway: "gateway_a"},
+		{Gateway: "gateway_a", Currencies: []string{"USD"}},
+		{Gateway: "gateway_b"},
+		{Gateway: "gateway_c"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error setting rules, got %v", err)
+	}
+
+	if err := SetFailoverPolicies(map[string]FailoverPolicy{"deposit": {MaxGateways: 2}}); err != nil {
+		t.Fatalf("Expected no error setting failover policies, got %v", err)
+	}
+
+	deposit := RouteRequest{TransactionType: "deposit", Amount: models.Money{MinorUnits: 100, Currency: "USD"}}
+
+	// the repeated rule for gateway A doesn't count as a second gateway
+	next, err := Failover(deposit, []string{"gateway_a"})
+	if err != nil || next.ID() != "gateway_b" {
+		t.Fatalf("Expected to fail over to gateway_b, got %v (%v)", next, err)
+	}
+
+	// the policy allows two gateways so gateway C is never used
+	if _, err := Failover(deposit, []string{"gateway_a", "gateway_b"}); !errors.Is(err, ErrNoFailover) {
+		t.Fatalf("Expected ErrNoFailover, got %v", err)
+	}
+
+	// withdrawals have no policy and never fail over
+	withdrawal := RouteRequest{TransactionType: "withdrawal", Amount: models.Money{MinorUnits: 100, Currency: "USD"}}
+	if _, err := Failover(withdrawal, []string{"gateway_a"}); !errors.Is(err, ErrNoFailover) {
+		t.Fatalf("Expected ErrNoFailover, got %v", err)
+	}
+}
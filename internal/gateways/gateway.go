@@ -0,0 +1,36 @@
+package gateways
+
+import (
+	"context"
+	"payment-gateway/internal/kafka"
+)
+
+// a payment gateway transactions can be sent to, new kinds of gateways only have to implement this interface and be registered
+type Gateway interface {
+	// the ID stored on transactions routed to this gateway
+	ID() string
+
+	// sends a masked gateway message for a transaction to the gateway
+	Publish(ctx context.Context, transactionID string, message []byte) error
+}
+
+// a gateway consuming its messages from a Kafka topic
+type KafkaGateway struct {
+	id    string
+	topic string
+}
+
+// creates a gateway publishing to the given Kafka topic
+func NewKafkaGateway(id string, topic string) *KafkaGateway {
+	return &KafkaGateway{id: id, topic: topic}
+}
+
+// returns the gateway ID
+func (g *KafkaGateway) ID() string {
+	return g.id
+}
+
+// publishes the message to the topic of the gateway
+func (g *KafkaGateway) Publish(ctx context.Context, transactionID string, message []byte) error {
+	return kafka.Publish(ctx, g.topic, transactionID, message)
+}
@@ -0,0 +1,49 @@
+package gateways
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// returned when a transaction refers to a gateway that isn't configured
+var ErrUnknownGateway = errors.New("unknown gateway")
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Gateway{}
+)
+
+// adds a gateway to the registry replacing any gateway with the same ID
+func Register(gateway Gateway) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry[gateway.ID()] = gateway
+}
+
+// returns the registered gateway with the given ID
+func Get(id string) (Gateway, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	gateway, ok := registry[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGateway, id)
+	}
+	return gateway, nil
+}
+
+// returns the IDs of all registered gateways in alphabetical order
+func IDs() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	ids := make([]string, 0, len(registry))
+	for id := range registry {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,129 @@
+package gateways
+
+import (
+	"errors"
+	"fmt"
+	"payment-gateway/internal/models"
+	"sync"
+)
+
+// returned when no routing rule matches a transaction
+var ErrNoRoute = errors.New("no gateway accepts this transaction")
+
+// a routing rule sending matching transactions to a gateway, empty criteria match everything
+type Rule struct {
+	Gateway          string         `json:"gateway"`
+	Currencies       []string       `json:"currencies,omitempty"`
+	TransactionTypes []string       `json:"transaction_types,omitempty"`
+	MerchantIDs      []string       `json:"merchant_ids,omitempty"`
+	MinAmount        models.Decimal `json:"min_amount,omitempty"` // inclusive, in the currency of the transaction
+	MaxAmount        models.Decimal `json:"max_amount,omitempty"` // inclusive, in the currency of the transaction
+
+	// the amount bounds in minor units of each listed currency, parsed once when the rules are set
+	minAmounts map[string]int64
+	maxAmounts map[string]int64
+}
+
+// what a transaction is routed on
+type RouteRequest struct {
+	TransactionType string
+	Amount          models.Money
+	MerchantID      string
+}
+
+var (
+	rulesMu sync.RWMutex
+	rules   []Rule
+)
+
+// validates the rules and replaces the current ones, rules are tried in order and the first match wins
+func SetRules(newRules []Rule) error {
+	parsed := make([]Rule, len(newRules))
+
+	for i, rule := range newRules {
+		if _, err := Get(rule.Gateway); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+
+		if (rule.MinAmount != "" || rule.MaxAmount != "") && len(rule.Currencies) == 0 {
+			return fmt.Errorf("rule %d: amount bounds require currencies", i+1)
+		}
+
+		rule.minAmounts = map[string]int64{}
+		rule.maxAmounts = map[string]int64{}
+		for _, currency := range rule.Currencies {
+			if rule.MinAmount != "" {
+				amount, err := models.ParseMoney(rule.MinAmount, currency)
+				if err != nil {
+					return fmt.Errorf("rule %d: min amount: %v", i+1, err)
+				}
+				rule.minAmounts[currency] = amount.MinorUnits
+			}
+
+			if rule.MaxAmount != "" {
+				amount, err := models.ParseMoney(rule.MaxAmount, currency)
+				if err != nil {
+					return fmt.Errorf("rule %d: max amount: %v", i+1, err)
+				}
+				rule.maxAmounts[currency] = amount.MinorUnits
+			}
+		}
+
+		parsed[i] = rule
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	rules = parsed
+	return nil
+}
+
+// picks the gateway of the first rule matching the request
+func Route(request RouteRequest) (Gateway, error) {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		if rule.matches(request) {
+			return Get(rule.Gateway)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s %s", ErrNoRoute, request.TransactionType, request.Amount)
+}
+
+// checks if the request meets every criterion of the rule
+func (r Rule) matches(request RouteRequest) bool {
+	if len(r.Currencies) > 0 && !contains(r.Currencies, request.Amount.Currency) {
+		return false
+	}
+
+	if len(r.TransactionTypes) > 0 && !contains(r.TransactionTypes, request.TransactionType) {
+		return false
+	}
+
+	if len(r.MerchantIDs) > 0 && !contains(r.MerchantIDs, request.MerchantID) {
+		return false
+	}
+
+	if minimum, ok := r.minAmounts[request.Amount.Currency]; ok && request.Amount.MinorUnits < minimum {
+		return false
+	}
+
+	if maximum, ok := r.maxAmounts[request.Amount.Currency]; ok && request.Amount.MinorUnits > maximum {
+		return false
+	}
+
+	return true
+}
+
+// checks if the value is in the list
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package gateways
+
+import (
+	"errors"
+	"payment-gateway/internal/models"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	Register(NewKafkaGateway("gateway_a", "transactions.json"))
+	Register(NewKafkaGateway("gateway_b", "transactions.soap"))
+
+	err := SetRules([]Rule{
+		{Gateway: "gateway_b", Currencies: []string{"USD"}, MinAmount: "1000", TransactionTypes: []string{"deposit"}},
+		{Gateway: "gateway_b", MerchantIDs: []string{"merchant_b"}},
+		{Gateway: "gateway_a", Currencies: []string{"USD", "JPY"}, MaxAmount: "5000"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error setting rules, got %v", err)
+	}
+
+	tests := []struct {
+		request RouteRequest
+		want    string
+	}{
+		{RouteRequest{TransactionType: "deposit", Amount: models.Money{MinorUnits: 100000, Currency: "USD"}}, "gateway_b"},
+		{RouteRequest{TransactionType: "withdrawal", Amount: models.Money{MinorUnits: 100000, Currency: "USD"}}, "gateway_a"},
+		{RouteRequest{TransactionType: "deposit", Amount: models.Money{MinorUnits: 99999, Currency: "USD"}}, "gateway_a"},
+		{RouteRequest{TransactionType: "deposit", Amount: models.Money{MinorUnits: 5000, Currency: "JPY"}}, "gateway_a"},
+		{RouteRequest{TransactionType: "deposit", Amount: models.Money{MinorUnits: 100, Currency: "EUR"}, MerchantID: "merchant_b"}, "gateway_b"},
+	}
+
+	for _, test := range tests {
+		gateway, err := Route(test.request)
+		if err != nil {
+			t.Fatalf("Expected no error routing %+v, got %v", test.request, err)
+		}
+		if gateway.ID() != test.want {
+			t.Fatalf("Expected %+v to be routed to %s, got %s", test.request, test.want, gateway.ID())
+		}
+	}
+
+	// above the max amount and no other rule matches
+	_, err = Route(RouteRequest{TransactionType: "deposit", Amount: models.Money{MinorUnits: 5001, Currency: "JPY"}})
+	if !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("Expected ErrNoRoute, got %v", err)
+	}
+}
+
+func TestSetRulesInvalid(t *testing.T) {
+	Register(NewKafkaGateway("gateway_a", "transactions.json"))
+
+	invalid := [][]Rule{
+		{{Gateway: "unknown"}},
+		{{Gateway: "gateway_a", MinAmount: "10"}},
+		{{Gateway: "gateway_a", Currencies: []string{"JPY"}, MaxAmount: "10.5"}},
+	}
+
+	for _, rules := range invalid {
+		if err := SetRules(rules); err == nil {
+			t.Fatalf("Expected an error setting rules %+v", rules)
+		}
+	}
+}
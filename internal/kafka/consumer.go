@@ -0,0 +1,198 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/resilience"
+	"payment-gateway/internal/security"
+	"payment-gateway/internal/tracing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// retries a result the handler failed on with backoff, a round ends after a minute so a result that keeps failing is logged while it is retried
+var resultPolicy = resilience.Policy{
+	BaseDelay:  time.Second,
+	MaxDelay:   30 * time.Second,
+	MaxElapsed: time.Minute,
+	Retryable:  func(err error) bool { return !IsPermanent(err) },
+}
+
+// handles the payload of a gateway result message signed by the gateway, the content type comes from the message header.
+// Errors marked with Permanent skip the result, any other error is retried until the result is handled
+type ResultHandler func(ctx context.Context, gatewayID string, payload []byte, contentType string) error
+
+// a handler error retrying won't fix
+type permanentError struct {
+	err error
+}
+
+// returns the message of the wrapped error
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// lets errors.Is and errors.As match the wrapped error
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// marks an error of a result handler as permanent so the result is skipped and its offset committed instead of retrying it
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// reports whether a handler error was marked as permanent, any other error is temporary
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+// returns the topic the gateways publish their results to
+func ResultsTopic() string {
+	topic := os.Getenv("KAFKA_RESULTS_TOPIC")
+	if topic == "" {
+		topic = "transactions.results"
+	}
+	return topic
+}
+
+// returns the consumer group used to share the results topic between service instances
+func resultsGroupID() string {
+	groupID := os.Getenv("KAFKA_RESULTS_GROUP_ID")
+	if groupID == "" {
+		groupID = "payment_gateway_results"
+	}
+	return groupID
+}
+
+// consumes gateway results from the results topic as part of a consumer group until the context is cancelled
+func StartResultsConsumer(ctx context.Context, handle ResultHandler) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  []string{brokerURL()},
+		Topic:    ResultsTopic(),
+		GroupID:  resultsGroupID(),
+		MinBytes: 1,
+		MaxBytes: 10e6,
+	})
+
+	defer func() {
+		if err := reader.Close(); err != nil {
+			slog.Error("failed to close kafka results reader", slog.Any("error", err))
+		}
+	}()
+
+	slog.Info("consuming gateway results from kafka", slog.String("topic", ResultsTopic()))
+
+	for {
+		message, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				slog.Info("kafka results consumer stopped")
+				return
+			}
+			slog.Error("failed to read result from kafka", slog.Any("error", err))
+			continue
+		}
+
+		// a result failing on a temporary error is left uncommitted so it is consumed again after the restart
+		if !handleResult(ctx, handle, message) {
+			slog.Info("kafka results consumer stopped")
+			return
+		}
+
+		// the offset is committed once the result was handled or skipped, also when shutdown started meanwhile
+		if err := reader.CommitMessages(context.WithoutCancel(ctx), message); err != nil {
+			slog.Error("failed to commit kafka result offset", slog.Any("error", err))
+		}
+	}
+}
+
+// passes a result message to the handler and returns whether its offset can be committed, temporary failures are retried until the context is done so an outage
+// of the stores doesn't drop results. The handler runs in a span continuing the trace of the gateway that published the result and logs with the request ID the gateway
+// passed on. Messages without a valid signature of a known gateway and results failing permanently are dropped
+func handleResult(ctx context.Context, handle ResultHandler, message kafka.Message) bool {
+	ctx = tracing.Extract(ctx, headerCarrier{headers: &message.Headers})
+	ctx = logging.WithRequestID(ctx, headerValue(message, logging.RequestIDHeader))
+	ctx = logging.WithTransaction(ctx, string(message.Key))
+	ctx, span := tracing.Tracer().Start(ctx, message.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.source.name", message.Topic),
+			attribute.String("messaging.kafka.message.key", string(message.Key)),
+		),
+	)
+
+	// results are signed like callbacks, anyone who can write to the topic could settle transactions otherwise
+	gatewayID, err := verifyResult(message)
+	if err != nil {
+		slog.WarnContext(ctx, "dropping unverified gateway result", slog.Any("error", err))
+		tracing.End(span, err)
+		return true
+	}
+	ctx = logging.WithGateway(ctx, gatewayID)
+
+	contentType := headerValue(message, "Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	for {
+		err = resultPolicy.Do(ctx, func(ctx context.Context) error {
+			// a result being handled is finished even when shutdown starts meanwhile
+			return handle(context.WithoutCancel(ctx), gatewayID, message.Value, contentType)
+		})
+		if err == nil || IsPermanent(err) {
+			break
+		}
+
+		if ctx.Err() != nil {
+			slog.WarnContext(ctx, "stopped retrying gateway result on shutdown", slog.Any("error", err))
+			tracing.End(span, err)
+			return false
+		}
+		slog.ErrorContext(ctx, "failed to handle gateway result, retrying", slog.Any("error", err))
+	}
+
+	if err != nil {
+		slog.WarnContext(ctx, "dropping gateway result", slog.Any("error", err))
+	}
+	tracing.End(span, err)
+	return true
+}
+
+// checks the HMAC signature of a result message against the secret of the gateway it names and returns that gateway
+func verifyResult(message kafka.Message) (string, error) {
+	gatewayID := headerValue(message, security.GatewayIDHeader)
+	secret, ok := security.GatewaySecret(gatewayID)
+	if !ok {
+		return "", fmt.Errorf("unknown gateway %q", gatewayID)
+	}
+
+	signature := headerValue(message, security.SignatureHeader)
+	if signature == "" || !security.VerifySignature(string(message.Value), secret, signature) {
+		return "", fmt.Errorf("invalid signature of gateway %s", gatewayID)
+	}
+	return gatewayID, nil
+}
+
+// returns the value of a message header or an empty string
+func headerValue(message kafka.Message, key string) string {
+	for _, header := range message.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
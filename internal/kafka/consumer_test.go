@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"payment-gateway/internal/security"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// a signed result of the test gateway
+func signedResult(t *testing.T) kafka.Message {
+	t.Setenv("GATEWAY_SECRETS", "gateway_a=test-secret")
+	value := []byte(`{"transaction_id":"tx-1","status":"completed"}`)
+	return kafka.Message{
+		Topic: "transactions.results",
+		Key:   []byte("tx-1"),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: security.GatewayIDHeader, Value: []byte("gateway_a")},
+			{Key: security.SignatureHeader, Value: []byte(security.CreateSignature(string(value), "test-secret"))},
+		},
+	}
+}
+
+// retries quickly so the tests don't wait for the production backoff
+func fastResultPolicy(t *testing.T) {
+	policy := resultPolicy
+	resultPolicy.BaseDelay = time.Millisecond
+	resultPolicy.MaxDelay = time.Millisecond
+	resultPolicy.MaxElapsed = 20 * time.Millisecond
+	t.Cleanup(func() { resultPolicy = policy })
+}
+
+func TestPermanentErrors(t *testing.T) {
+	failure := errors.New("transaction not found")
+
+	if !IsPermanent(Permanent(failure)) || !errors.Is(Permanent(failure), failure) {
+		t.Fatalf("Expected a permanent error wrapping the failure")
+	}
+	if IsPermanent(failure) || IsPermanent(nil) || Permanent(nil) != nil {
+		t.Fatalf("Expected unmarked errors to be temporary")
+	}
+}
+
+func TestHandleResultCommitsOnSuccess(t *testing.T) {
+	fastResultPolicy(t)
+
+	calls := 0
+	committed := handleResult(context.Background(), func(ctx context.Context, gatewayID string, payload []byte, contentType string) error {
+		calls++
+		if gatewayID != "gateway_a" {
+			t.Fatalf("Expected the signing gateway, got %q", gatewayID)
+		}
+		return nil
+	}, signedResult(t))
+
+	if !committed || calls != 1 {
+		t.Fatalf("Expected the result to be committed after 1 call, got %d calls (committed %v)", calls, committed)
+	}
+}
+
+func TestHandleResultSkipsPermanentErrors(t *testing.T) {
+	fastResultPolicy(t)
+
+	calls := 0
+	committed := handleResult(context.Background(), func(ctx context.Context, gatewayID string, payload []byte, contentType string) error {
+		calls++
+		return Permanent(errors.New("invalid status"))
+	}, signedResult(t))
+
+	if !committed || calls != 1 {
+		t.Fatalf("Expected the result to be skipped after 1 call, got %d calls (committed %v)", calls, committed)
+	}
+}
+
+func TestHandleResultRetriesTemporaryErrors(t *testing.T) {
+	fastResultPolicy(t)
+
+	// fails for longer than one round of the policy
+	calls := 0
+	committed := handleResult(context.Background(), func(ctx context.Context, gatewayID string, payload []byte, contentType string) error {
+		calls++
+		if calls < 50 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, signedResult(t))
+
+	if !committed || calls != 50 {
+		t.Fatalf("Expected the result to be committed once it was handled, got %d calls (committed %v)", calls, committed)
+	}
+}
+
+func TestHandleResultLeavesTemporaryErrorsUncommittedOnShutdown(t *testing.T) {
+	fastResultPolicy(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	committed := handleResult(ctx, func(ctx context.Context, gatewayID string, payload []byte, contentType string) error {
+		calls++
+		if ctx.Err() != nil {
+			t.Fatalf("Expected the handler to run with a context that isn't cancelled")
+		}
+		if calls == 3 {
+			cancel()
+		}
+		return errors.New("connection refused")
+	}, signedResult(t))
+
+	if committed {
+		t.Fatalf("Expected the result to stay uncommitted")
+	}
+}
+
+func TestHandleResultDropsUnverifiedResults(t *testing.T) {
+	message := signedResult(t)
+	message.Value = []byte(`{"transaction_id":"tx-1","status":"failed"}`)
+
+	committed := handleResult(context.Background(), func(ctx context.Context, gatewayID string, payload []byte, contentType string) error {
+		t.Fatalf("Expected the handler not to be called")
+		return nil
+	}, message)
+
+	if !committed {
+		t.Fatalf("Expected the unverified result to be dropped and committed")
+	}
+}
@@ -0,0 +1,40 @@
+package kafka
+
+import (
+	"github.com/segmentio/kafka-go"
+)
+
+// reads and writes W3C trace-context through the headers of a Kafka message
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+// returns the value of a header or an empty string
+func (c headerCarrier) Get(key string) string {
+	for _, header := range *c.headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// sets a header replacing an existing one with the same key
+func (c headerCarrier) Set(key string, value string) {
+	for i, header := range *c.headers {
+		if header.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+// returns the keys of all headers
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.headers))
+	for _, header := range *c.headers {
+		keys = append(keys, header.Key)
+	}
+	return keys
+}
@@ -0,0 +1,25 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// checks the broker answers a metadata request, used by the readiness check
+func Ping(ctx context.Context) error {
+	conn, err := kafka.DialContext(ctx, "tcp", brokerURL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.Brokers()
+	return err
+}
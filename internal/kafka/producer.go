@@ -2,79 +2,123 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/metrics"
+	"payment-gateway/internal/resilience"
+	"payment-gateway/internal/tracing"
 	"time"
 
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var writer *kafka.Writer
 
-// Initialize the Kafka writer
-func init() {
+// retries a publish a few times on broker errors that are expected to clear up, the outbox relay retries later on top of it
+var publishPolicy = resilience.Policy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Retryable:   isRetryable,
+}
+
+// returns the Kafka broker address from the environment
+func brokerURL() string {
 	kafkaURL := os.Getenv("KAFKA_BROKER_URL")
 	if kafkaURL == "" {
 		kafkaURL = "kafka:9092"
 	}
+	return kafkaURL
+}
 
+// Initialize the Kafka writer
+func init() {
 	writer = &kafka.Writer{
-		Addr:                   kafka.TCP(kafkaURL),
+		Addr:                   kafka.TCP(brokerURL()),
 		Balancer:               &kafka.LeastBytes{},
 		AllowAutoTopicCreation: true,
 		BatchTimeout:           10 * time.Millisecond,
+		MaxAttempts:            1, // retries are done by publishPolicy
 	}
 
-	log.Println("Kafka writer initialized successfully.")
-}
-
-// returns the appropriate Kafka topic based on the data format.
-func GetTopic(dataFormat string) (string, error) {
-	switch dataFormat {
-	case "application/json":
-		return "transactions.json", nil
-	case "text/xml":
-		return "transactions.soap", nil
-	case "application/xml":
-		return "transactions.soap", nil
-	default:
-		return "", fmt.Errorf("unsupported data format: %s", dataFormat)
-	}
+	slog.Info("kafka writer initialized")
 }
 
-// publishes a message to the appropriate Kafka topic based on data format.
-func PublishTransaction(ctx context.Context, transactionID string, message []byte, dataFormat string) error {
+// publishes a message to the given Kafka topic keyed by the transaction ID so messages of one transaction stay in order, the trace context of the publish span and the request ID travel in the message headers
+func Publish(ctx context.Context, topic string, transactionID string, message []byte) (err error) {
 	if writer == nil {
-		log.Println("Kafka writer is nil, cannot publish to Kafka.")
+		slog.ErrorContext(ctx, "kafka writer is nil, cannot publish to kafka")
 		return fmt.Errorf("Kafka writer is not initialized")
 	}
 
-	topic, err := GetTopic(dataFormat)
-	if err != nil {
-		return err
-	}
-
 	// log to check the right topic selected
-	log.Printf("Publishing message to Kafka topic: %s...", topic)
+	slog.DebugContext(ctx, "publishing message to kafka", slog.String("topic", topic))
+
+	ctx, span := tracing.Tracer().Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("messaging.kafka.message.key", transactionID),
+		),
+	)
+	defer func() { tracing.End(span, err) }()
 
 	kafkaMessage := kafka.Message{
 		Key:   []byte(transactionID),
 		Value: message,
 		Topic: topic,
 	}
+	tracing.InjectInto(ctx, headerCarrier{headers: &kafkaMessage.Headers})
+	if requestID := logging.RequestID(ctx); requestID != "" {
+		kafkaMessage.Headers = append(kafkaMessage.Headers, kafka.Header{Key: logging.RequestIDHeader, Value: []byte(requestID)})
+	}
 
-	err = writer.WriteMessages(ctx, kafkaMessage)
+	start := time.Now()
+	err = publishPolicy.Do(ctx, func(ctx context.Context) error {
+		return writer.WriteMessages(ctx, kafkaMessage)
+	})
+	metrics.ObserveKafkaPublish(topic, time.Since(start), err)
 	if err != nil {
-		log.Printf("Error publishing to Kafka: %v", err)
+		slog.ErrorContext(ctx, "failed to publish to kafka", slog.String("topic", topic), slog.Any("error", err))
 		return err
 	}
 
-	log.Println("Message successfully published to Kafka on topic " + string(topic))
+	slog.InfoContext(ctx, "message published to kafka", slog.String("topic", topic))
 	return nil
 }
 
-// Close the writer when the system shut down
+// checks if a Kafka error may go away on retry, cancelled calls and errors the broker reports as permanent are not retried
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var writeErrors kafka.WriteErrors
+	if errors.As(err, &writeErrors) {
+		for _, writeErr := range writeErrors {
+			if writeErr != nil && !isRetryable(writeErr) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		return kafkaErr.Temporary()
+	}
+
+	// network errors reaching the broker
+	return true
+}
+
+// flushes the messages still buffered by the writer and closes it, called on shutdown once nothing publishes anymore
 func Close() error {
 	return writer.Close()
 }
@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the header a request ID is read from and echoed back in, it is also set on the Kafka messages of the request
+const RequestIDHeader = "X-Request-ID"
+
+// the IDs a log line is correlated by, carried in the context of a request or of the message being worked on
+type fields struct {
+	requestID     string
+	transactionID string
+	merchantID    string
+	gateway       string
+}
+
+// the type of the context key the fields are stored under
+type fieldsKey struct{}
+
+// makes slog write JSON lines to stdout with the IDs of the context added to every line, output of the log package goes through it too.
+// LOG_LEVEL sets the lowest level written, debug, info, warn or error, info by default
+func Init() {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level(os.Getenv("LOG_LEVEL"))})
+	slog.SetDefault(slog.New(contextHandler{Handler: handler}))
+}
+
+// parses a level name, unknown names are info
+func level(name string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// returns ctx with the request ID set
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	f := fromContext(ctx)
+	f.requestID = requestID
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// returns ctx with the transaction ID set
+func WithTransaction(ctx context.Context, transactionID string) context.Context {
+	f := fromContext(ctx)
+	f.transactionID = transactionID
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// returns ctx with the merchant ID set
+func WithMerchant(ctx context.Context, merchantID string) context.Context {
+	f := fromContext(ctx)
+	f.merchantID = merchantID
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// returns ctx with the gateway set
+func WithGateway(ctx context.Context, gateway string) context.Context {
+	f := fromContext(ctx)
+	f.gateway = gateway
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// returns the request ID of ctx or an empty string
+func RequestID(ctx context.Context) string {
+	return fromContext(ctx).requestID
+}
+
+// returns the fields of ctx
+func fromContext(ctx context.Context) fields {
+	f, _ := ctx.Value(fieldsKey{}).(fields)
+	return f
+}
+
+// adds the IDs of the context and the trace ID of its span to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+// adds the IDs that are set, a line without a request or transaction has none of them
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if ctx != nil {
+		f := fromContext(ctx)
+		addAttr(&record, "request_id", f.requestID)
+		addAttr(&record, "transaction_id", f.transactionID)
+		addAttr(&record, "merchant_id", f.merchantID)
+		addAttr(&record, "gateway", f.gateway)
+
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// keeps the IDs on loggers derived with With
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// keeps the IDs on loggers derived with WithGroup
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// adds a string attribute unless it is empty
+func addAttr(record *slog.Record, key string, value string) {
+	if value != "" {
+		record.AddAttrs(slog.String(key, value))
+	}
+}
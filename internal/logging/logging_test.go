@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestContextIDsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(contextHandler{Handler: slog.NewJSONHandler(&buf, nil)})
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	ctx = WithTransaction(ctx, "tx-1")
+	ctx = WithMerchant(ctx, "merchant-1")
+	ctx = WithGateway(ctx, "gateway_a")
+	logger.InfoContext(ctx, "hello")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected a JSON line, got %q", buf.String())
+	}
+
+	for key, want := range map[string]string{"msg": "hello", "request_id": "req-1", "transaction_id": "tx-1", "merchant_id": "merchant-1", "gateway": "gateway_a"} {
+		if line[key] != want {
+			t.Fatalf("Expected %s to be %q, got %v", key, want, line[key])
+		}
+	}
+}
+
+func TestUnsetIDsAreLeftOut(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(contextHandler{Handler: slog.NewJSONHandler(&buf, nil)})
+
+	logger.InfoContext(WithRequestID(context.Background(), "req-1"), "hello")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected a JSON line, got %q", buf.String())
+	}
+
+	for _, key := range []string{"transaction_id", "merchant_id", "gateway", "trace_id"} {
+		if _, ok := line[key]; ok {
+			t.Fatalf("Expected no %s, got %v", key, line[key])
+		}
+	}
+	if RequestID(context.Background()) != "" {
+		t.Fatalf("Expected no request ID on an empty context")
+	}
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// the prefix of every metric of the service
+const namespace = "payment_gateway"
+
+// the values of the result label, errors are counted apart so error rates can be graphed next to latency
+const (
+	resultOK    = "ok"
+	resultError = "error"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	transactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transactions_total",
+		Help:      "Transactions entering a status, by transaction type and status.",
+	}, []string{"type", "status"})
+
+	kafkaPublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kafka_publish_duration_seconds",
+		Help:      "Kafka publish latency including retries, by topic and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"topic", "result"})
+
+	kafkaPublishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_publish_failures_total",
+		Help:      "Kafka publishes that failed after their retries, by topic.",
+	}, []string{"topic"})
+
+	redisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Redis command latency by command and result.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command", "result"})
+
+	postgresCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "postgres_call_duration_seconds",
+		Help:      "Latency of database calls made inside the postgres bulkhead, by result.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"result"})
+
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the state machine of each circuit breaker, operator overrides aside: 0 closed, 1 half-open, 2 open.",
+	}, []string{"name"})
+
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Circuit breaker state transitions by breaker and states.",
+	}, []string{"name", "from", "to"})
+)
+
+// serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// records a served HTTP request under the route template so paths with IDs don't create a series each
+func ObserveHTTPRequest(route string, method string, code int, duration time.Duration) {
+	status := strconv.Itoa(code)
+	httpRequests.WithLabelValues(route, method, status).Inc()
+	httpRequestDuration.WithLabelValues(route, method, status).Observe(duration.Seconds())
+}
+
+// counts a transaction entering a status
+func CountTransaction(transactionType string, status string) {
+	transactions.WithLabelValues(transactionType, status).Inc()
+}
+
+// records a Kafka publish and counts it as failed when it returned an error
+func ObserveKafkaPublish(topic string, duration time.Duration, err error) {
+	kafkaPublishDuration.WithLabelValues(topic, result(err)).Observe(duration.Seconds())
+	if err != nil {
+		kafkaPublishFailures.WithLabelValues(topic).Inc()
+	}
+}
+
+// records a Redis command
+func ObserveRedisCommand(command string, duration time.Duration, err error) {
+	redisCommandDuration.WithLabelValues(command, result(err)).Observe(duration.Seconds())
+}
+
+// records a database call
+func ObservePostgresCall(duration time.Duration, err error) {
+	postgresCallDuration.WithLabelValues(result(err)).Observe(duration.Seconds())
+}
+
+// sets the state of a circuit breaker, closed, half-open or open
+func SetBreakerState(name string, state string) {
+	breakerState.WithLabelValues(name).Set(breakerStateValue(state))
+}
+
+// records a circuit breaker moving between states and sets its new state
+func RecordBreakerTransition(name string, from string, to string) {
+	breakerTransitions.WithLabelValues(name, from, to).Inc()
+	SetBreakerState(name, to)
+}
+
+// maps a breaker state to the gauge value, unknown states are reported as closed
+func breakerStateValue(state string) float64 {
+	switch state {
+	case "half-open":
+		return 1
+	case "open":
+		return 2
+	}
+	return 0
+}
+
+// returns the result label of a call
+func result(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultOK
+}
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"net/http"
+	"payment-gateway/internal/security"
+	"payment-gateway/internal/services"
+)
+
+// restricts admin routes to callers presenting the configured admin token
+func AdminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !security.VerifyAdminToken(r.Header.Get(security.AdminTokenHeader)) {
+			services.RespondWithError(w, http.StatusUnauthorized, "Invalid admin token", services.NegotiateContentType(r))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -20,3 +20,17 @@ func DataFormatMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// checks that the response format requested in the Accept header is supported for routes that have no request body
+func AcceptFormatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if services.NegotiateContentType(r) == "" {
+			services.RespondWithTransaction(w, models.APIResponse{
+				StatusCode: http.StatusNotAcceptable,
+				Message:    "Unsupported response format",
+			}, "application/json")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"payment-gateway/db"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/security"
+	"payment-gateway/internal/services"
+)
+
+// the type of the request context key holding the authenticated merchant, unexported so other packages can't overwrite it
+type merchantContextKey struct{}
+
+// authenticates merchants by the API key in the X-API-Key header and puts the merchant on the request context
+func MerchantAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := services.NegotiateContentType(r)
+
+		merchant, err := services.AuthenticateMerchant(r.Context(), r.Header.Get(security.APIKeyHeader))
+		if err != nil {
+			switch {
+			case errors.Is(err, db.ErrInvalidAPIKey):
+				services.RespondWithError(w, http.StatusUnauthorized, "Invalid API key", contentType)
+			case services.RespondIfOverloaded(w, err, contentType):
+			default:
+				slog.ErrorContext(r.Context(), "failed to authenticate merchant", slog.Any("error", err))
+				services.RespondWithError(w, http.StatusInternalServerError, "Failed to authenticate request", contentType)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithMerchant(r.Context(), merchant)))
+	})
+}
+
+// returns a copy of the context carrying the merchant, log lines written with it name the merchant
+func WithMerchant(ctx context.Context, merchant models.Merchant) context.Context {
+	ctx = logging.WithMerchant(ctx, merchant.MerchantID)
+	return context.WithValue(ctx, merchantContextKey{}, merchant)
+}
+
+// returns the merchant authenticated for the request
+func MerchantFromContext(ctx context.Context) (models.Merchant, bool) {
+	merchant, ok := ctx.Value(merchantContextKey{}).(models.Merchant)
+	return merchant, ok
+}
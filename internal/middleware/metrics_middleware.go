@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"payment-gateway/internal/metrics"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// records the count and latency of every request by route template, method and status code
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		metrics.ObserveHTTPRequest(routeTemplate(r), r.Method, recorder.status, time.Since(start))
+	})
+}
+
+// returns the path template of the matched route so requests for different IDs share it, the path is used for requests no route matched
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// keeps the status code a handler responded with, handlers that never call WriteHeader respond with 200 OK
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// records the status code before writing it
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/services"
+	"strconv"
+	"time"
+)
+
+// throttles requests per authenticated merchant and route with the configured limits, limited requests get 429 Too Many Requests in the caller's content type
+func RateLimitMiddleware(next http.Handler) http.Handler {
+	return rateLimit(next, merchantRateLimitSubject)
+}
+
+// throttles gateway callbacks per gateway, it has to run after SignatureMiddleware so only a verified gateway ID picks the bucket
+func GatewayRateLimitMiddleware(next http.Handler) http.Handler {
+	return rateLimit(next, gatewayRateLimitSubject)
+}
+
+// throttles requests per route and the subject returned for the request
+func rateLimit(next http.Handler, subject func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+
+		status, limited, err := services.CheckRateLimit(r.Context(), subject(r), route)
+		if err != nil {
+			// the limiter fails open so a Redis outage doesn't stop payments
+			slog.WarnContext(r.Context(), "failed to check rate limit", slog.String("route", route), slog.Any("error", err))
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !limited {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setRateLimitHeaders(w, status)
+		if !status.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(status.RetryAfter)))
+			services.RespondWithError(w, http.StatusTooManyRequests, "Rate limit exceeded", r.Header.Get("Content-Type"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// returns the authenticated merchant the request is counted against or the client address for anonymous callers, request headers never pick the bucket
+func merchantRateLimitSubject(r *http.Request) string {
+	if merchant, ok := MerchantFromContext(r.Context()); ok {
+		return merchant.MerchantID
+	}
+	return clientRateLimitSubject(r)
+}
+
+// returns the gateway whose signature was verified for the callback or the client address when there is none
+func gatewayRateLimitSubject(r *http.Request) string {
+	if gatewayID, ok := GatewayFromContext(r.Context()); ok {
+		return "gateway:" + gatewayID
+	}
+	return clientRateLimitSubject(r)
+}
+
+// returns the client address a request is counted against
+func clientRateLimitSubject(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// sets the RateLimit-* headers of the IETF rate limit header fields draft
+func setRateLimitHeaders(w http.ResponseWriter, status models.RateLimitStatus) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(status.Reset)))
+	w.Header().Set("RateLimit-Policy", strconv.Itoa(status.Limit)+";w="+strconv.Itoa(ceilSeconds(status.Window)))
+}
+
+// rounds a duration up to whole seconds as the headers carry seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
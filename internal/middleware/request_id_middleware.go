@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"payment-gateway/internal/logging"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// longest X-Request-ID accepted from a caller, longer or malformed IDs are replaced by a generated one
+const maxRequestIDLength = 128
+
+// takes the caller's X-Request-ID or generates one, echoes it in the response and puts it on the request context so every log line of the request carries it.
+// The request is logged once it is served
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(logging.RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+
+		w.Header().Set(logging.RequestIDHeader, requestID)
+		ctx := logging.WithRequestID(r.Context(), requestID)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		slog.InfoContext(ctx, "request served",
+			slog.String("method", r.Method),
+			slog.String("route", routeTemplate(r)),
+			slog.Int("status", recorder.status),
+			slog.Duration("duration", time.Since(start)),
+		)
+	})
+}
+
+// accepts IDs of printable ASCII without spaces so a caller can't break up log lines or headers with it
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < '!' || requestID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
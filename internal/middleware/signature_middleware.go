@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/security"
+	"payment-gateway/internal/services"
+)
+
+// the largest callback body read before its signature is checked, callbacks carry a transaction ID and a status only
+const maxCallbackBodySize = 1 << 20
+
+// verifies the HMAC signature of callback requests against the secret of the calling gateway so only authorized gateways can update transactions
+func SignatureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+
+		gatewayID := r.Header.Get(security.GatewayIDHeader)
+		secret, ok := security.GatewaySecret(gatewayID)
+		if !ok {
+			services.RespondWithError(w, http.StatusUnauthorized, "Unknown gateway", contentType)
+			return
+		}
+
+		// the signature covers the raw body so it has to be read before the handler decodes it, the body is capped as the caller isn't verified yet
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				services.RespondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large", contentType)
+				return
+			}
+			services.RespondWithError(w, http.StatusBadRequest, "Failed to read request body", contentType)
+			return
+		}
+
+		signature := r.Header.Get(security.SignatureHeader)
+		if signature == "" || !security.VerifySignature(string(body), secret, signature) {
+			services.RespondWithError(w, http.StatusUnauthorized, "Invalid signature", contentType)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		ctx := context.WithValue(r.Context(), gatewayContextKey{}, gatewayID)
+		next.ServeHTTP(w, r.WithContext(logging.WithGateway(ctx, gatewayID)))
+	})
+}
+
+// the type of the request context key holding the gateway whose signature was verified
+type gatewayContextKey struct{}
+
+// returns the gateway whose signature SignatureMiddleware verified for the request
+func GatewayFromContext(ctx context.Context) (string, bool) {
+	gatewayID, ok := ctx.Value(gatewayContextKey{}).(string)
+	return gatewayID, ok
+}
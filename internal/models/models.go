@@ -2,23 +2,109 @@ package models
 
 import "time"
 
+// the statuses a transaction can be in, see services.transactionTransitions for the allowed moves between them
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+	StatusRefunded   = "refunded"
+
+	// card-style deposits are authorized first and captured or voided later
+	StatusAuthorized     = "authorized"
+	StatusCapturePending = "capture_pending"
+	StatusVoidPending    = "void_pending"
+	StatusVoided         = "voided"
+)
+
+// the operations a gateway message asks the gateway to run on a transaction
+const (
+	MessageTypePayment   = "payment"
+	MessageTypeRefund    = "refund"
+	MessageTypeAuthorize = "authorize"
+	MessageTypeCapture   = "capture"
+	MessageTypeVoid      = "void"
+)
+
 // a transaction model
 type Transaction struct {
-	ID            int       `json:"id"`
-	TransactionID string    `json:"transaction_id"`
-	Amount        float64   `json:"amount"`
-	Type          string    `json:"type"` // deposit or withdrawal
-	Status        string    `json:"status"`
-	CreatedAt     time.Time `json:"created_at"`
-	DataFormat    string    `json:"data_format"`
+	ID            int       `json:"id" xml:"id"`
+	TransactionID string    `json:"transaction_id" xml:"transaction_id"`
+	Amount        Money     `json:"amount" xml:"amount"`
+	Type          string    `json:"type" xml:"type"` // deposit, withdrawal or refund
+	Status        string    `json:"status" xml:"status"`
+	CreatedAt     time.Time `json:"created_at" xml:"created_at"`
+	DataFormat    string    `json:"data_format" xml:"data_format"`
+	AccountID     string    `json:"account_id" xml:"account_id"`
+
+	// the amount booked on the account, converted with the FX rate locked when the transaction was created if the currencies differ
+	SettlementAmount Money      `json:"settlement_amount" xml:"settlement_amount"`
+	FXRate           string     `json:"fx_rate,omitempty" xml:"fx_rate,omitempty"`
+	FXRateAt         *time.Time `json:"fx_rate_at,omitempty" xml:"fx_rate_at,omitempty"`
+
+	// the deposit a refund gives money back for
+	ParentTransactionID string `json:"parent_transaction_id,omitempty" xml:"parent_transaction_id,omitempty"`
+
+	// the payment gateway the routing rules picked for the transaction, its refunds, captures and voids go to the same gateway
+	Gateway string `json:"gateway" xml:"gateway"`
+
+	// every attempt to hand the transaction to a gateway, only filled in when a single transaction is retrieved
+	GatewayAttempts []GatewayAttempt `json:"gateway_attempts,omitempty" xml:"gateway_attempts>attempt,omitempty"`
+
+	// the amount held by an authorization, Amount becomes the captured amount once it is captured
+	AuthorizedAmount *Money `json:"authorized_amount,omitempty" xml:"authorized_amount,omitempty"`
+
+	// the merchant that created the transaction, follow-up transactions belong to the merchant of the original one
+	MerchantID string `json:"merchant_id,omitempty" xml:"merchant_id,omitempty"`
+}
+
+// one attempt to publish a transaction message to a gateway
+type GatewayAttempt struct {
+	Gateway   string    `json:"gateway" xml:"gateway"`
+	Status    string    `json:"status" xml:"status"` // published or failed
+	Error     string    `json:"error,omitempty" xml:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+}
+
+// the message published to the gateway topic, the transaction fields are inlined next to the operation the gateway should run
+type GatewayMessage struct {
+	MessageType string `json:"message_type"`
+	Transaction
 }
 
 // a standard request structure for the APIs
 type TransactionRequest struct {
 	Type          string  `json:"type" xml:"type"`
-	Amount        float64 `json:"amount" xml:"amount"`
+	Amount        Decimal `json:"amount" xml:"amount"`
+	Currency      string  `json:"currency,omitempty" xml:"currency,omitempty"`
 	TransactionID string  `json:"transaction_id,omitempty" xml:"transaction_id,omitempty"`
 	Status        string  `json:"status,omitempty" xml:"status,omitempty"`
+	AccountID     string  `json:"account_id,omitempty" xml:"account_id,omitempty"`
+
+	// the currency the account is settled in, defaults to the account currency
+	SettlementCurrency string `json:"settlement_currency,omitempty" xml:"settlement_currency,omitempty"`
+}
+
+// the balance of an account, reserved funds are held for pending withdrawals and can't be spent until they are released
+type AccountBalance struct {
+	AccountID string `json:"account_id" xml:"account_id"`
+	Balance   Money  `json:"balance" xml:"balance"`
+	Reserved  Money  `json:"reserved" xml:"reserved"`
+	Available Money  `json:"available" xml:"available"`
+}
+
+// an exchange rate where one unit of the base currency buys rate units of the quote currency
+type FXRate struct {
+	BaseCurrency  string    `json:"base_currency" xml:"base_currency"`
+	QuoteCurrency string    `json:"quote_currency" xml:"quote_currency"`
+	Rate          string    `json:"rate" xml:"rate"` // decimal kept as text so it is stored exactly
+	UpdatedAt     time.Time `json:"updated_at" xml:"updated_at"`
+}
+
+// the body of the admin request loading FX rates
+type FXRatesRequest struct {
+	Rates []FXRate `json:"rates" xml:"rate"`
 }
 
 // a standard response structure for the APIs
@@ -27,3 +113,184 @@ type APIResponse struct {
 	Message    string      `json:"message" xml:"message"`
 	Data       interface{} `json:"data,omitempty" xml:"data,omitempty"`
 }
+
+// the stored outcome of a request sent with an Idempotency-Key so retries can be answered with the original response
+type IdempotencyRecord struct {
+	Key         string       `json:"key"`
+	RequestHash string       `json:"request_hash"`
+	StatusCode  int          `json:"status_code"` // zero while the original request is still in progress
+	Message     string       `json:"message"`
+	Transaction *Transaction `json:"transaction,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+
+	// the transaction the request creates and whether the reservation outlived the request, only set while the request is in progress
+	TransactionID string `json:"-"`
+	Expired       bool   `json:"-"`
+}
+
+// a message waiting in the outbox to be published to Kafka for a transaction
+type OutboxMessage struct {
+	ID            int64             `json:"id"`
+	TransactionID string            `json:"transaction_id"`
+	DataFormat    string            `json:"data_format"`
+	Gateway       string            `json:"gateway"`
+	Payload       []byte            `json:"payload"`
+	TraceContext  map[string]string `json:"trace_context,omitempty"` // W3C headers of the request that queued the message
+	RequestID     string            `json:"request_id,omitempty"`    // X-Request-ID of the request that queued the message
+	Attempts      int               `json:"attempts"`
+	CreatedAt     time.Time         `json:"created_at"`
+	LeaseID       string            `json:"lease_id,omitempty"` // the claim of the relay holding the message
+}
+
+// the state of the circuit breaker of a gateway as shown to operators
+type CircuitBreakerStatus struct {
+	Name                 string `json:"name" xml:"name"`
+	State                string `json:"state" xml:"state"`       // closed, half-open or open as seen by callers
+	Override             string `json:"override" xml:"override"` // auto, open or closed
+	Requests             uint32 `json:"requests" xml:"requests"`
+	TotalSuccesses       uint32 `json:"total_successes" xml:"total_successes"`
+	TotalFailures        uint32 `json:"total_failures" xml:"total_failures"`
+	ConsecutiveSuccesses uint32 `json:"consecutive_successes" xml:"consecutive_successes"`
+	ConsecutiveFailures  uint32 `json:"consecutive_failures" xml:"consecutive_failures"`
+}
+
+// the body of the admin request overriding a circuit breaker
+type CircuitBreakerOverrideRequest struct {
+	Override string `json:"override" xml:"override"`
+}
+
+// the body of the admin response listing circuit breakers
+type CircuitBreakersResponse struct {
+	Breakers []CircuitBreakerStatus `json:"breakers" xml:"breaker"`
+}
+
+// a merchant calling the API with its own API keys
+type Merchant struct {
+	MerchantID string    `json:"merchant_id" xml:"merchant_id"`
+	Name       string    `json:"name" xml:"name"`
+	CreatedAt  time.Time `json:"created_at" xml:"created_at"`
+}
+
+// an API key of a merchant, only its hash is stored so the key itself is returned once when it is issued
+type APIKey struct {
+	ID         string     `json:"id" xml:"id"`
+	MerchantID string     `json:"merchant_id" xml:"merchant_id"`
+	Prefix     string     `json:"prefix" xml:"prefix"` // the start of the key so merchants can tell their keys apart
+	Key        string     `json:"key,omitempty" xml:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"` // set on rotated keys still accepted for a grace period
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" xml:"revoked_at,omitempty"`
+}
+
+// the body of the admin request creating a merchant
+type MerchantRequest struct {
+	Name string `json:"name" xml:"name"`
+}
+
+// the body of the admin request rotating the API key of a merchant
+type RotateAPIKeyRequest struct {
+	GracePeriod string `json:"grace_period,omitempty" xml:"grace_period,omitempty"` // how long the previous keys keep working, a Go duration such as 24h
+}
+
+// a merchant together with a newly issued API key
+type MerchantCredentials struct {
+	Merchant Merchant `json:"merchant" xml:"merchant"`
+	APIKey   APIKey   `json:"api_key" xml:"api_key"`
+}
+
+// the body of the admin response listing the API keys of a merchant
+type APIKeysResponse struct {
+	APIKeys []APIKey `json:"api_keys" xml:"api_key"`
+}
+
+// the state of the rate limit a request was counted against
+type RateLimitStatus struct {
+	Allowed    bool
+	Limit      int           // requests allowed per window
+	Window     time.Duration // the time the bucket takes to refill completely
+	Remaining  int           // requests left right now
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next request is allowed, zero when it is allowed now
+}
+
+// webhook event statuses, a dead event ran out of delivery attempts and is only sent again when redelivered
+const (
+	WebhookEventPending   = "pending"
+	WebhookEventDelivered = "delivered"
+	WebhookEventDead      = "dead"
+)
+
+// a URL of a merchant that is sent an event whenever one of its transactions changes status
+type WebhookEndpoint struct {
+	ID         string    `json:"id" xml:"id"`
+	MerchantID string    `json:"merchant_id" xml:"merchant_id"`
+	URL        string    `json:"url" xml:"url"`
+	Secret     string    `json:"secret,omitempty" xml:"secret,omitempty"` // only returned when the endpoint is registered
+	CreatedAt  time.Time `json:"created_at" xml:"created_at"`
+}
+
+// the body of the request registering a webhook endpoint
+type WebhookEndpointRequest struct {
+	URL string `json:"url" xml:"url"`
+}
+
+// the body of the response listing webhook endpoints
+type WebhookEndpointsResponse struct {
+	Endpoints []WebhookEndpoint `json:"endpoints" xml:"endpoint"`
+}
+
+// the JSON body sent to webhook endpoints, the same event sent to several endpoints keeps its ID so merchants can drop duplicates
+type WebhookPayload struct {
+	EventID     string      `json:"event_id"`
+	Type        string      `json:"type"` // transaction. followed by the new status
+	CreatedAt   time.Time   `json:"created_at"`
+	Transaction Transaction `json:"transaction"`
+}
+
+// the delivery of an event to one webhook endpoint
+type WebhookEvent struct {
+	ID             int64      `json:"id" xml:"id"`
+	EventID        string     `json:"event_id" xml:"event_id"`
+	EndpointID     string     `json:"endpoint_id" xml:"endpoint_id"`
+	TransactionID  string     `json:"transaction_id" xml:"transaction_id"`
+	Type           string     `json:"type" xml:"type"`
+	Status         string     `json:"status" xml:"status"` // pending, delivered or dead
+	Attempts       int        `json:"attempts" xml:"attempts"`
+	LastError      string     `json:"last_error,omitempty" xml:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at" xml:"created_at"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty" xml:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty" xml:"delivered_at,omitempty"`
+	Payload        []byte     `json:"-" xml:"-"`
+	EndpointURL    string     `json:"-" xml:"-"`
+	EndpointSecret string     `json:"-" xml:"-"`
+	LeaseID        string     `json:"-" xml:"-"` // the claim of the dispatcher holding the event
+}
+
+// the body of the response listing webhook events
+type WebhookEventsResponse struct {
+	Events []WebhookEvent `json:"events" xml:"event"`
+}
+
+// the readiness of the service and of each dependency, degraded still takes traffic
+const (
+	HealthReady    = "ready"
+	HealthDegraded = "degraded"
+	HealthNotReady = "not_ready"
+	HealthOK       = "ok"
+	HealthDown     = "down"
+)
+
+// the outcome of checking one dependency of the service
+type DependencyHealth struct {
+	Status    string `json:"status" xml:"status"` // ok or down
+	LatencyMS int64  `json:"latency_ms" xml:"latency_ms"`
+	Error     string `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// the body of the readiness response with the check of every dependency
+type ReadinessReport struct {
+	Status       string                      `json:"status" xml:"status"` // ready, degraded or not_ready
+	Dependencies map[string]DependencyHealth `json:"dependencies" xml:"-"`
+	OpenBreakers []string                    `json:"open_breakers,omitempty" xml:"open_breaker,omitempty"`
+	Draining     bool                        `json:"draining,omitempty" xml:"draining,omitempty"` // the service is shutting down and takes no new traffic
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// the number of decimal places of each supported ISO 4217 currency, amounts are stored in these minor units
+var currencyExponents = map[string]int{
+	"AED": 2,
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EGP": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"INR": 2,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"QAR": 2,
+	"SAR": 2,
+	"USD": 2,
+}
+
+// a monetary amount in integer minor units of its currency so no rounding happens on the way, e.g. 1050 USD minor units is 10.50 dollars
+type Money struct {
+	MinorUnits int64  `json:"minor_units" xml:"minor_units"`
+	Currency   string `json:"currency" xml:"currency"`
+}
+
+// a decimal amount as sent by clients, kept as text until it is converted to minor units so no precision is lost in a float
+type Decimal string
+
+// accepts both JSON numbers and numeric strings
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("amount must be a decimal number")
+	}
+	*d = Decimal(number)
+	return nil
+}
+
+// encodes the amount as a JSON number
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(json.Number(d))
+}
+
+// returns the number of decimal places of a supported currency
+func CurrencyExponent(currency string) (int, bool) {
+	exponent, ok := currencyExponents[currency]
+	return exponent, ok
+}
+
+// converts a decimal amount into minor units of the currency, the amount may not have more decimal places than the currency allows
+func ParseMoney(amount Decimal, currency string) (Money, error) {
+	exponent, ok := CurrencyExponent(currency)
+	if !ok {
+		return Money{}, fmt.Errorf("unsupported currency: %s", currency)
+	}
+
+	value := strings.TrimSpace(string(amount))
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "-"), "+")
+
+	whole, fraction, _ := strings.Cut(value, ".")
+	if (whole == "" && fraction == "") || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("amount must be a decimal number")
+	}
+
+	// trailing zeros beyond the currency precision don't change the amount so only other digits are rejected
+	if len(fraction) > exponent {
+		if strings.Trim(fraction[exponent:], "0") != "" {
+			return Money{}, fmt.Errorf("amount has more decimal places than %s allows (%d)", currency, exponent)
+		}
+		fraction = fraction[:exponent]
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	digits := whole + fraction
+	if digits == "" {
+		digits = "0"
+	}
+
+	minorUnits, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("amount is too large")
+	}
+
+	if negative {
+		minorUnits = -minorUnits
+	}
+
+	return Money{MinorUnits: minorUnits, Currency: currency}, nil
+}
+
+// formats the amount as a decimal in major units of its currency, e.g. 10.50
+func (m Money) Decimal() string {
+	exponent, _ := CurrencyExponent(m.Currency)
+
+	units := m.MinorUnits
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+
+	digits := strconv.FormatInt(units, 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+// formats the amount with its currency, e.g. 10.50 USD
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// parses an exchange rate which must be a positive decimal number
+func ParseRate(rate string) (*big.Rat, error) {
+	value := strings.TrimSpace(rate)
+	whole, fraction, _ := strings.Cut(value, ".")
+	if (whole == "" && fraction == "") || !isDigits(whole) || !isDigits(fraction) {
+		return nil, fmt.Errorf("rate must be a decimal number")
+	}
+
+	parsed, ok := new(big.Rat).SetString(value)
+	if !ok || parsed.Sign() <= 0 {
+		return nil, fmt.Errorf("rate must be greater than zero")
+	}
+
+	return parsed, nil
+}
+
+// converts the amount into another currency at the given rate, the result is rounded half to even to the minor units of the target currency
+func (m Money) Convert(rate *big.Rat, currency string) (Money, error) {
+	fromExponent, ok := CurrencyExponent(m.Currency)
+	if !ok {
+		return Money{}, fmt.Errorf("unsupported currency: %s", m.Currency)
+	}
+
+	toExponent, ok := CurrencyExponent(currency)
+	if !ok {
+		return Money{}, fmt.Errorf("unsupported currency: %s", currency)
+	}
+
+	value := new(big.Rat).SetInt64(m.MinorUnits)
+	value.Mul(value, rate)
+
+	// move from minor units of the source currency to minor units of the target currency
+	exponent := toExponent - fromExponent
+	if exponent < 0 {
+		exponent = -exponent
+	}
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil))
+	if toExponent > fromExponent {
+		value.Mul(value, scale)
+	} else {
+		value.Quo(value, scale)
+	}
+
+	minorUnits := roundHalfEven(value)
+	if !minorUnits.IsInt64() {
+		return Money{}, fmt.Errorf("amount is too large")
+	}
+
+	return Money{MinorUnits: minorUnits.Int64(), Currency: currency}, nil
+}
+
+// returns the share part/whole of the amount rounded half to even, e.g. the settlement amount of a partial refund
+func (m Money) Proportion(part int64, whole int64) Money {
+	value := new(big.Rat).SetFrac(big.NewInt(m.MinorUnits), big.NewInt(whole))
+	value.Mul(value, new(big.Rat).SetInt64(part))
+
+	return Money{MinorUnits: roundHalfEven(value).Int64(), Currency: m.Currency}
+}
+
+// rounds a rational number to the nearest integer, ties go to the even neighbour so rounding doesn't drift in one direction
+func roundHalfEven(value *big.Rat) *big.Int {
+	quotient, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+
+	twiceRemainder := new(big.Int).Abs(remainder)
+	twiceRemainder.Lsh(twiceRemainder, 1)
+
+	comparison := twiceRemainder.Cmp(value.Denom())
+	if comparison > 0 || (comparison == 0 && quotient.Bit(0) == 1) {
+		if value.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+
+	return quotient
+}
+
+// checks if a string only contains ASCII digits
+func isDigits(value string) bool {
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package models
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount   Decimal
+		currency string
+		want     int64
+	}{
+		{"100", "USD", 10000},
+		{"100.5", "USD", 10050},
+		{"100.50", "USD", 10050},
+		{"0.01", "USD", 1},
+		{"100.500", "USD", 10050},
+		{"250000000.99", "USD", 25000000099},
+		{"1500", "JPY", 1500},
+		{"1.234", "KWD", 1234},
+		{".5", "EUR", 50},
+	}
+
+	for _, test := range tests {
+		money, err := ParseMoney(test.amount, test.currency)
+		if err != nil {
+			t.Fatalf("Expected no error parsing %s %s, got %v", test.amount, test.currency, err)
+		}
+		if money.MinorUnits != test.want || money.Currency != test.currency {
+			t.Fatalf("Expected %d %s for %s, got %+v", test.want, test.currency, test.amount, money)
+		}
+	}
+}
+
+func TestParseMoneyInvalid(t *testing.T) {
+	tests := []struct {
+		amount   Decimal
+		currency string
+	}{
+		{"100.001", "USD"},
+		{"100.5", "JPY"},
+		{"1.2345", "KWD"},
+		{"100", "XYZ"},
+		{"abc", "USD"},
+		{"1e5", "USD"},
+		{".", "USD"},
+		{"99999999999999999999", "USD"},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseMoney(test.amount, test.currency); err == nil {
+			t.Fatalf("Expected an error parsing %s %s", test.amount, test.currency)
+		}
+	}
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{Money{MinorUnits: 10050, Currency: "USD"}, "100.50"},
+		{Money{MinorUnits: 5, Currency: "USD"}, "0.05"},
+		{Money{MinorUnits: -1234, Currency: "KWD"}, "-1.234"},
+		{Money{MinorUnits: 1500, Currency: "JPY"}, "1500"},
+	}
+
+	for _, test := range tests {
+		if got := test.money.Decimal(); got != test.want {
+			t.Fatalf("Expected %s, got %s", test.want, got)
+		}
+	}
+}
+
+func TestMoneyConvert(t *testing.T) {
+	tests := []struct {
+		money    Money
+		rate     string
+		currency string
+		want     int64
+	}{
+		{Money{MinorUnits: 10000, Currency: "EUR"}, "1.085", "USD", 10850},
+		{Money{MinorUnits: 10000, Currency: "USD"}, "149.5", "JPY", 14950},
+		{Money{MinorUnits: 15000, Currency: "JPY"}, "0.0067", "USD", 10050},
+		{Money{MinorUnits: 1000, Currency: "USD"}, "0.307", "KWD", 3070},
+		{Money{MinorUnits: 1, Currency: "USD"}, "0.5", "EUR", 0},
+		{Money{MinorUnits: 3, Currency: "USD"}, "0.5", "EUR", 2},
+	}
+
+	for _, test := range tests {
+		rate, err := ParseRate(test.rate)
+		if err != nil {
+			t.Fatalf("Expected no error parsing rate %s, got %v", test.rate, err)
+		}
+
+		converted, err := test.money.Convert(rate, test.currency)
+		if err != nil {
+			t.Fatalf("Expected no error converting %s, got %v", test.money, err)
+		}
+		if converted.MinorUnits != test.want || converted.Currency != test.currency {
+			t.Fatalf("Expected %d %s converting %s at %s, got %+v", test.want, test.currency, test.money, test.rate, converted)
+		}
+	}
+}
+
+func TestParseRateInvalid(t *testing.T) {
+	for _, rate := range []string{"", "0", "-1.2", "abc", "1/2", "1e3"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Fatalf("Expected an error parsing rate %q", rate)
+		}
+	}
+}
+
+func TestMoneyProportion(t *testing.T) {
+	tests := []struct {
+		money Money
+		part  int64
+		whole int64
+		want  int64
+	}{
+		{Money{MinorUnits: 10850, Currency: "USD"}, 5000, 10000, 5425},
+		{Money{MinorUnits: 1112, Currency: "USD"}, 1025, 1025, 1112},
+		{Money{MinorUnits: 1112, Currency: "USD"}, 100, 1025, 108},
+		{Money{MinorUnits: 5, Currency: "USD"}, 1, 2, 2},
+	}
+
+	for _, test := range tests {
+		share := test.money.Proportion(test.part, test.whole)
+		if share.MinorUnits != test.want || share.Currency != test.money.Currency {
+			t.Fatalf("Expected %d/%d of %s to be %d, got %s", test.part, test.whole, test.money, test.want, share)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"context"
+	"payment-gateway/internal/metrics"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// the type of the context key holding the start time of a command, unexported so other packages can't overwrite it
+type commandStartKey struct{}
+
+// records the latency of every Redis command so calls outside the bulkhead are measured as well
+type metricsHook struct{}
+
+// notes the start time of a command
+func (metricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, commandStartKey{}, time.Now()), nil
+}
+
+// records the latency of a command, a missing key is a normal answer and not counted as an error
+func (metricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if start, ok := ctx.Value(commandStartKey{}).(time.Time); ok {
+		metrics.ObserveRedisCommand(cmd.Name(), time.Since(start), commandError(cmd))
+	}
+	return nil
+}
+
+// notes the start time of a pipeline
+func (metricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, commandStartKey{}, time.Now()), nil
+}
+
+// records the latency of a pipeline under the pipeline command name
+func (metricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	start, ok := ctx.Value(commandStartKey{}).(time.Time)
+	if !ok {
+		return nil
+	}
+
+	var err error
+	for _, cmd := range cmds {
+		if err = commandError(cmd); err != nil {
+			break
+		}
+	}
+	metrics.ObserveRedisCommand("pipeline", time.Since(start), err)
+	return nil
+}
+
+// returns the error of a command ignoring redis.Nil
+func commandError(cmd redis.Cmder) error {
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/models"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// takes one token from a token bucket holding up to ARGV[1] tokens that refills completely in ARGV[2] milliseconds,
+// the bucket is read and written in one script using the Redis clock so concurrent requests on any instance can't overspend it
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated_at')
+local tokens = tonumber(bucket[1])
+local updated_at = tonumber(bucket[2])
+if tokens == nil or updated_at == nil then
+	tokens = capacity
+	updated_at = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - updated_at) * capacity / window)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry_after = math.ceil((1 - tokens) * window / capacity)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated_at', now)
+redis.call('PEXPIRE', KEYS[1], window)
+
+return {allowed, math.floor(tokens), math.ceil((capacity - tokens) * window / capacity), retry_after}
+`)
+
+// returns the key of the token bucket of a caller on a route
+func rateLimitKey(subject string, route string) string {
+	return "rate_limit:" + subject + ":" + route
+}
+
+// counts a request against the token bucket of the caller on the route, the bucket holds limit requests and refills over the window
+func TakeRateLimitToken(ctx context.Context, subject string, route string, limit int, window time.Duration) (models.RateLimitStatus, error) {
+	status := models.RateLimitStatus{Limit: limit, Window: window}
+
+	result, err := tokenBucketScript.Run(ctx, rdb, []string{rateLimitKey(subject, route)}, limit, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return status, err
+	}
+	if len(result) != 4 {
+		return status, fmt.Errorf("unexpected rate limit script result: %v", result)
+	}
+
+	status.Allowed = result[0] == 1
+	status.Remaining = int(result[1])
+	status.Reset = time.Duration(result[2]) * time.Millisecond
+	status.RetryAfter = time.Duration(result[3]) * time.Millisecond
+
+	return status, nil
+}
@@ -2,17 +2,43 @@ package redis
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"log/slog"
 	"os"
+	"time"
 
+	"payment-gateway/internal/models"
 	"payment-gateway/internal/resilience"
 
 	"github.com/go-redis/redis/v8"
 )
 
-var ctx = context.Background()
 var rdb *redis.Client
 
+var (
+	// keeps trying to reach Redis for a minute while it is starting up next to the service
+	connectPolicy = resilience.Policy{
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   10 * time.Second,
+		MaxElapsed: time.Minute,
+	}
+
+	// retries status writes briefly as callbacks are validated against them
+	writePolicy = resilience.Policy{
+		MaxAttempts: 3,
+		BaseDelay:   50 * time.Millisecond,
+		MaxDelay:    500 * time.Millisecond,
+	}
+)
+
+// full transaction records are cached for a short time only as the status key stays the source for status checks
+const transactionCacheTTL = 10 * time.Minute
+
+// returns the cache key holding the full transaction record
+func transactionKey(transactionID string) string {
+	return "transaction:" + transactionID
+}
+
 // initializes the Redis client
 func InitRedis() {
 	var err error
@@ -22,32 +48,116 @@ func InitRedis() {
 		Password: os.Getenv("REDIS_PASSWORD"),
 		DB:       0,
 	})
+	rdb.AddHook(metricsHook{})
+	rdb.AddHook(tracingHook{})
 
 	// Test the connection with resilience's service retry logic
-	err = resilience.RetryOperation(func() error {
+	err = connectPolicy.Do(context.Background(), func(ctx context.Context) error {
 		return rdb.Ping(ctx).Err()
-	}, 5)
+	})
 
 	if err != nil {
-		log.Fatalf("Could not connect to Redis after retries: %v", err)
+		slog.Error("could not connect to redis after retries", slog.Any("error", err))
+		os.Exit(1)
 	}
 
-	log.Println("Connected to Redis successfully.")
+	slog.Info("connected to redis")
+}
+
+// closes the Redis client, called on shutdown
+func Close() error {
+	return rdb.Close()
+}
+
+// checks Redis answers, used by the readiness check
+func Ping(ctx context.Context) error {
+	return rdb.Ping(ctx).Err()
 }
 
 // sets the transaction status in Redis made it with no expiration but can be improved later by expiring it once tranasction status become completed
-func SetTransactionStatus(transactionID string, status string) {
-	err := rdb.Set(ctx, transactionID, status, 0).Err()
+func SetTransactionStatus(ctx context.Context, transactionID string, status string) {
+	err := writePolicy.Do(context.WithoutCancel(ctx), func(ctx context.Context) error {
+		return rdb.Set(ctx, transactionID, status, 0).Err()
+	})
 	if err != nil {
-		log.Printf("Could not set transaction status in Redis: %v", err)
+		slog.WarnContext(ctx, "could not set transaction status in redis", slog.Any("error", err))
+	}
+}
+
+// removes the transaction status from Redis
+func DeleteTransactionStatus(ctx context.Context, transactionID string) {
+	if err := rdb.Del(context.WithoutCancel(ctx), transactionID).Err(); err != nil {
+		slog.WarnContext(ctx, "could not delete transaction status in redis", slog.Any("error", err))
 	}
 }
 
 // retrieves the transaction status from Redis
-func GetTransactionStatus(transactionID string) (string, error) {
+func GetTransactionStatus(ctx context.Context, transactionID string) (string, error) {
 	status, err := rdb.Get(ctx, transactionID).Result()
 	if err != nil {
 		return "", err
 	}
 	return status, nil
 }
+
+// caches the full transaction record in Redis
+func SetTransaction(ctx context.Context, transaction models.Transaction) {
+	data, err := json.Marshal(transaction)
+	if err != nil {
+		slog.WarnContext(ctx, "could not encode transaction for redis", slog.Any("error", err))
+		return
+	}
+
+	if err := rdb.Set(context.WithoutCancel(ctx), transactionKey(transaction.TransactionID), data, transactionCacheTTL).Err(); err != nil {
+		slog.WarnContext(ctx, "could not cache transaction in redis", slog.Any("error", err))
+	}
+}
+
+// retrieves the cached transaction record from Redis
+func GetTransaction(ctx context.Context, transactionID string) (models.Transaction, error) {
+	var transaction models.Transaction
+
+	data, err := rdb.Get(ctx, transactionKey(transactionID)).Bytes()
+	if err != nil {
+		return transaction, err
+	}
+
+	err = json.Unmarshal(data, &transaction)
+	return transaction, err
+}
+
+// removes the cached transaction record so the next read goes to the database
+func DeleteTransaction(ctx context.Context, transactionID string) {
+	if err := rdb.Del(context.WithoutCancel(ctx), transactionKey(transactionID)).Err(); err != nil {
+		slog.WarnContext(ctx, "could not invalidate transaction in redis", slog.Any("error", err))
+	}
+}
+
+// completed idempotency records are kept in Redis for a day to answer client retries without a database lookup
+const idempotencyCacheTTL = 24 * time.Hour
+
+// caches a completed idempotency record in Redis
+func SetIdempotencyRecord(ctx context.Context, record models.IdempotencyRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		slog.WarnContext(ctx, "could not encode idempotency record for redis", slog.Any("error", err))
+		return
+	}
+
+	if err := rdb.Set(context.WithoutCancel(ctx), "idempotency:"+record.Key, data, idempotencyCacheTTL).Err(); err != nil {
+		slog.WarnContext(ctx, "could not cache idempotency record in redis", slog.Any("error", err))
+	}
+}
+
+// retrieves a cached idempotency record from Redis
+func GetIdempotencyRecord(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+
+	data, err := rdb.Get(ctx, "idempotency:"+key).Bytes()
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"context"
+	"payment-gateway/internal/tracing"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// starts a span for every Redis command made as part of a trace, commands outside a trace don't start one of their own
+type tracingHook struct{}
+
+// starts the span of a command
+func (tracingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return startCommandSpan(ctx, cmd.Name()), nil
+}
+
+// ends the span of a command, a missing key is a normal answer and not recorded as an error
+func (tracingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	endCommandSpan(ctx, commandError(cmd))
+	return nil
+}
+
+// starts the span of a pipeline
+func (tracingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return startCommandSpan(ctx, "pipeline"), nil
+}
+
+// ends the span of a pipeline with the first error of its commands
+func (tracingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if err = commandError(cmd); err != nil {
+			break
+		}
+	}
+	endCommandSpan(ctx, err)
+	return nil
+}
+
+// the type of the context key marking the span started by the hook, so a span of the caller is never ended by it
+type commandSpanKey struct{}
+
+// starts a client span for the command if ctx is part of a trace
+func startCommandSpan(ctx context.Context, command string) context.Context {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+
+	ctx, span := tracing.Tracer().Start(ctx, "redis "+command,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "redis"), attribute.String("db.operation", command)),
+	)
+	return context.WithValue(ctx, commandSpanKey{}, span)
+}
+
+// ends the span started for the command if there is one
+func endCommandSpan(ctx context.Context, err error) {
+	if span, ok := ctx.Value(commandSpanKey{}).(trace.Span); ok {
+		tracing.End(span, err)
+	}
+}
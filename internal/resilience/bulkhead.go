@@ -0,0 +1,151 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// returned when a bulkhead has no free slot and its wait queue is full or the wait took too long
+var ErrBulkheadFull = errors.New("too many concurrent calls")
+
+// the rejection of a call by a bulkhead, matches ErrBulkheadFull
+type BulkheadFullError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+// names the rejecting bulkhead
+func (e *BulkheadFullError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, ErrBulkheadFull)
+}
+
+// lets errors.Is match the rejection against ErrBulkheadFull
+func (e *BulkheadFullError) Is(target error) bool {
+	return target == ErrBulkheadFull
+}
+
+// the limits of a bulkhead
+type BulkheadSettings struct {
+	MaxConcurrent int           // calls running at the same time
+	MaxQueue      int           // calls waiting for a slot, further calls are rejected right away
+	MaxWait       time.Duration // how long a queued call waits for a slot
+}
+
+// caps the concurrent calls to one dependency so a slow dependency can't tie up every goroutine of the service
+type Bulkhead struct {
+	name     string
+	slots    chan struct{}
+	queue    chan struct{}
+	maxWait  time.Duration
+	retryGap time.Duration
+}
+
+// creates a bulkhead, the settings must allow at least one concurrent call
+func NewBulkhead(name string, settings BulkheadSettings) *Bulkhead {
+	if settings.MaxConcurrent < 1 {
+		settings.MaxConcurrent = 1
+	}
+	if settings.MaxQueue < 0 {
+		settings.MaxQueue = 0
+	}
+
+	// clients are told to come back once a queued call would have timed out, never sooner than a second
+	retryGap := settings.MaxWait.Round(time.Second)
+	if retryGap < time.Second {
+		retryGap = time.Second
+	}
+
+	return &Bulkhead{
+		name:     name,
+		slots:    make(chan struct{}, settings.MaxConcurrent),
+		queue:    make(chan struct{}, settings.MaxQueue),
+		maxWait:  settings.MaxWait,
+		retryGap: retryGap,
+	}
+}
+
+// runs the operation once a slot is free, the call is rejected right away when the queue is full or after waiting MaxWait for a slot
+func (b *Bulkhead) Execute(ctx context.Context, operation func() error) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() { <-b.slots }()
+
+	return operation()
+}
+
+// takes a slot waiting in the queue if all slots are busy
+func (b *Bulkhead) acquire(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case b.queue <- struct{}{}:
+	default:
+		return b.rejection()
+	}
+	defer func() { <-b.queue }()
+
+	timer := time.NewTimer(b.maxWait)
+	defer timer.Stop()
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return b.rejection()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// builds the error returned for a rejected call
+func (b *Bulkhead) rejection() error {
+	return &BulkheadFullError{Name: b.name, RetryAfter: b.retryGap}
+}
+
+// the bulkheads of the downstream dependencies, gateways get theirs when they are configured
+var defaultBulkheadSettings = map[string]BulkheadSettings{
+	"postgres": {MaxConcurrent: 50, MaxQueue: 100, MaxWait: time.Second},
+	"redis":    {MaxConcurrent: 100, MaxQueue: 200, MaxWait: 500 * time.Millisecond},
+	"kafka":    {MaxConcurrent: 20, MaxQueue: 100, MaxWait: 2 * time.Second},
+}
+
+// used for dependencies without settings of their own
+var DefaultBulkheadSettings = BulkheadSettings{MaxConcurrent: 20, MaxQueue: 50, MaxWait: time.Second}
+
+var (
+	bulkheadsMu sync.Mutex
+	bulkheads   = map[string]*Bulkhead{}
+)
+
+// replaces the bulkhead of a dependency, calls running in the old one finish there
+func ConfigureBulkhead(name string, settings BulkheadSettings) {
+	bulkheadsMu.Lock()
+	defer bulkheadsMu.Unlock()
+
+	bulkheads[name] = NewBulkhead(name, settings)
+}
+
+// returns the bulkhead of a dependency creating it on first use
+func GetBulkhead(name string) *Bulkhead {
+	bulkheadsMu.Lock()
+	defer bulkheadsMu.Unlock()
+
+	b, ok := bulkheads[name]
+	if !ok {
+		settings, ok := defaultBulkheadSettings[name]
+		if !ok {
+			settings = DefaultBulkheadSettings
+		}
+		b = NewBulkhead(name, settings)
+		bulkheads[name] = b
+	}
+	return b
+}
@@ -0,0 +1,113 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBulkheadLimitsConcurrentCalls(t *testing.T) {
+	bulkhead := NewBulkhead("test", BulkheadSettings{MaxConcurrent: 2, MaxQueue: 10, MaxWait: time.Second})
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bulkhead.Execute(context.Background(), func() error {
+				mu.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				mu.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Expected queued calls to run, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak != 2 {
+		t.Fatalf("Expected at most 2 concurrent calls, got %d", peak)
+	}
+}
+
+func TestBulkheadRejectsWhenQueueIsFull(t *testing.T) {
+	bulkhead := NewBulkhead("postgres", BulkheadSettings{MaxConcurrent: 1, MaxQueue: 1, MaxWait: 3 * time.Second})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go bulkhead.Execute(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	// the second call waits in the queue
+	queued := make(chan error)
+	go func() {
+		queued <- bulkhead.Execute(context.Background(), func() error { return nil })
+	}()
+	for len(bulkhead.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	err := bulkhead.Execute(context.Background(), func() error { return nil })
+	if !errors.Is(err, ErrBulkheadFull) {
+		t.Fatalf("Expected ErrBulkheadFull, got %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("Expected the call to be rejected right away, took %v", time.Since(start))
+	}
+
+	var rejection *BulkheadFullError
+	if !errors.As(err, &rejection) || rejection.Name != "postgres" || rejection.RetryAfter != 3*time.Second {
+		t.Fatalf("Expected a rejection of postgres retrying after 3s, got %+v", rejection)
+	}
+
+	close(release)
+	if err := <-queued; err != nil {
+		t.Fatalf("Expected the queued call to run, got %v", err)
+	}
+}
+
+func TestBulkheadRejectsAfterMaxWait(t *testing.T) {
+	bulkhead := NewBulkhead("kafka", BulkheadSettings{MaxConcurrent: 1, MaxQueue: 1, MaxWait: 10 * time.Millisecond})
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	go bulkhead.Execute(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	called := false
+	err := bulkhead.Execute(context.Background(), func() error { called = true; return nil })
+	if !errors.Is(err, ErrBulkheadFull) || called {
+		t.Fatalf("Expected the call to time out in the queue, got %v", err)
+	}
+
+	var rejection *BulkheadFullError
+	if errors.As(err, &rejection) && rejection.RetryAfter != time.Second {
+		t.Fatalf("Expected Retry-After to be at least a second, got %v", rejection.RetryAfter)
+	}
+}
@@ -0,0 +1,194 @@
+package resilience
+
+import (
+	"errors"
+	"fmt"
+	"payment-gateway/internal/metrics"
+	"payment-gateway/internal/models"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// the ways an operator can override a circuit breaker
+const (
+	OverrideAuto   = "auto"   // the breaker opens and closes on its own
+	OverrideOpen   = "open"   // every call is rejected
+	OverrideClosed = "closed" // every call goes through and the breaker doesn't count it
+)
+
+var (
+	// returned when an override is not one of the known modes
+	ErrInvalidOverride = errors.New("override must be auto, open or closed")
+
+	// returned when no circuit breaker has the given name
+	ErrBreakerNotFound = errors.New("circuit breaker not found")
+)
+
+// the settings of a circuit breaker, zero values fall back to the defaults
+type BreakerSettings struct {
+	MaxRequests         uint32        // calls let through while half-open
+	Interval            time.Duration // how often the counts are cleared while closed
+	Timeout             time.Duration // how long the breaker stays open before trying again
+	ConsecutiveFailures uint32        // failures in a row that open the breaker
+}
+
+// the settings used before a gateway is configured, the breaker opens after 6 failures in a row and half-opens after three seconds to let 1 request through
+var DefaultBreakerSettings = BreakerSettings{
+	MaxRequests:         1,
+	Interval:            5 * time.Second,
+	Timeout:             3 * time.Second,
+	ConsecutiveFailures: 6,
+}
+
+// a gobreaker together with the override set by an operator
+type breaker struct {
+	cb       *gobreaker.CircuitBreaker
+	override string
+}
+
+var (
+	breakersMu sync.RWMutex
+	breakers   = map[string]*breaker{}
+)
+
+// creates or replaces the circuit breaker of a gateway, its counts start over but an override stays in place
+func ConfigureBreaker(name string, settings BreakerSettings) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	override := OverrideAuto
+	if existing, ok := breakers[name]; ok {
+		override = existing.override
+	}
+
+	breakers[name] = &breaker{cb: newCircuitBreaker(name, settings), override: override}
+}
+
+// builds a gobreaker from the settings, its state changes are exported as metrics
+func newCircuitBreaker(name string, settings BreakerSettings) *gobreaker.CircuitBreaker {
+	if settings.MaxRequests == 0 {
+		settings.MaxRequests = DefaultBreakerSettings.MaxRequests
+	}
+	if settings.Interval == 0 {
+		settings.Interval = DefaultBreakerSettings.Interval
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = DefaultBreakerSettings.Timeout
+	}
+	if settings.ConsecutiveFailures == 0 {
+		settings.ConsecutiveFailures = DefaultBreakerSettings.ConsecutiveFailures
+	}
+
+	metrics.SetBreakerState(name, gobreaker.StateClosed.String())
+
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        name,
+		MaxRequests: settings.MaxRequests,
+		Interval:    settings.Interval,
+		Timeout:     settings.Timeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= settings.ConsecutiveFailures
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			metrics.RecordBreakerTransition(name, from.String(), to.String())
+		},
+	})
+}
+
+// returns the circuit breaker of a gateway creating it with the default settings on first use
+func circuitBreaker(name string) *breaker {
+	breakersMu.RLock()
+	b, ok := breakers[name]
+	breakersMu.RUnlock()
+	if ok {
+		return b
+	}
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	if b, ok := breakers[name]; ok {
+		return b
+	}
+
+	b = &breaker{cb: newCircuitBreaker(name, DefaultBreakerSettings), override: OverrideAuto}
+	breakers[name] = b
+	return b
+}
+
+// publishes a transaction through the circuit breaker of the given gateway so one failing gateway doesn't stop publishing to the others
+func PublishWithCircuitBreaker(name string, operation func() error) error {
+	b := circuitBreaker(name)
+
+	breakersMu.RLock()
+	override := b.override
+	breakersMu.RUnlock()
+
+	switch override {
+	case OverrideOpen:
+		return gobreaker.ErrOpenState
+	case OverrideClosed:
+		return operation()
+	}
+
+	_, err := b.cb.Execute(func() (interface{}, error) {
+		return nil, operation()
+	})
+	return err
+}
+
+// forces a circuit breaker open or closed, or hands it back to its own state machine
+func OverrideBreaker(name string, override string) (models.CircuitBreakerStatus, error) {
+	if override != OverrideAuto && override != OverrideOpen && override != OverrideClosed {
+		return models.CircuitBreakerStatus{}, ErrInvalidOverride
+	}
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[name]
+	if !ok {
+		return models.CircuitBreakerStatus{}, fmt.Errorf("%w: %s", ErrBreakerNotFound, name)
+	}
+
+	b.override = override
+	return b.status(), nil
+}
+
+// returns the state and counts of every circuit breaker ordered by name
+func BreakerStatuses() []models.CircuitBreakerStatus {
+	breakersMu.RLock()
+	defer breakersMu.RUnlock()
+
+	statuses := make([]models.CircuitBreakerStatus, 0, len(breakers))
+	for _, b := range breakers {
+		statuses = append(statuses, b.status())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// reports the state callers see, which is the override if one is set, the caller holds breakersMu
+func (b *breaker) status() models.CircuitBreakerStatus {
+	counts := b.cb.Counts()
+
+	state := b.cb.State().String()
+	if b.override != OverrideAuto {
+		state = b.override
+	}
+
+	return models.CircuitBreakerStatus{
+		Name:                 b.cb.Name(),
+		State:                state,
+		Override:             b.override,
+		Requests:             counts.Requests,
+		TotalSuccesses:       counts.TotalSuccesses,
+		TotalFailures:        counts.TotalFailures,
+		ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+		ConsecutiveFailures:  counts.ConsecutiveFailures,
+	}
+}
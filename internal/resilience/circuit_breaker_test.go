@@ -0,0 +1,55 @@
+package resilience
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestBreakersArePerGateway(t *testing.T) {
+	ConfigureBreaker("gateway_a", BreakerSettings{ConsecutiveFailures: 2})
+	ConfigureBreaker("gateway_b", BreakerSettings{})
+
+	failure := errors.New("broker unavailable")
+	for i := 0; i < 2; i++ {
+		PublishWithCircuitBreaker("gateway_a", func() error { return failure })
+	}
+
+	if err := PublishWithCircuitBreaker("gateway_a", func() error { return nil }); !errors.Is(err, gobreaker.ErrOpenState) {
+		t.Fatalf("Expected the breaker of gateway_a to be open, got %v", err)
+	}
+
+	if err := PublishWithCircuitBreaker("gateway_b", func() error { return nil }); err != nil {
+		t.Fatalf("Expected gateway_b to be unaffected, got %v", err)
+	}
+}
+
+func TestOverrideBreaker(t *testing.T) {
+	ConfigureBreaker("gateway_c", BreakerSettings{})
+
+	status, err := OverrideBreaker("gateway_c", OverrideOpen)
+	if err != nil || status.State != "open" {
+		t.Fatalf("Expected the breaker to be forced open, got %+v (%v)", status, err)
+	}
+
+	called := false
+	if err := PublishWithCircuitBreaker("gateway_c", func() error { called = true; return nil }); !errors.Is(err, gobreaker.ErrOpenState) || called {
+		t.Fatalf("Expected the call to be rejected, got %v", err)
+	}
+
+	if _, err := OverrideBreaker("gateway_c", OverrideAuto); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := PublishWithCircuitBreaker("gateway_c", func() error { return nil }); err != nil {
+		t.Fatalf("Expected the call to go through, got %v", err)
+	}
+
+	if _, err := OverrideBreaker("gateway_c", "half-open"); !errors.Is(err, ErrInvalidOverride) {
+		t.Fatalf("Expected ErrInvalidOverride, got %v", err)
+	}
+
+	if _, err := OverrideBreaker("unknown", OverrideOpen); !errors.Is(err, ErrBreakerNotFound) {
+		t.Fatalf("Expected ErrBreakerNotFound, got %v", err)
+	}
+}
@@ -1,35 +1,77 @@
 package resilience
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"time"
-
-	"github.com/sony/gobreaker"
 )
 
-// CircuitBreaker configuration for kafka publisher doing only 1 request at a time each five seconds
-var cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
-	Name:        "KafkaPublisher",
-	MaxRequests: 1,
-	Interval:    5 * time.Second,
-	Timeout:     3 * time.Second,
-})
-
-// publishes a transaction to Kafka using a circuit breaker
-func PublishWithCircuitBreaker(operation func() error) error {
-	_, err := cb.Execute(func() (interface{}, error) {
-		return nil, operation()
-	})
-	return err
+// a retry policy with exponential backoff and full jitter, the zero value tries once
+type Policy struct {
+	MaxAttempts int           // attempts including the first one, 0 means no limit other than MaxElapsed
+	BaseDelay   time.Duration // the backoff ceiling of the first retry, doubled on each retry
+	MaxDelay    time.Duration // the highest backoff ceiling, 0 means no cap
+	MaxElapsed  time.Duration // no retry is started after this much time since the first attempt, 0 means no limit
+
+	// decides whether an error is worth retrying, every error is retried when it is nil
+	Retryable func(error) bool
 }
 
-// Retry operation with exponential backoff
-func RetryOperation(operation func() error, maxRetries int) error {
-	for i := 0; i < maxRetries; i++ {
-		if err := operation(); err == nil {
+// runs the operation until it succeeds, returns an error that isn't retryable or the policy runs out, the returned error wraps the last error of the operation
+func (p Policy) Do(ctx context.Context, operation func(ctx context.Context) error) error {
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := operation(ctx)
+		if err == nil {
 			return nil
 		}
-		time.Sleep(time.Duration(2^i) * time.Second)
+
+		if p.Retryable != nil && !p.Retryable(err) {
+			return err
+		}
+
+		if p.MaxAttempts == 0 && p.MaxElapsed == 0 {
+			return err
+		}
+
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return fmt.Errorf("operation failed after %d attempts: %w", attempt, err)
+		}
+
+		delay := p.backoff(attempt)
+		if p.MaxElapsed > 0 && time.Since(start)+delay > p.MaxElapsed {
+			return fmt.Errorf("operation failed after %d attempts in %s: %w", attempt, time.Since(start).Round(time.Millisecond), err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("operation cancelled after %d attempts: %w, last error: %w", attempt, ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// returns a random delay between zero and the exponential backoff ceiling of the attempt so retrying clients don't line up
+func (p Policy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay
+	for i := 1; i < attempt && ceiling > 0; i++ {
+		if p.MaxDelay > 0 && ceiling >= p.MaxDelay {
+			break
+		}
+		ceiling *= 2
 	}
-	return fmt.Errorf("operation failed after %d attempts", maxRetries)
+
+	if p.MaxDelay > 0 && (ceiling > p.MaxDelay || ceiling <= 0) {
+		ceiling = p.MaxDelay
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
 }
@@ -0,0 +1,99 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPolicyRetriesUntilSuccess(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("temporary")
+		}
+		return nil
+	})
+
+	if err != nil || attempts != 3 {
+		t.Fatalf("Expected success on the third attempt, got %d attempts (%v)", attempts, err)
+	}
+}
+
+func TestPolicyWrapsLastError(t *testing.T) {
+	failure := errors.New("connection refused")
+	policy := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return failure
+	})
+
+	if !errors.Is(err, failure) || attempts != 3 {
+		t.Fatalf("Expected the last error after 3 attempts, got %d attempts (%v)", attempts, err)
+	}
+}
+
+func TestPolicyStopsOnPermanentError(t *testing.T) {
+	permanent := errors.New("not found")
+	policy := Policy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		Retryable:   func(err error) bool { return !errors.Is(err, permanent) },
+	}
+
+	attempts := 0
+	err := policy.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return permanent
+	})
+
+	if err != permanent || attempts != 1 {
+		t.Fatalf("Expected the error to be returned as is after 1 attempt, got %d attempts (%v)", attempts, err)
+	}
+}
+
+func TestPolicyHonorsContext(t *testing.T) {
+	failure := errors.New("timeout")
+	policy := Policy{BaseDelay: time.Hour, MaxElapsed: 24 * time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := policy.Do(ctx, func(ctx context.Context) error {
+		return failure
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, failure) || time.Since(start) > time.Second {
+		t.Fatalf("Expected the retry to stop with the context, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestPolicyMaxElapsed(t *testing.T) {
+	policy := Policy{BaseDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond, MaxElapsed: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := policy.Do(context.Background(), func(ctx context.Context) error {
+		return errors.New("unavailable")
+	})
+
+	if err == nil || time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("Expected the retry to give up within the max elapsed time, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestPolicyBackoffIsCapped(t *testing.T) {
+	policy := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt := 1; attempt < 100; attempt++ {
+		if delay := policy.backoff(attempt); delay < 0 || delay > time.Second {
+			t.Fatalf("Expected a delay between 0 and 1s on attempt %d, got %s", attempt, delay)
+		}
+	}
+}
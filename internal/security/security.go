@@ -2,8 +2,18 @@ package security
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// headers gateways use to identify themselves and sign their callback requests
+const (
+	GatewayIDHeader = "X-Gateway-ID"
+	SignatureHeader = "X-Signature"
 )
 
 // masks the sensitive information before publishing to Kafka using 64encoding but can be improved by using stronger algorithms and match it with the secret key.
@@ -24,3 +34,72 @@ func VerifySignature(data string, secretKey string, signature string) bool {
 	expectedSignature := CreateSignature(data, secretKey)
 	return hmac.Equal([]byte(expectedSignature), []byte(signature))
 }
+
+// returns the callback secret of a gateway configured in GATEWAY_SECRETS as comma separated gateway=secret pairs
+func GatewaySecret(gatewayID string) (string, bool) {
+	if gatewayID == "" {
+		return "", false
+	}
+
+	for _, pair := range strings.Split(os.Getenv("GATEWAY_SECRETS"), ",") {
+		id, secret, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && id == gatewayID && secret != "" {
+			return secret, true
+		}
+	}
+
+	return "", false
+}
+
+// header carrying the token of operators calling the admin endpoints
+const AdminTokenHeader = "X-Admin-Token"
+
+// checks the token against ADMIN_API_TOKEN, admin access is refused when no token is configured
+func VerifyAdminToken(token string) bool {
+	expected := os.Getenv("ADMIN_API_TOKEN")
+	if expected == "" || token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(expected), []byte(token))
+}
+
+// header carrying the API key merchants authenticate with
+const APIKeyHeader = "X-API-Key"
+
+// marks the keys issued by this service so leaked keys are easy to spot
+const apiKeyPrefix = "pgk_"
+
+// generates a random API key
+func GenerateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashes an API key for storage and lookup, keys are long random strings so a fast hash can't be brute forced
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// headers sent with every webhook event, the signature header is shared with gateway callbacks
+const (
+	WebhookIDHeader        = "X-Webhook-ID"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+// generates the secret a webhook endpoint's events are signed with
+func GenerateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// signs a webhook event, the timestamp is signed together with the body so a captured event can't be replayed later
+func SignWebhook(timestamp string, payload []byte, secret string) string {
+	return CreateSignature(timestamp+"."+string(payload), secret)
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payment-gateway/db"
+	"payment-gateway/internal/metrics"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/redis"
+)
+
+// returned when a capture or void is requested for a transaction that isn't an open authorization
+var ErrNotAuthorized = errors.New("only authorized transactions can be captured or voided")
+
+// retrieves an authorization that can still be captured or voided, read from the database as its current status decides that
+func GetAuthorizedTransaction(ctx context.Context, scope db.Scope, transactionID string) (models.Transaction, error) {
+	transaction, err := getTransactionFromDB(ctx, scope, transactionID)
+	if err != nil {
+		return transaction, err
+	}
+
+	if transaction.AuthorizedAmount == nil || transaction.Status != models.StatusAuthorized {
+		return transaction, ErrNotAuthorized
+	}
+
+	return transaction, nil
+}
+
+// validates the capture request (data fields) and returns the amount to capture, the whole authorized amount is captured when no amount is given
+func ValidateCaptureRequest(request models.TransactionRequest, authorization models.Transaction) (models.Money, error) {
+	if request.Currency != "" && request.Currency != authorization.Amount.Currency {
+		return models.Money{}, fmt.Errorf("capture currency must be %s", authorization.Amount.Currency)
+	}
+
+	if request.Amount == "" {
+		return *authorization.AuthorizedAmount, nil
+	}
+
+	amount, err := models.ParseMoney(request.Amount, authorization.Amount.Currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+
+	if amount.MinorUnits <= 0 {
+		return models.Money{}, fmt.Errorf("amount must be greater than zero")
+	}
+
+	if amount.MinorUnits > authorization.AuthorizedAmount.MinorUnits {
+		return models.Money{}, fmt.Errorf("amount must not exceed the authorized amount of %s", authorization.AuthorizedAmount)
+	}
+
+	return amount, nil
+}
+
+// asks the gateway to capture the amount of an authorization, a partial capture settles its share of the authorized settlement amount
+func CaptureTransaction(ctx context.Context, authorization models.Transaction, amount models.Money) (models.Transaction, error) {
+	capture := authorization
+	capture.Status = models.StatusCapturePending
+	capture.Amount = amount
+	capture.SettlementAmount = authorization.SettlementAmount.Proportion(amount.MinorUnits, authorization.AuthorizedAmount.MinorUnits)
+
+	return updateAuthorization(ctx, capture, models.MessageTypeCapture)
+}
+
+// asks the gateway to release the hold of an authorization
+func VoidTransaction(ctx context.Context, authorization models.Transaction) (models.Transaction, error) {
+	void := authorization
+	void.Status = models.StatusVoidPending
+
+	return updateAuthorization(ctx, void, models.MessageTypeVoid)
+}
+
+// stores the capture or void request with its gateway message and refreshes Redis, an authorization that changed meanwhile is reported as an invalid transition
+func updateAuthorization(ctx context.Context, transaction models.Transaction, messageType string) (models.Transaction, error) {
+	message, err := NewOutboxMessage(ctx, transaction, messageType)
+	if err != nil {
+		return transaction, err
+	}
+
+	err = withPostgres(ctx, "UpdateAuthorization", func(ctx context.Context) error {
+		return db.UpdateAuthorization(ctx, transactionScope(transaction), transaction, message)
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrStatusConflict) {
+			return transaction, fmt.Errorf("%w to %s", ErrInvalidTransition, transaction.Status)
+		}
+		return transaction, err
+	}
+
+	// the update is committed so the cache is brought up to date even when the caller gave up meanwhile
+	ctx = context.WithoutCancel(ctx)
+
+	metrics.CountTransaction(transaction.Type, transaction.Status)
+	withRedisWrite(ctx, "SetTransactionStatus", func() { redis.SetTransactionStatus(ctx, transaction.TransactionID, transaction.Status) })
+	withRedisWrite(ctx, "DeleteTransaction", func() { redis.DeleteTransaction(ctx, transaction.TransactionID) })
+
+	return transaction, nil
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"payment-gateway/internal/gateways"
+	"payment-gateway/internal/metrics"
+	"payment-gateway/internal/resilience"
+	"payment-gateway/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the bulkheads limiting concurrent calls to the downstream dependencies
+const (
+	postgresBulkhead = "postgres"
+	redisBulkhead    = "redis"
+	kafkaBulkhead    = "kafka"
+)
+
+// runs a database call inside the postgres bulkhead in a span named after the call and records its latency, the call is passed the context of the span so its queries are traced as children.
+// A rejection is returned as a resilience.BulkheadFullError.
+// A caller whose context ends while it waits for a slot gives up its place in the queue
+func withPostgres(ctx context.Context, name string, operation func(ctx context.Context) error) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "postgres "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql"), attribute.String("db.operation", name)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	return resilience.GetBulkhead(postgresBulkhead).Execute(ctx, func() error {
+		// timed once a slot is taken so the latency shows the database and not the queue
+		start := time.Now()
+		err := operation(ctx)
+		metrics.ObservePostgresCall(time.Since(start), err)
+		return err
+	})
+}
+
+// runs a cache call inside the redis bulkhead, callers treat a rejection like a cache miss, the commands are traced by the Redis client
+func withRedis(ctx context.Context, operation func() error) error {
+	return resilience.GetBulkhead(redisBulkhead).Execute(ctx, operation)
+}
+
+// runs a cache write inside the redis bulkhead, a rejected write is skipped like a failed one as the database stays the source of truth
+func withRedisWrite(ctx context.Context, name string, write func()) {
+	err := withRedis(ctx, func() error {
+		write()
+		return nil
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "skipped redis write", slog.String("operation", name), slog.Any("error", err))
+	}
+}
+
+// runs a publish inside the bulkhead of the gateway and then the shared kafka bulkhead
+func withKafka(ctx context.Context, gatewayID string, operation func() error) error {
+	return resilience.GetBulkhead(gateways.BulkheadName(gatewayID)).Execute(ctx, func() error {
+		return resilience.GetBulkhead(kafkaBulkhead).Execute(ctx, operation)
+	})
+}
@@ -0,0 +1,35 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestWithPostgresPassesTheSpanToTheCall(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(provider) })
+
+	var callSpan trace.SpanContext
+	err := withPostgres(context.Background(), "TestCall", func(ctx context.Context) error {
+		callSpan = trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "postgres TestCall" {
+		t.Fatalf("Expected one postgres span, got %d", len(spans))
+	}
+	if !callSpan.IsValid() || callSpan.SpanID() != spans[0].SpanContext().SpanID() {
+		t.Fatalf("Expected the call to run in the postgres span")
+	}
+}
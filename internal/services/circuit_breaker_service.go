@@ -0,0 +1,24 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/resilience"
+)
+
+// returns the state and counts of the circuit breaker of every gateway
+func ListCircuitBreakers() []models.CircuitBreakerStatus {
+	return resilience.BreakerStatuses()
+}
+
+// forces the circuit breaker of a gateway open or closed or hands it back to its own state machine, overrides only apply to this instance
+func OverrideCircuitBreaker(ctx context.Context, name string, override string) (models.CircuitBreakerStatus, error) {
+	status, err := resilience.OverrideBreaker(name, override)
+	if err != nil {
+		return status, err
+	}
+
+	slog.InfoContext(ctx, "circuit breaker override set", slog.String("breaker", name), slog.String("override", override))
+	return status, nil
+}
@@ -3,9 +3,16 @@ package services
 import (
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"payment-gateway/internal/models"
+	"payment-gateway/internal/resilience"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Supported content types can easily be extended by adding more types here
@@ -20,20 +27,56 @@ func IsSupportedContentType(contentType string) bool {
 	return supportedContentTypes[contentType]
 }
 
+// picks the response format from the Accept header falling back to the request content type and then JSON, returns an empty string when nothing acceptable is supported
+func NegotiateContentType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		if contentType := r.Header.Get("Content-Type"); IsSupportedContentType(contentType) {
+			return contentType
+		}
+		return "application/json"
+	}
+
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+
+		if IsSupportedContentType(mediaType) {
+			return mediaType
+		}
+
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return "application/json"
+		}
+
+		if mediaType == "text/*" {
+			return "text/xml"
+		}
+	}
+
+	return ""
+}
+
 // decodes the incoming request based on content type
-func DecodeRequest(r *http.Request, request *models.TransactionRequest) error {
-	contentType := r.Header.Get("Content-Type")
+func DecodeRequest(r *http.Request, request interface{}) error {
+	return DecodePayload(r.Body, r.Header.Get("Content-Type"), request)
+}
+
+// decodes a payload in the given content type into request, shared by HTTP requests and Kafka messages
+func DecodePayload(body io.Reader, contentType string, request interface{}) error {
 	if !IsSupportedContentType(contentType) {
 		return fmt.Errorf("unsupported content type")
 	}
 
 	switch contentType {
 	case "application/json":
-		return json.NewDecoder(r.Body).Decode(request)
+		return json.NewDecoder(body).Decode(request)
 	case "text/xml":
-		return xml.NewDecoder(r.Body).Decode(request)
+		return xml.NewDecoder(body).Decode(request)
 	case "application/xml":
-		return xml.NewDecoder(r.Body).Decode(request)
+		return xml.NewDecoder(body).Decode(request)
 	default:
 		return fmt.Errorf("unsupported content type")
 	}
@@ -50,7 +93,7 @@ func RespondWithTransaction(w http.ResponseWriter, response models.APIResponse,
 	switch contentType {
 	case "application/json":
 		json.NewEncoder(w).Encode(response)
-	case "text/xml":
+	case "text/xml", "application/xml":
 		xml.NewEncoder(w).Encode(response)
 	default:
 		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
@@ -72,7 +115,19 @@ func RespondWithError(w http.ResponseWriter, statusCode int, message string, con
 	switch contentType {
 	case "application/json":
 		json.NewEncoder(w).Encode(response)
-	case "text/xml":
+	case "text/xml", "application/xml":
 		xml.NewEncoder(w).Encode(response)
 	}
 }
+
+// responds 503 with a Retry-After header when a dependency bulkhead rejected the call, returns false for any other error
+func RespondIfOverloaded(w http.ResponseWriter, err error, contentType string) bool {
+	var rejection *resilience.BulkheadFullError
+	if !errors.As(err, &rejection) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(rejection.RetryAfter/time.Second)))
+	RespondWithError(w, http.StatusServiceUnavailable, "Service is busy, please retry later", contentType)
+	return true
+}
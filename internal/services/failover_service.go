@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"payment-gateway/db"
+	"payment-gateway/internal/gateways"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/redis"
+)
+
+// records the outcome of publishing an outbox message to its gateway on the transaction
+func recordGatewayAttempt(ctx context.Context, message models.OutboxMessage, publishErr error) {
+	attempt := models.GatewayAttempt{Gateway: message.Gateway, Status: "published"}
+	if publishErr != nil {
+		attempt.Status = "failed"
+		attempt.Error = publishErr.Error()
+	}
+
+	err := withPostgres(ctx, "RecordGatewayAttempt", func(ctx context.Context) error {
+		return db.RecordGatewayAttempt(ctx, message.TransactionID, attempt)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record gateway attempt", slog.Any("error", err))
+	}
+}
+
+// re-routes the message of a transaction the gateway failed to take to the next eligible gateway, returns false when the failover policy leaves no other gateway
+func failoverOutboxMessage(ctx context.Context, message models.OutboxMessage, publishErr error) bool {
+	transaction, err := getTransactionFromDB(ctx, db.SystemScope, message.TransactionID)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to retrieve transaction for failover", slog.Any("error", err))
+		return false
+	}
+
+	// only new transactions can move, refunds, captures and voids have to reach the gateway holding the original transaction
+	if transaction.Status != models.StatusPending || transaction.ParentTransactionID != "" {
+		return false
+	}
+
+	var attempts []models.GatewayAttempt
+	err = withPostgres(ctx, "GetGatewayAttempts", func(ctx context.Context) (err error) {
+		attempts, err = db.GetGatewayAttempts(ctx, db.SystemScope, message.TransactionID)
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to retrieve gateway attempts", slog.Any("error", err))
+		return false
+	}
+
+	tried := []string{message.Gateway}
+	for _, attempt := range attempts {
+		tried = append(tried, attempt.Gateway)
+	}
+
+	next, err := gateways.Failover(gateways.RouteRequest{TransactionType: transaction.Type, Amount: transaction.Amount, MerchantID: transaction.MerchantID}, tried)
+	if err != nil {
+		return false
+	}
+
+	transaction.Gateway = next.ID()
+	rerouted, err := NewOutboxMessage(ctx, transaction, newTransactionMessageType(transaction))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to build failover message", slog.Any("error", err))
+		return false
+	}
+	rerouted.ID = message.ID
+
+	err = withPostgres(ctx, "RerouteTransaction", func(ctx context.Context) error {
+		return db.RerouteTransaction(ctx, rerouted, publishErr.Error())
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to fail over transaction", slog.String("next_gateway", next.ID()), slog.Any("error", err))
+		return false
+	}
+
+	withRedisWrite(ctx, "DeleteTransaction", func() { redis.DeleteTransaction(ctx, message.TransactionID) })
+
+	slog.InfoContext(ctx, "failed over transaction", slog.String("next_gateway", next.ID()))
+	return true
+}
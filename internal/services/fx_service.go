@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"strings"
+)
+
+var (
+	// returned when no rate is stored between the transaction and settlement currencies
+	ErrFXRateNotFound = errors.New("no fx rate available")
+
+	// returned when the converted amount rounds down to nothing in the settlement currency
+	ErrSettlementAmountTooSmall = errors.New("amount is too small to settle")
+)
+
+// returns the currency a transaction settles in, the requested one or else the account currency or else the transaction currency for a new account
+func ResolveSettlementCurrency(ctx context.Context, scope db.Scope, request models.TransactionRequest, amount models.Money) (string, error) {
+	if request.SettlementCurrency != "" {
+		return request.SettlementCurrency, nil
+	}
+
+	var currency string
+	err := withPostgres(ctx, "GetAccountCurrency", func(ctx context.Context) (err error) {
+		currency, err = db.GetAccountCurrency(ctx, scope, request.AccountID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrAccountNotFound) {
+			return amount.Currency, nil
+		}
+		return "", err
+	}
+
+	return currency, nil
+}
+
+// sets the settlement amount of a new transaction converting it with the current FX rate, the rate and its timestamp are stored on the transaction so later callbacks never re-price it
+func ApplySettlement(ctx context.Context, transaction *models.Transaction, settlementCurrency string) error {
+	if settlementCurrency == transaction.Amount.Currency {
+		transaction.SettlementAmount = transaction.Amount
+		return nil
+	}
+
+	rate, err := findFXRate(ctx, transaction.Amount.Currency, settlementCurrency)
+	if err != nil {
+		return err
+	}
+
+	value, err := models.ParseRate(rate.Rate)
+	if err != nil {
+		return err
+	}
+
+	settlementAmount, err := transaction.Amount.Convert(value, settlementCurrency)
+	if err != nil {
+		return err
+	}
+
+	if settlementAmount.MinorUnits <= 0 {
+		return fmt.Errorf("%w in %s", ErrSettlementAmountTooSmall, settlementCurrency)
+	}
+
+	updatedAt := rate.UpdatedAt
+	transaction.SettlementAmount = settlementAmount
+	transaction.FXRate = value.FloatString(12)
+	transaction.FXRateAt = &updatedAt
+
+	return nil
+}
+
+// looks up the rate between two currencies using the inverse of the opposite pair when only that one is stored
+func findFXRate(ctx context.Context, baseCurrency string, quoteCurrency string) (models.FXRate, error) {
+	rate, err := getFXRate(ctx, baseCurrency, quoteCurrency)
+	if err == nil {
+		return rate, nil
+	}
+	if !errors.Is(err, db.ErrFXRateNotFound) {
+		return rate, err
+	}
+
+	inverse, err := getFXRate(ctx, quoteCurrency, baseCurrency)
+	if err != nil {
+		if errors.Is(err, db.ErrFXRateNotFound) {
+			return rate, fmt.Errorf("%w from %s to %s", ErrFXRateNotFound, baseCurrency, quoteCurrency)
+		}
+		return rate, err
+	}
+
+	value, err := models.ParseRate(inverse.Rate)
+	if err != nil {
+		return rate, err
+	}
+
+	return models.FXRate{
+		BaseCurrency:  baseCurrency,
+		QuoteCurrency: quoteCurrency,
+		Rate:          new(big.Rat).Inv(value).FloatString(12),
+		UpdatedAt:     inverse.UpdatedAt,
+	}, nil
+}
+
+// retrieves a stored rate inside the postgres bulkhead
+func getFXRate(ctx context.Context, baseCurrency string, quoteCurrency string) (rate models.FXRate, err error) {
+	err = withPostgres(ctx, "GetFXRate", func(ctx context.Context) error {
+		rate, err = db.GetFXRate(ctx, baseCurrency, quoteCurrency)
+		return err
+	})
+	return rate, err
+}
+
+// validates FX rates normalizing their currency codes in place
+func ValidateFXRates(rates []models.FXRate) error {
+	if len(rates) == 0 {
+		return fmt.Errorf("at least one rate is required")
+	}
+
+	for i, rate := range rates {
+		rate.BaseCurrency = strings.ToUpper(strings.TrimSpace(rate.BaseCurrency))
+		rate.QuoteCurrency = strings.ToUpper(strings.TrimSpace(rate.QuoteCurrency))
+		rate.Rate = strings.TrimSpace(rate.Rate)
+
+		if _, ok := models.CurrencyExponent(rate.BaseCurrency); !ok {
+			return fmt.Errorf("unsupported currency: %s", rate.BaseCurrency)
+		}
+
+		if _, ok := models.CurrencyExponent(rate.QuoteCurrency); !ok {
+			return fmt.Errorf("unsupported currency: %s", rate.QuoteCurrency)
+		}
+
+		if rate.BaseCurrency == rate.QuoteCurrency {
+			return fmt.Errorf("rate from %s to itself is not allowed", rate.BaseCurrency)
+		}
+
+		if _, err := models.ParseRate(rate.Rate); err != nil {
+			return fmt.Errorf("rate from %s to %s: %v", rate.BaseCurrency, rate.QuoteCurrency, err)
+		}
+
+		rates[i] = rate
+	}
+
+	return nil
+}
+
+// stores validated FX rates
+func SaveFXRates(ctx context.Context, rates []models.FXRate) error {
+	return withPostgres(ctx, "UpsertFXRates", func(ctx context.Context) error {
+		return db.UpsertFXRates(ctx, rates)
+	})
+}
+
+// retrieves all stored FX rates
+func ListFXRates(ctx context.Context) (rates []models.FXRate, err error) {
+	err = withPostgres(ctx, "ListFXRates", func(ctx context.Context) error {
+		rates, err = db.ListFXRates(ctx)
+		return err
+	})
+	return rates, err
+}
+
+// loads FX rates from a CSV file with base_currency,quote_currency,rate rows, a header row is skipped
+func LoadFXRatesFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	var rates []models.FXRate
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if line == 1 && strings.EqualFold(record[0], "base_currency") {
+			continue
+		}
+
+		rates = append(rates, models.FXRate{BaseCurrency: record[0], QuoteCurrency: record[1], Rate: record[2]})
+	}
+
+	if err := ValidateFXRates(rates); err != nil {
+		return err
+	}
+
+	if err := SaveFXRates(context.Background(), rates); err != nil {
+		return err
+	}
+
+	slog.Info("loaded fx rates", slog.Int("count", len(rates)), slog.String("path", path))
+	return nil
+}
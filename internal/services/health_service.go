@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"payment-gateway/db"
+	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/redis"
+	"payment-gateway/internal/resilience"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long each dependency may take to answer the readiness check before it counts as down
+const readinessCheckTimeout = 2 * time.Second
+
+// the dependencies checked for readiness, the service can't take payments without any of them
+var readinessChecks = map[string]func(context.Context) error{
+	"postgres": db.Ping,
+	"redis":    redis.Ping,
+	"kafka":    kafka.Ping,
+}
+
+// set once shutdown starts so readiness fails before the server stops accepting requests
+var draining atomic.Bool
+
+// makes readiness fail so the orchestrator stops sending traffic while in-flight requests finish
+func StartDraining() {
+	draining.Store(true)
+}
+
+// checks every dependency concurrently, the service is not ready when one is down or it is shutting down and degraded while the circuit breaker of a gateway is open
+func CheckReadiness(ctx context.Context) models.ReadinessReport {
+	// the dependencies are being closed during shutdown so they aren't checked anymore
+	if draining.Load() {
+		return models.ReadinessReport{Status: models.HealthNotReady, Dependencies: map[string]models.DependencyHealth{}, Draining: true}
+	}
+
+	report := models.ReadinessReport{
+		Status:       models.HealthReady,
+		Dependencies: make(map[string]models.DependencyHealth, len(readinessChecks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range readinessChecks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			health := checkDependency(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[name] = health
+		}(name, check)
+	}
+	wg.Wait()
+
+	// the breakers guard the Kafka publishes to each gateway, an open one means transactions of that gateway wait in the outbox
+	for _, breaker := range resilience.BreakerStatuses() {
+		if breaker.State == "open" {
+			report.OpenBreakers = append(report.OpenBreakers, breaker.Name)
+		}
+	}
+	sort.Strings(report.OpenBreakers)
+
+	if len(report.OpenBreakers) > 0 {
+		report.Status = models.HealthDegraded
+	}
+	for _, health := range report.Dependencies {
+		if health.Status != models.HealthOK {
+			report.Status = models.HealthNotReady
+		}
+	}
+
+	return report
+}
+
+// runs the check of one dependency with the readiness timeout
+func checkDependency(ctx context.Context, check func(context.Context) error) models.DependencyHealth {
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	health := models.DependencyHealth{Status: models.HealthOK, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		health.Status = models.HealthDown
+		health.Error = err.Error()
+	}
+	return health
+}
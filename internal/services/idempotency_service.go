@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/redis"
+	"time"
+)
+
+// longest Idempotency-Key accepted, matches the database column
+const maxIdempotencyKeyLength = 255
+
+// the message a new transaction is answered with
+const TransactionCreatedMessage = "Transaction processed successfully"
+
+// how long a reservation is held for its request, a request that crashed or failed to store its response is long gone by then
+var idempotencyReservationExpiry = 5 * time.Minute
+
+var (
+	// returned when a key is reused with a different request body
+	ErrIdempotencyKeyConflict = errors.New("idempotency key has already been used with a different request")
+
+	// returned when a retry arrives while the original request is still being processed
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still being processed")
+)
+
+// validates the Idempotency-Key header value
+func ValidateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("idempotency key must not be longer than %d characters", maxIdempotencyKeyLength)
+	}
+	return nil
+}
+
+// returns the key a merchant's Idempotency-Key is stored under so merchants choosing the same key never see each other's responses
+func MerchantIdempotencyKey(merchantID string, key string) string {
+	return merchantID + ":" + key
+}
+
+// hashes the decoded request so a reused key can be matched against the original request, a retry that only differs in whitespace, key order or format matches as well.
+// The transaction type is included so the same request on another route doesn't match
+func HashRequest(transactionType string, request models.TransactionRequest) string {
+	// amounts written differently like 100 and 100.00 are the same amount
+	if amount, err := models.ParseMoney(request.Amount, request.Currency); err == nil {
+		request.Amount = models.Decimal(amount.Decimal())
+	}
+
+	// the fields are encoded in struct order so the encoding doesn't depend on how the client sent them
+	data, _ := json.Marshal(request)
+
+	h := sha256.New()
+	h.Write([]byte(transactionType))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reserves the key for a new request creating the given transaction or returns the stored response when the same request was already processed
+func BeginIdempotentRequest(ctx context.Context, key string, requestHash string, transactionID string) (*models.APIResponse, error) {
+	// completed requests are cached in Redis so most retries never reach the database
+	var record models.IdempotencyRecord
+	err := withRedis(ctx, func() (err error) {
+		record, err = redis.GetIdempotencyRecord(ctx, key)
+		return err
+	})
+	if err == nil {
+		return replayIdempotencyRecord(record, requestHash)
+	}
+
+	var reserved bool
+	err = withPostgres(ctx, "ReserveIdempotencyKey", func(ctx context.Context) (err error) {
+		reserved, err = db.ReserveIdempotencyKey(ctx, key, requestHash, transactionID, idempotencyReservationExpiry)
+		if err != nil || reserved {
+			return err
+		}
+		record, err = db.GetIdempotencyRecord(ctx, key, idempotencyReservationExpiry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reserved {
+		return nil, nil
+	}
+
+	if record.StatusCode == 0 {
+		if record.RequestHash != requestHash {
+			return nil, ErrIdempotencyKeyConflict
+		}
+		if !record.Expired {
+			return nil, ErrIdempotencyKeyInProgress
+		}
+
+		// an expired reservation is only kept when its request created the transaction, the response it couldn't store is stored now
+		return completeExpiredIdempotentRequest(ctx, record)
+	}
+
+	withRedisWrite(ctx, "SetIdempotencyRecord", func() { redis.SetIdempotencyRecord(ctx, record) })
+	return replayIdempotencyRecord(record, requestHash)
+}
+
+// stores the response of a reserved request so later retries get the same answer
+func CompleteIdempotentRequest(ctx context.Context, key string, requestHash string, response models.APIResponse) error {
+	record := models.IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		StatusCode:  response.StatusCode,
+		Message:     response.Message,
+	}
+
+	if transaction, ok := response.Data.(models.Transaction); ok {
+		record.Transaction = &transaction
+	}
+
+	err := withPostgres(ctx, "CompleteIdempotencyKey", func(ctx context.Context) error {
+		return db.CompleteIdempotencyKey(ctx, record)
+	})
+	if err != nil {
+		return err
+	}
+
+	withRedisWrite(ctx, "SetIdempotencyRecord", func() { redis.SetIdempotencyRecord(ctx, record) })
+	return nil
+}
+
+// answers a retry of a request that created its transaction but never stored its response with the transaction as it is now
+func completeExpiredIdempotentRequest(ctx context.Context, record models.IdempotencyRecord) (*models.APIResponse, error) {
+	transaction, err := getTransactionFromDB(ctx, db.SystemScope, record.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    TransactionCreatedMessage,
+		Data:       transaction,
+	}
+	if err := CompleteIdempotentRequest(ctx, record.Key, record.RequestHash, response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// frees a reserved key when the request failed before creating anything so the client can retry with it
+func ReleaseIdempotentRequest(ctx context.Context, key string) error {
+	return withPostgres(ctx, "ReleaseIdempotencyKey", func(ctx context.Context) error {
+		return db.ReleaseIdempotencyKey(ctx, key)
+	})
+}
+
+// rebuilds the original API response from a stored record
+func replayIdempotencyRecord(record models.IdempotencyRecord, requestHash string) (*models.APIResponse, error) {
+	if record.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyConflict
+	}
+
+	response := &models.APIResponse{
+		StatusCode: record.StatusCode,
+		Message:    record.Message,
+	}
+
+	if record.Transaction != nil {
+		response.Data = *record.Transaction
+	}
+
+	return response, nil
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// lets reservations expire right away
+func expireReservations(t *testing.T) {
+	expiry := idempotencyReservationExpiry
+	idempotencyReservationExpiry = time.Millisecond
+	t.Cleanup(func() { idempotencyReservationExpiry = expiry })
+}
+
+func TestExpiredReservationWithoutTransactionIsReservedAgain(t *testing.T) {
+	key := MerchantIdempotencyKey(testMerchant.MerchantID, uuid.New().String())
+	requestHash := HashRequest("deposit", models.TransactionRequest{Amount: "100.00", Currency: "USD"})
+
+	if replay, err := BeginIdempotentRequest(context.Background(), key, requestHash, uuid.New().String()); replay != nil || err != nil {
+		t.Fatalf("Expected the key to be reserved, got %v (%v)", replay, err)
+	}
+	if _, err := BeginIdempotentRequest(context.Background(), key, requestHash, uuid.New().String()); !errors.Is(err, ErrIdempotencyKeyInProgress) {
+		t.Fatalf("Expected the key to be in progress, got %v", err)
+	}
+
+	// the request crashed before it created its transaction
+	expireReservations(t)
+	time.Sleep(10 * time.Millisecond)
+
+	if replay, err := BeginIdempotentRequest(context.Background(), key, requestHash, uuid.New().String()); replay != nil || err != nil {
+		t.Fatalf("Expected the expired key to be reserved again, got %v (%v)", replay, err)
+	}
+}
+
+func TestExpiredReservationAnswersWithItsTransaction(t *testing.T) {
+	key := MerchantIdempotencyKey(testMerchant.MerchantID, uuid.New().String())
+	requestHash := HashRequest("deposit", models.TransactionRequest{Amount: "10.00", Currency: "USD"})
+
+	transaction := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 1000, Currency: "USD"},
+		Type:          "deposit",
+		Status:        models.StatusPending,
+		DataFormat:    "application/json",
+		MerchantID:    testMerchant.MerchantID,
+		Gateway:       newFakeGateway(nil).ID(),
+	}
+
+	if replay, err := BeginIdempotentRequest(context.Background(), key, requestHash, transaction.TransactionID); replay != nil || err != nil {
+		t.Fatalf("Expected the key to be reserved, got %v (%v)", replay, err)
+	}
+
+	// the request created its transaction but failed to store its response
+	if err := SaveTransaction(context.Background(), transaction); err != nil {
+		t.Fatalf("Expected no error saving transaction, got %v", err)
+	}
+	expireReservations(t)
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		replay, err := BeginIdempotentRequest(context.Background(), key, requestHash, uuid.New().String())
+		if err != nil || replay == nil || replay.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the transaction to be replayed, got %v (%v)", replay, err)
+		}
+		if replayed, ok := replay.Data.(models.Transaction); !ok || replayed.TransactionID != transaction.TransactionID {
+			t.Fatalf("Expected the original transaction, got %v", replay.Data)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/security"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// returned when the grace period of a key rotation isn't a valid duration
+var ErrInvalidGracePeriod = errors.New("grace period must be a non-negative duration such as 24h")
+
+// the number of leading characters of a key stored in clear so merchants can tell their keys apart
+const apiKeyPrefixLength = 12
+
+// validates the merchant request (data fields)
+func ValidateMerchantRequest(request models.MerchantRequest) error {
+	if strings.TrimSpace(request.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	return nil
+}
+
+// creates a merchant with its first API key, the key is only part of the returned credentials and can't be retrieved later
+func CreateMerchant(ctx context.Context, request models.MerchantRequest) (models.MerchantCredentials, error) {
+	merchant := models.Merchant{
+		MerchantID: uuid.New().String(),
+		Name:       strings.TrimSpace(request.Name),
+	}
+
+	key, keyHash, err := newAPIKey(merchant.MerchantID)
+	if err != nil {
+		return models.MerchantCredentials{}, err
+	}
+
+	err = withPostgres(ctx, "CreateMerchant", func(ctx context.Context) (err error) {
+		merchant, key, err = db.CreateMerchant(ctx, merchant, key, keyHash)
+		return err
+	})
+	if err != nil {
+		return models.MerchantCredentials{}, err
+	}
+
+	return models.MerchantCredentials{Merchant: merchant, APIKey: key}, nil
+}
+
+// issues a new API key for a merchant, its previous keys keep working for the requested grace period
+func RotateAPIKey(ctx context.Context, merchantID string, request models.RotateAPIKeyRequest) (models.APIKey, error) {
+	var gracePeriod time.Duration
+	if request.GracePeriod != "" {
+		parsed, err := time.ParseDuration(request.GracePeriod)
+		if err != nil || parsed < 0 {
+			return models.APIKey{}, ErrInvalidGracePeriod
+		}
+		gracePeriod = parsed
+	}
+
+	key, keyHash, err := newAPIKey(merchantID)
+	if err != nil {
+		return key, err
+	}
+
+	err = withPostgres(ctx, "RotateAPIKey", func(ctx context.Context) (err error) {
+		key, err = db.RotateAPIKey(ctx, key, keyHash, gracePeriod)
+		return err
+	})
+	return key, err
+}
+
+// revokes an API key of a merchant right away
+func RevokeAPIKey(ctx context.Context, merchantID string, keyID string) (key models.APIKey, err error) {
+	err = withPostgres(ctx, "RevokeAPIKey", func(ctx context.Context) error {
+		key, err = db.RevokeAPIKey(ctx, merchantID, keyID)
+		return err
+	})
+	return key, err
+}
+
+// retrieves the API keys of a merchant without the keys themselves
+func ListAPIKeys(ctx context.Context, merchantID string) (keys []models.APIKey, err error) {
+	err = withPostgres(ctx, "ListAPIKeys", func(ctx context.Context) error {
+		keys, err = db.ListAPIKeys(ctx, merchantID)
+		return err
+	})
+	return keys, err
+}
+
+// resolves the merchant owning an API key, unknown, revoked and expired keys return db.ErrInvalidAPIKey
+func AuthenticateMerchant(ctx context.Context, key string) (merchant models.Merchant, err error) {
+	if key == "" {
+		return merchant, db.ErrInvalidAPIKey
+	}
+
+	err = withPostgres(ctx, "GetMerchantByAPIKey", func(ctx context.Context) error {
+		merchant, err = db.GetMerchantByAPIKey(ctx, security.HashAPIKey(key))
+		return err
+	})
+	return merchant, err
+}
+
+// generates an API key for a merchant and returns it with the hash to store
+func newAPIKey(merchantID string) (models.APIKey, string, error) {
+	secret, err := security.GenerateAPIKey()
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+
+	key := models.APIKey{
+		ID:         uuid.New().String(),
+		MerchantID: merchantID,
+		Prefix:     secret[:apiKeyPrefixLength],
+		Key:        secret,
+	}
+
+	return key, security.HashAPIKey(secret), nil
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"payment-gateway/db"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/resilience"
+	"payment-gateway/internal/security"
+	"payment-gateway/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// outbox relay settings, a message is retried with exponential backoff until it runs out of attempts and its transaction is marked failed.
+// The lease is renewed right before each message of a batch is published so it only has to cover one publish
+const (
+	outboxPollInterval   = 500 * time.Millisecond
+	outboxBatchSize      = 100
+	outboxLease          = 30 * time.Second
+	outboxMaxAttempts    = 10
+	outboxBaseBackoff    = time.Second
+	outboxMaxBackoff     = time.Minute
+	outboxPublishTimeout = 10 * time.Second
+)
+
+// builds the masked Kafka message asking the gateway to run the given operation on a transaction, the trace of ctx is stored with it so the relay continues it
+func NewOutboxMessage(ctx context.Context, transaction models.Transaction, messageType string) (models.OutboxMessage, error) {
+	transactionData, err := json.Marshal(models.GatewayMessage{MessageType: messageType, Transaction: transaction})
+	if err != nil {
+		return models.OutboxMessage{}, err
+	}
+
+	// Mask the transaction data before sending it to Kafka for better security
+	maskedData := security.MaskData(transactionData)
+
+	return models.OutboxMessage{
+		TransactionID: transaction.TransactionID,
+		DataFormat:    transaction.DataFormat,
+		Gateway:       transaction.Gateway,
+		Payload:       []byte(maskedData),
+		TraceContext:  tracing.Inject(ctx),
+		RequestID:     logging.RequestID(ctx),
+	}, nil
+}
+
+// polls the outbox and publishes pending messages to Kafka until the context is cancelled
+func StartOutboxRelay(ctx context.Context) {
+	slog.Info("starting outbox relay")
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("outbox relay stopped")
+			return
+		case <-ticker.C:
+			if err := RelayOutbox(ctx); err != nil {
+				slog.Error("outbox relay failed", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// publishes one batch of due outbox messages, the messages are published one at a time so the lease of each is renewed right before it is published
+func RelayOutbox(ctx context.Context) error {
+	var messages []models.OutboxMessage
+	err := withPostgres(ctx, "ClaimOutboxMessages", func(ctx context.Context) (err error) {
+		messages, err = db.ClaimOutboxMessages(ctx, outboxBatchSize, outboxLease)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if ctx.Err() != nil {
+			// the lease expires on its own so unsent messages are picked up again later
+			return ctx.Err()
+		}
+
+		// a message whose lease ran out while it waited in the batch may have been claimed by another relay, it is left to that relay so it isn't sent twice
+		var renewed bool
+		err := withPostgres(ctx, "RenewOutboxLease", func(ctx context.Context) (err error) {
+			renewed, err = db.RenewOutboxLease(ctx, message, outboxLease)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !renewed {
+			slog.WarnContext(ctx, "skipping outbox message claimed by another relay", slog.Int64("outbox_message_id", message.ID), slog.String("transaction_id", message.TransactionID))
+			continue
+		}
+
+		// a message already being published finishes on shutdown so it isn't sent again after the restart
+		relayOutboxMessage(context.WithoutCancel(ctx), message)
+	}
+
+	return nil
+}
+
+// publishes a single outbox message and records the outcome
+func relayOutboxMessage(ctx context.Context, message models.OutboxMessage) {
+	// the relay span joins the trace of the request that queued the message and its log lines carry the request's ID
+	ctx = tracing.Extract(ctx, propagation.MapCarrier(message.TraceContext))
+	ctx = logging.WithRequestID(ctx, message.RequestID)
+	ctx = logging.WithTransaction(ctx, message.TransactionID)
+	ctx = logging.WithGateway(ctx, message.Gateway)
+	ctx, span := tracing.Tracer().Start(ctx, "outbox relay")
+	span.SetAttributes(
+		attribute.Int64("outbox.message_id", message.ID),
+		attribute.Int("outbox.attempt", message.Attempts+1),
+		attribute.String("transaction.id", message.TransactionID),
+		attribute.String("gateway", message.Gateway),
+	)
+
+	err := publishOutboxMessage(ctx, message)
+	tracing.End(span, err)
+}
+
+// publishes a single outbox message inside the relay span, the publish error is returned for the span after the outcome is recorded
+func publishOutboxMessage(ctx context.Context, message models.OutboxMessage) error {
+	publishCtx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+	defer cancel()
+
+	err := PublishTransaction(publishCtx, message.Gateway, message.TransactionID, message.Payload)
+	if errors.Is(err, resilience.ErrBulkheadFull) {
+		// the gateway never saw the message so it doesn't count as an attempt, it is picked up again once its lease expires
+		slog.WarnContext(ctx, "deferred publishing transaction", slog.Any("error", err))
+		return err
+	}
+	recordGatewayAttempt(ctx, message, err)
+	if err == nil {
+		err := withPostgres(ctx, "MarkOutboxMessagePublished", func(ctx context.Context) error {
+			return db.MarkOutboxMessagePublished(ctx, message.ID)
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to mark outbox message as published", slog.Int64("outbox_message_id", message.ID), slog.Any("error", err))
+		}
+		return nil
+	}
+
+	slog.WarnContext(ctx, "failed to publish transaction", slog.Int("attempt", message.Attempts+1), slog.Any("error", err))
+
+	// Hand the transaction to the next eligible gateway before retrying the same one with backoff
+	if failoverOutboxMessage(ctx, message, err) {
+		return err
+	}
+
+	if message.Attempts+1 >= outboxMaxAttempts {
+		markErr := withPostgres(ctx, "MarkOutboxMessageFailed", func(ctx context.Context) error {
+			return db.MarkOutboxMessageFailed(ctx, message.ID, err.Error())
+		})
+		if markErr != nil {
+			slog.ErrorContext(ctx, "failed to mark outbox message as failed", slog.Int64("outbox_message_id", message.ID), slog.Any("error", markErr))
+			return markErr
+		}
+
+		// Mark the transaction as failed once it can't be published to prevent any duplicate processing
+		if err := UpdateTransactionStatus(ctx, message.TransactionID, models.StatusFailed); err != nil {
+			slog.ErrorContext(ctx, "failed to mark transaction as failed", slog.Any("error", err))
+		}
+		return err
+	}
+
+	rescheduleErr := withPostgres(ctx, "RescheduleOutboxMessage", func(ctx context.Context) error {
+		return db.RescheduleOutboxMessage(ctx, message.ID, outboxBackoff(message.Attempts), err.Error())
+	})
+	if rescheduleErr != nil {
+		slog.ErrorContext(ctx, "failed to reschedule outbox message", slog.Int64("outbox_message_id", message.ID), slog.Any("error", rescheduleErr))
+	}
+	return err
+}
+
+// returns the delay before the next publish attempt doubling with each failed attempt
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff << uint(attempts)
+	if backoff <= 0 || backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
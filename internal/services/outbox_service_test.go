@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"payment-gateway/db"
+	"payment-gateway/internal/gateways"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/redis"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// the merchant the transactions of the tests belong to
+var testMerchant models.Merchant
+
+func TestMain(m *testing.M) {
+	redis.InitRedis()
+
+	dbUser := os.Getenv("DB_USER")
+	dbPassword := os.Getenv("DB_PASSWORD")
+	dbName := os.Getenv("DB_NAME")
+	dbHost := os.Getenv("DB_HOST")
+	dbPort := os.Getenv("DB_PORT")
+
+	dbURL := "postgres://" + dbUser + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName + "?sslmode=disable"
+	db.InitializeDB(dbURL)
+
+	if err := gateways.Configure(gateways.DefaultConfig); err != nil {
+		log.Fatalf("Could not configure gateways: %v", err)
+	}
+
+	credentials, err := CreateMerchant(context.Background(), models.MerchantRequest{Name: "Outbox Test Merchant"})
+	if err != nil {
+		log.Fatalf("Could not create test merchant: %v", err)
+	}
+	testMerchant = credentials.Merchant
+
+	code := m.Run()
+	os.Exit(code)
+}
+
+// a gateway recording the transactions published to it, publishes fail with err when it is set
+type fakeGateway struct {
+	id string
+	mu sync.Mutex
+
+	err       error
+	published []string
+}
+
+// registers a fake gateway of its own for the test so its circuit breaker starts closed
+func newFakeGateway(err error) *fakeGateway {
+	gateway := &fakeGateway{id: "outbox_test_" + uuid.New().String(), err: err}
+	gateways.Register(gateway)
+	return gateway
+}
+
+// returns the gateway ID
+func (g *fakeGateway) ID() string {
+	return g.id
+}
+
+// records the publish
+func (g *fakeGateway) Publish(ctx context.Context, transactionID string, message []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.published = append(g.published, transactionID)
+	return g.err
+}
+
+// counts the publishes of a transaction
+func (g *fakeGateway) publishes(transactionID string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	count := 0
+	for _, published := range g.published {
+		if published == transactionID {
+			count++
+		}
+	}
+	return count
+}
+
+// saves a pending deposit routed to the gateway together with its outbox message
+func createOutboxTransaction(t *testing.T, gateway *fakeGateway) string {
+	transaction := models.Transaction{
+		TransactionID: uuid.New().String(),
+		Amount:        models.Money{MinorUnits: 1000, Currency: "USD"},
+		Type:          "deposit",
+		Status:        models.StatusPending,
+		DataFormat:    "application/json",
+		MerchantID:    testMerchant.MerchantID,
+		Gateway:       gateway.ID(),
+	}
+	if err := SaveTransaction(context.Background(), transaction); err != nil {
+		t.Fatalf("Expected no error saving transaction, got %v", err)
+	}
+	return transaction.TransactionID
+}
+
+// relays batches until the transaction was published, messages queued before it by other tests come first
+func relayUntilPublished(t *testing.T, gateway *fakeGateway, transactionID string) {
+	for i := 0; i < 50; i++ {
+		if err := RelayOutbox(context.Background()); err != nil {
+			t.Fatalf("Expected no error relaying the outbox, got %v", err)
+		}
+		if gateway.publishes(transactionID) > 0 {
+			return
+		}
+	}
+	t.Fatalf("Expected the transaction to be published")
+}
+
+// claims the due outbox messages without a lease and returns the one of the transaction
+func claimOutboxMessage(t *testing.T, transactionID string) models.OutboxMessage {
+	messages, err := db.ClaimOutboxMessages(context.Background(), 100000, 0)
+	if err != nil {
+		t.Fatalf("Expected no error claiming outbox messages, got %v", err)
+	}
+	for _, message := range messages {
+		if message.TransactionID == transactionID {
+			return message
+		}
+	}
+	t.Fatalf("Expected the outbox message of the transaction to be due")
+	return models.OutboxMessage{}
+}
+
+// returns the gateway attempts recorded on a transaction
+func gatewayAttempts(t *testing.T, transactionID string) []models.GatewayAttempt {
+	attempts, err := db.GetGatewayAttempts(context.Background(), db.SystemScope, transactionID)
+	if err != nil {
+		t.Fatalf("Expected no error retrieving gateway attempts, got %v", err)
+	}
+	return attempts
+}
+
+func TestRelayOutboxPublishes(t *testing.T) {
+	gateway := newFakeGateway(nil)
+	transactionID := createOutboxTransaction(t, gateway)
+
+	relayUntilPublished(t, gateway, transactionID)
+
+	attempts := gatewayAttempts(t, transactionID)
+	if len(attempts) != 1 || attempts[0].Status != "published" {
+		t.Fatalf("Expected one published attempt, got %+v", attempts)
+	}
+
+	// a published message is never sent again
+	if err := RelayOutbox(context.Background()); err != nil {
+		t.Fatalf("Expected no error relaying the outbox, got %v", err)
+	}
+	if gateway.publishes(transactionID) != 1 {
+		t.Fatalf("Expected the transaction to be published once, got %d", gateway.publishes(transactionID))
+	}
+}
+
+func TestRelayOutboxReschedulesFailedPublish(t *testing.T) {
+	gateway := newFakeGateway(errors.New("broker unavailable"))
+	transactionID := createOutboxTransaction(t, gateway)
+
+	relayUntilPublished(t, gateway, transactionID)
+
+	attempts := gatewayAttempts(t, transactionID)
+	if len(attempts) != 1 || attempts[0].Status != "failed" {
+		t.Fatalf("Expected one failed attempt, got %+v", attempts)
+	}
+
+	status, err := GetTransactionStatus(context.Background(), transactionID)
+	if err != nil || status != models.StatusPending {
+		t.Fatalf("Expected the transaction to stay pending, got %s (%v)", status, err)
+	}
+
+	// the retry waits for the backoff
+	if err := RelayOutbox(context.Background()); err != nil {
+		t.Fatalf("Expected no error relaying the outbox, got %v", err)
+	}
+	if gateway.publishes(transactionID) != 1 {
+		t.Fatalf("Expected no retry before the backoff, got %d publishes", gateway.publishes(transactionID))
+	}
+}
+
+func TestRelayOutboxFailsTransactionAfterMaxAttempts(t *testing.T) {
+	gateway := newFakeGateway(errors.New("broker unavailable"))
+	transactionID := createOutboxTransaction(t, gateway)
+
+	// every attempt but the last one already failed
+	message := claimOutboxMessage(t, transactionID)
+	for i := 0; i < outboxMaxAttempts-1; i++ {
+		if err := db.RescheduleOutboxMessage(context.Background(), message.ID, 0, "broker unavailable"); err != nil {
+			t.Fatalf("Expected no error rescheduling the message, got %v", err)
+		}
+	}
+
+	relayUntilPublished(t, gateway, transactionID)
+
+	status, err := GetTransactionStatus(context.Background(), transactionID)
+	if err != nil || status != models.StatusFailed {
+		t.Fatalf("Expected the transaction to be failed, got %s (%v)", status, err)
+	}
+
+	if err := RelayOutbox(context.Background()); err != nil {
+		t.Fatalf("Expected no error relaying the outbox, got %v", err)
+	}
+	if gateway.publishes(transactionID) != 1 {
+		t.Fatalf("Expected the failed message not to be sent again, got %d publishes", gateway.publishes(transactionID))
+	}
+}
+
+func TestOutboxLeaseIsKeptByTheLatestClaim(t *testing.T) {
+	gateway := newFakeGateway(nil)
+	transactionID := createOutboxTransaction(t, gateway)
+
+	// the first relay's lease ran out and another relay claimed the message
+	first := claimOutboxMessage(t, transactionID)
+	second := claimOutboxMessage(t, transactionID)
+
+	renewed, err := db.RenewOutboxLease(context.Background(), first, outboxLease)
+	if err != nil || renewed {
+		t.Fatalf("Expected the first relay to lose the message, got %v (%v)", renewed, err)
+	}
+
+	renewed, err = db.RenewOutboxLease(context.Background(), second, outboxLease)
+	if err != nil || !renewed {
+		t.Fatalf("Expected the second relay to keep the message, got %v (%v)", renewed, err)
+	}
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/redis"
+	"sync"
+	"time"
+)
+
+// a limit of requests per window, bursts up to the whole limit are allowed once the caller was idle for a window
+type RateLimit struct {
+	Requests int    `json:"requests"`
+	Window   string `json:"window"` // a Go duration such as 1m
+
+	window time.Duration
+}
+
+// the rate limits per route, merchants with their own limits override the route limits for the routes they list
+type RateLimitConfig struct {
+	Routes    map[string]RateLimit            `json:"routes"`
+	Merchants map[string]map[string]RateLimit `json:"merchants,omitempty"`
+}
+
+// used when no configuration file is set
+var DefaultRateLimitConfig = RateLimitConfig{
+	Routes: map[string]RateLimit{
+		"/deposit":    {Requests: 600, Window: "1m"},
+		"/withdrawal": {Requests: 600, Window: "1m"},
+		"/authorize":  {Requests: 600, Window: "1m"},
+		"/callback":   {Requests: 3000, Window: "1m"},
+	},
+}
+
+var (
+	rateLimitsMu sync.RWMutex
+	rateLimits   RateLimitConfig
+)
+
+// reads the rate limit configuration from a JSON file
+func LoadRateLimitConfig(path string) (RateLimitConfig, error) {
+	var config RateLimitConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid rate limit configuration: %v", err)
+	}
+
+	return config, nil
+}
+
+// validates the rate limits and replaces the current ones
+func ConfigureRateLimits(config RateLimitConfig) error {
+	routes, err := parseRateLimits(config.Routes)
+	if err != nil {
+		return err
+	}
+
+	merchants := make(map[string]map[string]RateLimit, len(config.Merchants))
+	for merchantID, limits := range config.Merchants {
+		parsed, err := parseRateLimits(limits)
+		if err != nil {
+			return fmt.Errorf("merchant %s: %v", merchantID, err)
+		}
+		merchants[merchantID] = parsed
+	}
+
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+
+	rateLimits = RateLimitConfig{Routes: routes, Merchants: merchants}
+	return nil
+}
+
+// parses the windows of the limits of each route
+func parseRateLimits(limits map[string]RateLimit) (map[string]RateLimit, error) {
+	parsed := make(map[string]RateLimit, len(limits))
+
+	for route, limit := range limits {
+		if limit.Requests <= 0 {
+			return nil, fmt.Errorf("route %s: requests must be greater than zero", route)
+		}
+
+		window, err := time.ParseDuration(limit.Window)
+		if err != nil || window < time.Millisecond {
+			return nil, fmt.Errorf("route %s: invalid window %q", route, limit.Window)
+		}
+
+		limit.window = window
+		parsed[route] = limit
+	}
+
+	return parsed, nil
+}
+
+// returns the limit of a merchant on a route, false when the route isn't limited
+func findRateLimit(merchantID string, route string) (RateLimit, bool) {
+	rateLimitsMu.RLock()
+	defer rateLimitsMu.RUnlock()
+
+	if limit, ok := rateLimits.Merchants[merchantID][route]; ok {
+		return limit, true
+	}
+
+	limit, ok := rateLimits.Routes[route]
+	return limit, ok
+}
+
+// counts a request of a merchant, or of a gateway or client address without one, against its limit on the route, false when the route isn't limited
+func CheckRateLimit(ctx context.Context, merchantID string, route string) (models.RateLimitStatus, bool, error) {
+	limit, ok := findRateLimit(merchantID, route)
+	if !ok {
+		return models.RateLimitStatus{}, false, nil
+	}
+
+	var status models.RateLimitStatus
+	err := withRedis(ctx, func() (err error) {
+		status, err = redis.TakeRateLimitToken(ctx, merchantID, route, limit.Requests, limit.window)
+		return err
+	})
+	return status, true, err
+}
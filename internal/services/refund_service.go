@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// retrieves the deposit a refund is requested for from the database as its current status decides whether it can be refunded
+func GetRefundableTransaction(ctx context.Context, scope db.Scope, transactionID string) (models.Transaction, error) {
+	transaction, err := getTransactionFromDB(ctx, scope, transactionID)
+	if err != nil {
+		return transaction, err
+	}
+
+	if transaction.Type != "deposit" || transaction.Status != models.StatusCompleted {
+		return transaction, db.ErrNotRefundable
+	}
+
+	return transaction, nil
+}
+
+// validates the refund request (data fields) and returns its amount in the currency of the deposit, a zero amount refunds whatever is left
+func ValidateRefundRequest(request models.TransactionRequest, parent models.Transaction) (models.Money, error) {
+	if request.Currency != "" && request.Currency != parent.Amount.Currency {
+		return models.Money{}, fmt.Errorf("refund currency must be %s", parent.Amount.Currency)
+	}
+
+	if request.Amount == "" {
+		return models.Money{Currency: parent.Amount.Currency}, nil
+	}
+
+	amount, err := models.ParseMoney(request.Amount, parent.Amount.Currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+
+	if amount.MinorUnits <= 0 {
+		return models.Money{}, fmt.Errorf("amount must be greater than zero")
+	}
+
+	return amount, nil
+}
+
+// creates a refund of the deposit as a child transaction sent to the gateway of the deposit, the amount is converted back at the rate locked on the deposit
+func CreateRefund(ctx context.Context, parent models.Transaction, amount models.Money) (models.Transaction, error) {
+	var refundedAmount, refundedSettlementAmount int64
+	err := withPostgres(ctx, "GetRefundedAmounts", func(ctx context.Context) (err error) {
+		refundedAmount, refundedSettlementAmount, err = db.GetRefundedAmounts(ctx, transactionScope(parent), parent.TransactionID)
+		return err
+	})
+	if err != nil {
+		return models.Transaction{}, err
+	}
+
+	remaining := parent.Amount.MinorUnits - refundedAmount
+	remainingSettlement := parent.SettlementAmount.MinorUnits - refundedSettlementAmount
+
+	if amount.MinorUnits == 0 {
+		amount.MinorUnits = remaining
+	}
+
+	if remaining <= 0 || amount.MinorUnits > remaining {
+		return models.Transaction{}, db.ErrRefundExceedsRemaining
+	}
+
+	// the last refund takes whatever is left of the settlement amount so rounding never leaves money behind
+	settlementAmount := models.Money{MinorUnits: remainingSettlement, Currency: parent.SettlementAmount.Currency}
+	if amount.MinorUnits < remaining {
+		share := parent.SettlementAmount.Proportion(amount.MinorUnits, parent.Amount.MinorUnits)
+		if share.MinorUnits < settlementAmount.MinorUnits {
+			settlementAmount = share
+		}
+	}
+
+	refund := models.Transaction{
+		TransactionID:       uuid.New().String(),
+		Amount:              amount,
+		SettlementAmount:    settlementAmount,
+		FXRate:              parent.FXRate,
+		FXRateAt:            parent.FXRateAt,
+		Type:                "refund",
+		Status:              models.StatusPending,
+		DataFormat:          parent.DataFormat,
+		Gateway:             parent.Gateway,
+		AccountID:           parent.AccountID,
+		MerchantID:          parent.MerchantID,
+		ParentTransactionID: parent.TransactionID,
+	}
+
+	if err := SaveTransaction(ctx, refund); err != nil {
+		return models.Transaction{}, err
+	}
+
+	return refund, nil
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"payment-gateway/db"
+	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/models"
+)
+
+// handles a gateway result consumed from Kafka and signed by gatewayID, invalid results are returned as permanent errors so the consumer drops them
+// while failures of the stores are returned as they are so the consumer retries them
+func HandleGatewayResultMessage(ctx context.Context, gatewayID string, payload []byte, contentType string) error {
+	var request models.TransactionRequest
+
+	if err := DecodePayload(bytes.NewReader(payload), contentType, &request); err != nil {
+		return kafka.Permanent(err)
+	}
+
+	ctx = logging.WithTransaction(ctx, request.TransactionID)
+	if err := ValidateCallbackRequest(ctx, gatewayID, request); err != nil {
+		return resultError(err)
+	}
+
+	if err := UpdateTransactionStatus(ctx, request.TransactionID, request.Status); err != nil {
+		return resultError(err)
+	}
+
+	slog.InfoContext(ctx, "gateway result applied", slog.String("status", request.Status))
+	return nil
+}
+
+// marks the errors of results that fail the same way on every retry as permanent
+func resultError(err error) error {
+	if permanentResultError(err) {
+		return kafka.Permanent(err)
+	}
+	return err
+}
+
+// reports whether a result is invalid or not allowed by the state machine, any other error comes from a store being down or busy and passes
+func permanentResultError(err error) bool {
+	for _, permanent := range []error{ErrMissingTransactionID, ErrMissingStatus, ErrInvalidStatus, ErrInvalidTransition, ErrWrongGateway, db.ErrTransactionNotFound} {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"payment-gateway/db"
+	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/resilience"
+	"testing"
+)
+
+func TestResultErrors(t *testing.T) {
+	permanent := []error{
+		ErrMissingTransactionID,
+		ErrMissingStatus,
+		fmt.Errorf("%w: settled", ErrInvalidStatus),
+		fmt.Errorf("%w from completed to failed", ErrInvalidTransition),
+		ErrWrongGateway,
+		fmt.Errorf("error retrieving transaction: %w", db.ErrTransactionNotFound),
+	}
+	for _, err := range permanent {
+		if !kafka.IsPermanent(resultError(err)) {
+			t.Fatalf("Expected %v to be permanent", err)
+		}
+	}
+
+	temporary := []error{
+		errors.New("dial tcp postgres:5432: connection refused"),
+		fmt.Errorf("error retrieving transaction: %w", errors.New("redis: connection pool timeout")),
+		&resilience.BulkheadFullError{Name: "postgres"},
+	}
+	for _, err := range temporary {
+		if kafka.IsPermanent(resultError(err)) {
+			t.Fatalf("Expected %v to be temporary", err)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"payment-gateway/db"
-	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/gateways"
+	"payment-gateway/internal/metrics"
 	"payment-gateway/internal/models"
 	"payment-gateway/internal/redis"
 	"payment-gateway/internal/resilience"
@@ -12,17 +14,39 @@ import (
 	"sync"
 )
 
-// saves the transaction in the database and Redis concurrently for better performance
-func SaveTransaction(transaction models.Transaction) error {
+// saves the transaction in the database and Redis concurrently for better performance, the Kafka message is queued in the outbox with the database row and published later by the relay
+func SaveTransaction(ctx context.Context, transaction models.Transaction) error {
+	// transactions without a conversion settle in their own currency
+	if transaction.SettlementAmount.Currency == "" {
+		transaction.SettlementAmount = transaction.Amount
+	}
+
+	// new transactions go to the gateway picked by the routing rules, follow-up transactions such as refunds already carry theirs
+	if transaction.Gateway == "" {
+		gateway, err := RouteTransaction(transaction)
+		if err != nil {
+			return err
+		}
+		transaction.Gateway = gateway
+	}
+
+	message, err := NewOutboxMessage(ctx, transaction, newTransactionMessageType(transaction))
+	if err != nil {
+		return err
+	}
+
 	var wg sync.WaitGroup
 	errChan := make(chan error, 2)
 
 	wg.Add(2)
 
-	// Save transaction in the database
+	// Save transaction and its outbox message in the database
 	go func() {
 		defer wg.Done()
-		if err := db.SaveTransaction(transaction); err != nil {
+		err := withPostgres(ctx, "SaveTransaction", func(ctx context.Context) error {
+			return db.SaveTransaction(ctx, transactionScope(transaction), transaction, message)
+		})
+		if err != nil {
 			errChan <- err
 		}
 	}()
@@ -30,7 +54,7 @@ func SaveTransaction(transaction models.Transaction) error {
 	// Save the transaction status in Redis
 	go func() {
 		defer wg.Done()
-		redis.SetTransactionStatus(transaction.TransactionID, transaction.Status) // Assuming Redis set always succeeds
+		withRedisWrite(ctx, "SetTransactionStatus", func() { redis.SetTransactionStatus(ctx, transaction.TransactionID, transaction.Status) })
 	}()
 
 	wg.Wait()
@@ -38,65 +62,195 @@ func SaveTransaction(transaction models.Transaction) error {
 
 	for err := range errChan {
 		if err != nil {
+			// drop the cached status of a transaction the database rejected so callbacks can't find it
+			withRedisWrite(ctx, "DeleteTransactionStatus", func() { redis.DeleteTransactionStatus(ctx, transaction.TransactionID) })
 			return err
 		}
 	}
 
+	metrics.CountTransaction(transaction.Type, transaction.Status)
 	return nil
 }
 
-// retrieves a transaction by its ID from the database
-func GetTransactionByID(transactionID string) (models.Transaction, error) {
-	return db.GetTransactionByID(transactionID) // Call the function in db package
+// returns the database scope a transaction is written in, the scope of its merchant or the system scope for transactions without one
+func transactionScope(transaction models.Transaction) db.Scope {
+	if transaction.MerchantID == "" {
+		return db.SystemScope
+	}
+	return db.MerchantScope(transaction.MerchantID)
+}
+
+// picks the gateway a new transaction is sent to
+func RouteTransaction(transaction models.Transaction) (string, error) {
+	gateway, err := gateways.Route(gateways.RouteRequest{
+		TransactionType: transaction.Type,
+		Amount:          transaction.Amount,
+		MerchantID:      transaction.MerchantID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return gateway.ID(), nil
+}
+
+// returns the gateway operation a new transaction starts with
+func newTransactionMessageType(transaction models.Transaction) string {
+	switch {
+	case transaction.Type == "refund":
+		return models.MessageTypeRefund
+	case transaction.AuthorizedAmount != nil:
+		return models.MessageTypeAuthorize
+	default:
+		return models.MessageTypePayment
+	}
+}
+
+// retrieves the balance of an account from the database as balances must never be served stale
+func GetAccountBalance(ctx context.Context, scope db.Scope, accountID string) (balance models.AccountBalance, err error) {
+	err = withPostgres(ctx, "GetAccountBalance", func(ctx context.Context) error {
+		balance, err = db.GetAccountBalance(ctx, scope, accountID)
+		return err
+	})
+	return balance, err
 }
 
-// validates the transaction request (data fields)
-func ValidateTransactionRequest(request models.TransactionRequest) error {
+// retrieves a transaction by its ID from Redis first if not cached then from the database and caches it for the next reads, transactions outside the scope are reported as not found
+func GetTransactionByID(ctx context.Context, scope db.Scope, transactionID string) (models.Transaction, error) {
+	var transaction models.Transaction
 
-	if request.Amount == 0 {
-		return fmt.Errorf("amount is required")
+	// a busy cache is skipped rather than waited for, the cache is shared by all merchants so its records are checked against the scope
+	err := withRedis(ctx, func() (err error) {
+		transaction, err = redis.GetTransaction(ctx, transactionID)
+		return err
+	})
+	if err == nil && scope.Includes(transaction.MerchantID) {
+		return transaction, nil
 	}
 
-	if request.Amount <= 0 {
-		return fmt.Errorf("amount must be greater than zero")
+	transaction, err = getTransactionFromDB(ctx, scope, transactionID)
+	if err != nil {
+		return transaction, err
 	}
 
-	return nil
+	withRedisWrite(ctx, "SetTransaction", func() { redis.SetTransaction(ctx, transaction) })
+	return transaction, nil
+}
+
+// retrieves a transaction from the database inside the postgres bulkhead
+func getTransactionFromDB(ctx context.Context, scope db.Scope, transactionID string) (transaction models.Transaction, err error) {
+	err = withPostgres(ctx, "GetTransactionByID", func(ctx context.Context) error {
+		transaction, err = db.GetTransactionByID(ctx, scope, transactionID)
+		return err
+	})
+	return transaction, err
+}
+
+// retrieves a transaction together with its gateway attempts, the attempts are always read from the database as the relay adds them without touching the cache
+func GetTransactionWithAttempts(ctx context.Context, scope db.Scope, transactionID string) (models.Transaction, error) {
+	transaction, err := GetTransactionByID(ctx, scope, transactionID)
+	if err != nil {
+		return transaction, err
+	}
+
+	err = withPostgres(ctx, "GetGatewayAttempts", func(ctx context.Context) (err error) {
+		transaction.GatewayAttempts, err = db.GetGatewayAttempts(ctx, scope, transactionID)
+		return err
+	})
+	return transaction, err
+}
+
+// validates the transaction request (data fields) and returns its amount in minor units of the currency
+func ValidateTransactionRequest(request models.TransactionRequest) (models.Money, error) {
+
+	if request.Amount == "" {
+		return models.Money{}, fmt.Errorf("amount is required")
+	}
+
+	if request.Currency == "" {
+		return models.Money{}, fmt.Errorf("currency is required")
+	}
+
+	amount, err := models.ParseMoney(request.Amount, request.Currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+
+	if amount.MinorUnits == 0 {
+		return models.Money{}, fmt.Errorf("amount is required")
+	}
+
+	if amount.MinorUnits < 0 {
+		return models.Money{}, fmt.Errorf("amount must be greater than zero")
+	}
+
+	if request.AccountID == "" {
+		return models.Money{}, fmt.Errorf("account ID is required")
+	}
+
+	if request.SettlementCurrency != "" {
+		if _, ok := models.CurrencyExponent(request.SettlementCurrency); !ok {
+			return models.Money{}, fmt.Errorf("unsupported settlement currency: %s", request.SettlementCurrency)
+		}
+	}
+
+	return amount, nil
 }
 
-// validates the callback request (data fields)
-func ValidateCallbackRequest(request models.TransactionRequest) error {
+var (
+	// returned when a gateway reports on a transaction routed to another gateway
+	ErrWrongGateway = errors.New("transaction is routed to another gateway")
+
+	// returned when a callback or result misses one of its fields
+	ErrMissingTransactionID = errors.New("transaction ID is required")
+	ErrMissingStatus        = errors.New("status is required")
+)
+
+// validates the callback request (data fields), that the gateway which signed it is the one the transaction is routed to and that the transaction can move to the reported status
+func ValidateCallbackRequest(ctx context.Context, gatewayID string, request models.TransactionRequest) error {
 
 	if request.TransactionID == "" {
-		return fmt.Errorf("transaction ID is required")
+		return ErrMissingTransactionID
 	}
 
 	if request.Status == "" {
-		return fmt.Errorf("status is required")
+		return ErrMissingStatus
+	}
+
+	if err := validateReportedStatus(request.Status); err != nil {
+		return err
 	}
 
-	// try to validate the transaction existence first from redis then from the database
-	status, err := GetTransactionStatus(request.TransactionID)
+	// a gateway may only settle its own transactions, gateways report on transactions of every merchant so the lookup isn't scoped
+	transaction, err := GetTransactionByID(ctx, db.SystemScope, request.TransactionID)
 	if err != nil {
-		return fmt.Errorf("error retrieving transaction status: %v", err)
+		return fmt.Errorf("error retrieving transaction: %w", err)
+	}
+	if gatewayID == "" || transaction.Gateway != gatewayID {
+		return ErrWrongGateway
 	}
 
-	if status == "completed" {
-		return fmt.Errorf("transaction has already been completed")
+	// the cached record may be behind, the status is read from redis first then from the database
+	transaction.Status, err = GetTransactionStatus(ctx, request.TransactionID)
+	if err != nil {
+		return fmt.Errorf("error retrieving transaction status: %w", err)
 	}
 
-	return nil
+	return ValidateTransition(transaction, request.Status)
 }
 
-// retrieves the transaction status from Redis first if not found then will get from the database
-func GetTransactionStatus(transactionID string) (string, error) {
+// retrieves the transaction status from Redis first if not found then will get from the database, gateways report on transactions of every merchant so the lookup isn't scoped
+func GetTransactionStatus(ctx context.Context, transactionID string) (string, error) {
 
-	status, err := redis.GetTransactionStatus(transactionID)
+	var status string
+	err := withRedis(ctx, func() (err error) {
+		status, err = redis.GetTransactionStatus(ctx, transactionID)
+		return err
+	})
 	if err == nil {
 		return status, nil
 	}
 
-	transaction, dbErr := db.GetTransactionByID(transactionID)
+	transaction, dbErr := getTransactionFromDB(ctx, db.SystemScope, transactionID)
 	if dbErr != nil {
 		return "", dbErr
 	}
@@ -104,41 +258,60 @@ func GetTransactionStatus(transactionID string) (string, error) {
 	return transaction.Status, nil
 }
 
-// updates the transaction status in the database and Redis concurrently
-func UpdateTransactionStatus(transactionID, status string) error {
-	var wg sync.WaitGroup
-	errChan := make(chan error, 2)
-
-	wg.Add(2)
+// updates the transaction status in the database and then Redis, the database update is conditional on the state machine so Redis is only written once the transition was accepted.
+// Statuses are reported by the gateways for transactions of every merchant so the update runs in the system scope, refunded can't be reported as only completed refunds set it
+func UpdateTransactionStatus(ctx context.Context, transactionID, status string) error {
+	if err := validateReportedStatus(status); err != nil {
+		return err
+	}
 
-	go func() {
-		defer wg.Done()
-		if err := db.UpdateTransactionStatus(transactionID, status); err != nil {
-			errChan <- err
-			return
+	var transaction models.Transaction
+	err := withPostgres(ctx, "UpdateTransactionStatus", func(ctx context.Context) (err error) {
+		transaction, err = db.UpdateTransactionStatus(ctx, db.SystemScope, transactionID, status, previousStatuses(paymentTransitions, status), previousStatuses(authorizationTransitions, status))
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrStatusConflict) {
+			// the transaction moved on since it was validated so report the transition from its actual status
+			if transaction, dbErr := getTransactionFromDB(ctx, db.SystemScope, transactionID); dbErr == nil {
+				withRedisWrite(ctx, "SetTransactionStatus", func() { redis.SetTransactionStatus(ctx, transactionID, transaction.Status) })
+				if err := ValidateTransition(transaction, status); err != nil {
+					return err
+				}
+			}
+			return fmt.Errorf("%w to %s", ErrInvalidTransition, status)
 		}
-	}()
+		return err
+	}
 
-	go func() {
-		defer wg.Done()
-		redis.SetTransactionStatus(transactionID, status) // Assuming Redis set always succeeds
-	}()
+	// the update is committed so the cache is brought up to date even when the caller gave up meanwhile
+	ctx = context.WithoutCancel(ctx)
 
-	wg.Wait()
-	close(errChan)
+	metrics.CountTransaction(transaction.Type, status)
+	withRedisWrite(ctx, "SetTransactionStatus", func() { redis.SetTransactionStatus(ctx, transactionID, status) })
 
-	for err := range errChan {
-		if err != nil {
-			return err
-		}
+	// invalidate the cached record only after the database write so a concurrent read can't cache the old status
+	withRedisWrite(ctx, "DeleteTransaction", func() { redis.DeleteTransaction(ctx, transactionID) })
+
+	// a completed refund may have moved its deposit to refunded as well
+	if transaction.ParentTransactionID != "" {
+		withRedisWrite(ctx, "DeleteTransactionStatus", func() { redis.DeleteTransactionStatus(ctx, transaction.ParentTransactionID) })
+		withRedisWrite(ctx, "DeleteTransaction", func() { redis.DeleteTransaction(ctx, transaction.ParentTransactionID) })
 	}
 
 	return nil
 }
 
-// publishes a transaction to Kafka with retries and circuit breaker
-func PublishTransaction(ctx context.Context, transactionID string, transactionData []byte, dataFormat string) error {
-	return resilience.PublishWithCircuitBreaker(func() error {
-		return kafka.PublishTransaction(ctx, transactionID, transactionData, dataFormat)
+// publishes a transaction message to its gateway with circuit breaker, calls beyond the bulkheads of the gateway and of Kafka are rejected before reaching the breaker
+func PublishTransaction(ctx context.Context, gatewayID string, transactionID string, transactionData []byte) error {
+	gateway, err := gateways.Get(gatewayID)
+	if err != nil {
+		return err
+	}
+
+	return withKafka(ctx, gatewayID, func() error {
+		return resilience.PublishWithCircuitBreaker(gatewayID, func() error {
+			return gateway.Publish(ctx, transactionID, transactionData)
+		})
 	})
 }
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"payment-gateway/internal/models"
+)
+
+var (
+	// returned when a status is not one of the known transaction statuses
+	ErrInvalidStatus = errors.New("invalid transaction status")
+
+	// returned when a transaction can't move from its current status to the requested one
+	ErrInvalidTransition = errors.New("invalid transaction status transition")
+)
+
+// the allowed status transitions of deposits, withdrawals and refunds, they can never be authorized. Final statuses have no outgoing transitions, db/init.sql enforces the same tables
+var paymentTransitions = map[string][]string{
+	models.StatusPending:    {models.StatusProcessing, models.StatusCompleted, models.StatusFailed, models.StatusCancelled},
+	models.StatusProcessing: {models.StatusCompleted, models.StatusFailed, models.StatusCancelled},
+	models.StatusCompleted:  {models.StatusRefunded},
+	models.StatusFailed:     {},
+	models.StatusCancelled:  {},
+	models.StatusRefunded:   {},
+}
+
+// the allowed status transitions of authorizations, deposits holding the authorized amount which only complete through a capture. It lists every known status
+var authorizationTransitions = map[string][]string{
+	models.StatusPending:        {models.StatusProcessing, models.StatusAuthorized, models.StatusFailed, models.StatusCancelled},
+	models.StatusProcessing:     {models.StatusAuthorized, models.StatusFailed, models.StatusCancelled},
+	models.StatusAuthorized:     {models.StatusCapturePending, models.StatusVoidPending, models.StatusVoided, models.StatusFailed},
+	models.StatusCapturePending: {models.StatusCompleted, models.StatusFailed},
+	models.StatusVoidPending:    {models.StatusVoided, models.StatusAuthorized, models.StatusFailed},
+	models.StatusCompleted:      {models.StatusRefunded},
+	models.StatusFailed:         {},
+	models.StatusCancelled:      {},
+	models.StatusRefunded:       {},
+	models.StatusVoided:         {},
+}
+
+// statuses only the service moves transactions to, a deposit is refunded by its refunds once they complete so the ledger gives the money back
+var internalStatuses = map[string]bool{
+	models.StatusRefunded: true,
+}
+
+// checks if the status is a known transaction status
+func IsValidStatus(status string) bool {
+	_, ok := authorizationTransitions[status]
+	return ok
+}
+
+// checks if a gateway may report the status of a transaction
+func validateReportedStatus(status string) error {
+	if !IsValidStatus(status) {
+		return fmt.Errorf("%w: %s", ErrInvalidStatus, status)
+	}
+	if internalStatuses[status] {
+		return fmt.Errorf("%w: %s can't be reported, it is set once the refunds of a transaction complete", ErrInvalidStatus, status)
+	}
+	return nil
+}
+
+// returns the transitions of the flow the transaction follows, authorizations are told apart by their authorized amount
+func transitionsOf(transaction models.Transaction) map[string][]string {
+	if transaction.AuthorizedAmount != nil {
+		return authorizationTransitions
+	}
+	return paymentTransitions
+}
+
+// checks if a transaction can move from its current status to another
+func ValidateTransition(transaction models.Transaction, to string) error {
+	if !IsValidStatus(to) {
+		return fmt.Errorf("%w: %s", ErrInvalidStatus, to)
+	}
+
+	for _, allowed := range transitionsOf(transaction)[transaction.Status] {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, transaction.Status, to)
+}
+
+// returns the statuses a transaction following the transitions may be in to move to the given status
+func previousStatuses(transitions map[string][]string, to string) []string {
+	var statuses []string
+	for from, allowed := range transitions {
+		for _, status := range allowed {
+			if status == to {
+				statuses = append(statuses, from)
+			}
+		}
+	}
+	return statuses
+}
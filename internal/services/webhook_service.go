@@ -0,0 +1,334 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"payment-gateway/db"
+	"payment-gateway/internal/logging"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/security"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// webhook dispatcher settings, an event is retried with exponential backoff until it runs out of attempts and is moved to dead.
+// The lease is renewed right before each event of a batch is delivered so it only has to cover one delivery
+const (
+	webhookPollInterval       = time.Second
+	webhookBatchSize          = 100
+	webhookLease              = time.Minute
+	webhookBaseBackoff        = 10 * time.Second
+	webhookMaxBackoff         = time.Hour
+	webhookDeliveryTimeout    = 10 * time.Second
+	webhookEventsLimit        = 100
+	DefaultWebhookMaxAttempts = 8
+)
+
+var (
+	// returned when a webhook endpoint isn't an absolute https URL, or http URL when insecure webhooks are allowed
+	ErrInvalidWebhookURL = errors.New("url must be an absolute https URL")
+
+	// returned when the host of a webhook endpoint resolves to an address inside the service network
+	ErrPrivateWebhookURL = errors.New("url must not point to a loopback, private, link-local or metadata address")
+
+	// returned when webhook events are filtered by an unknown status
+	ErrInvalidWebhookEventStatus = errors.New("status must be pending, delivered or dead")
+)
+
+// the number of delivery attempts before a webhook event is moved to dead, set with ConfigureWebhooks
+var webhookMaxAttempts = DefaultWebhookMaxAttempts
+
+// set with AllowInsecureWebhooks for local development, lets endpoints use plain http and private addresses
+var webhookAllowInsecure bool
+
+// the shared address space carriers and cloud providers use, some put their metadata service there such as 100.100.100.200
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// the client webhook events are delivered with, redirects aren't followed so events only reach the registered URL.
+// The address is checked again when dialing since the host may resolve differently than it did at registration
+var webhookClient = &http.Client{
+	Timeout: webhookDeliveryTimeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: webhookDeliveryTimeout, Control: checkWebhookDial}).DialContext,
+		TLSHandshakeTimeout: webhookDeliveryTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sets the number of delivery attempts before a webhook event is moved to dead
+func ConfigureWebhooks(maxAttempts int) error {
+	if maxAttempts < 1 {
+		return fmt.Errorf("webhook max attempts must be at least 1, got %d", maxAttempts)
+	}
+	webhookMaxAttempts = maxAttempts
+	return nil
+}
+
+// lets webhook endpoints use plain http and addresses inside the service network, only meant for local development
+func AllowInsecureWebhooks(allow bool) {
+	webhookAllowInsecure = allow
+}
+
+// validates the webhook endpoint request (data fields), the host has to resolve to public addresses only so merchants can't make the dispatcher post to services inside the network
+func ValidateWebhookEndpointRequest(ctx context.Context, request models.WebhookEndpointRequest) error {
+	endpoint, err := url.Parse(strings.TrimSpace(request.URL))
+	if err != nil || !allowedWebhookScheme(endpoint.Scheme) || endpoint.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	if webhookAllowInsecure {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, endpoint.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return fmt.Errorf("%w: %s can't be resolved", ErrInvalidWebhookURL, endpoint.Hostname())
+	}
+	for _, address := range addresses {
+		if privateWebhookIP(address.IP) {
+			return ErrPrivateWebhookURL
+		}
+	}
+	return nil
+}
+
+// https is required unless insecure webhooks are allowed
+func allowedWebhookScheme(scheme string) bool {
+	return scheme == "https" || (scheme == "http" && webhookAllowInsecure)
+}
+
+// reports addresses a webhook must not reach, cloud metadata services such as 169.254.169.254 are link-local
+func privateWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// refuses connections to private addresses, it runs with the resolved address right before connecting so a host can't be rebound to one after it was validated
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	if webhookAllowInsecure {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateWebhookIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateWebhookURL, host)
+	}
+	return nil
+}
+
+// registers a webhook endpoint of a merchant, the signing secret is only part of the returned endpoint and can't be retrieved later
+func CreateWebhookEndpoint(ctx context.Context, merchantID string, request models.WebhookEndpointRequest) (models.WebhookEndpoint, error) {
+	secret, err := security.GenerateWebhookSecret()
+	if err != nil {
+		return models.WebhookEndpoint{}, err
+	}
+
+	endpoint := models.WebhookEndpoint{
+		ID:         uuid.New().String(),
+		MerchantID: merchantID,
+		URL:        strings.TrimSpace(request.URL),
+		Secret:     secret,
+	}
+
+	err = withPostgres(ctx, "CreateWebhookEndpoint", func(ctx context.Context) (err error) {
+		endpoint, err = db.CreateWebhookEndpoint(ctx, db.MerchantScope(merchantID), endpoint)
+		return err
+	})
+	return endpoint, err
+}
+
+// retrieves the active webhook endpoints in the scope
+func ListWebhookEndpoints(ctx context.Context, scope db.Scope) (endpoints []models.WebhookEndpoint, err error) {
+	err = withPostgres(ctx, "ListWebhookEndpoints", func(ctx context.Context) error {
+		endpoints, err = db.ListWebhookEndpoints(ctx, scope)
+		return err
+	})
+	return endpoints, err
+}
+
+// removes a webhook endpoint, events still waiting for it are moved to dead
+func DeleteWebhookEndpoint(ctx context.Context, scope db.Scope, endpointID string) (endpoint models.WebhookEndpoint, err error) {
+	err = withPostgres(ctx, "DeleteWebhookEndpoint", func(ctx context.Context) error {
+		endpoint, err = db.DeleteWebhookEndpoint(ctx, scope, endpointID)
+		return err
+	})
+	return endpoint, err
+}
+
+// retrieves the latest webhook events in the scope, optionally only those in the given status or of the given transaction
+func ListWebhookEvents(ctx context.Context, scope db.Scope, status string, transactionID string) (events []models.WebhookEvent, err error) {
+	switch status {
+	case "", models.WebhookEventPending, models.WebhookEventDelivered, models.WebhookEventDead:
+	default:
+		return nil, ErrInvalidWebhookEventStatus
+	}
+
+	err = withPostgres(ctx, "ListWebhookEvents", func(ctx context.Context) error {
+		events, err = db.ListWebhookEvents(ctx, scope, status, transactionID, webhookEventsLimit)
+		return err
+	})
+	return events, err
+}
+
+// sends a webhook event again, dead events get a fresh set of attempts
+func RedeliverWebhookEvent(ctx context.Context, scope db.Scope, eventID int64) (event models.WebhookEvent, err error) {
+	err = withPostgres(ctx, "RedeliverWebhookEvent", func(ctx context.Context) error {
+		event, err = db.RedeliverWebhookEvent(ctx, scope, eventID)
+		return err
+	})
+	return event, err
+}
+
+// polls the webhook events and delivers the pending ones until the context is cancelled
+func StartWebhookDispatcher(ctx context.Context) {
+	slog.Info("starting webhook dispatcher")
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("webhook dispatcher stopped")
+			return
+		case <-ticker.C:
+			if err := DispatchWebhooks(ctx); err != nil {
+				slog.Error("webhook dispatch failed", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// delivers one batch of due webhook events, the events are delivered one at a time so the lease of each is renewed right before it is delivered
+func DispatchWebhooks(ctx context.Context) error {
+	var events []models.WebhookEvent
+	err := withPostgres(ctx, "ClaimWebhookEvents", func(ctx context.Context) (err error) {
+		events, err = db.ClaimWebhookEvents(ctx, webhookBatchSize, webhookLease)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if ctx.Err() != nil {
+			// the lease expires on its own so undelivered events are picked up again later
+			return ctx.Err()
+		}
+
+		// an event whose lease ran out while it waited in the batch may have been claimed by another dispatcher, it is left to that dispatcher so it isn't delivered twice
+		var renewed bool
+		err := withPostgres(ctx, "RenewWebhookEventLease", func(ctx context.Context) (err error) {
+			renewed, err = db.RenewWebhookEventLease(ctx, event, webhookLease)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !renewed {
+			slog.WarnContext(ctx, "skipping webhook event claimed by another dispatcher", slog.Int64("webhook_event_id", event.ID), slog.String("transaction_id", event.TransactionID))
+			continue
+		}
+
+		// an event already being delivered finishes on shutdown so it isn't sent again after the restart
+		deliverWebhookEvent(context.WithoutCancel(ctx), event)
+	}
+
+	return nil
+}
+
+// delivers a single webhook event and records the outcome
+func deliverWebhookEvent(ctx context.Context, event models.WebhookEvent) {
+	ctx = logging.WithTransaction(ctx, event.TransactionID)
+
+	err := postWebhookEvent(ctx, event)
+	if err == nil {
+		err := withPostgres(ctx, "MarkWebhookEventDelivered", func(ctx context.Context) error {
+			return db.MarkWebhookEventDelivered(ctx, event.ID)
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to mark webhook event as delivered", slog.Int64("webhook_event_id", event.ID), slog.Any("error", err))
+		}
+		return
+	}
+
+	slog.WarnContext(ctx, "failed to deliver webhook event", slog.Int64("webhook_event_id", event.ID), slog.Int("attempt", event.Attempts+1), slog.Any("error", err))
+
+	if event.Attempts+1 >= webhookMaxAttempts {
+		deadErr := withPostgres(ctx, "MarkWebhookEventDead", func(ctx context.Context) error {
+			return db.MarkWebhookEventDead(ctx, event.ID, err.Error())
+		})
+		if deadErr != nil {
+			slog.ErrorContext(ctx, "failed to mark webhook event as dead", slog.Int64("webhook_event_id", event.ID), slog.Any("error", deadErr))
+		}
+		return
+	}
+
+	rescheduleErr := withPostgres(ctx, "RescheduleWebhookEvent", func(ctx context.Context) error {
+		return db.RescheduleWebhookEvent(ctx, event.ID, webhookBackoff(event.Attempts), err.Error())
+	})
+	if rescheduleErr != nil {
+		slog.ErrorContext(ctx, "failed to reschedule webhook event", slog.Int64("webhook_event_id", event.ID), slog.Any("error", rescheduleErr))
+	}
+}
+
+// posts a signed webhook event to its endpoint, any status other than 2xx counts as a failed delivery
+func postWebhookEvent(ctx context.Context, event models.WebhookEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookDeliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, event.EndpointURL, bytes.NewReader(event.Payload))
+	if err != nil {
+		return err
+	}
+	// endpoints registered while insecure webhooks were allowed don't get events over http afterwards
+	if !allowedWebhookScheme(req.URL.Scheme) {
+		return ErrInvalidWebhookURL
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(security.WebhookIDHeader, event.EventID)
+	req.Header.Set(security.WebhookTimestampHeader, timestamp)
+	req.Header.Set(security.SignatureHeader, security.SignWebhook(timestamp, event.Payload, event.EndpointSecret))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// the body is drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with %s", res.Status)
+	}
+	return nil
+}
+
+// returns the delay before the next delivery attempt doubling with each failed attempt
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff << uint(attempts)
+	if backoff <= 0 || backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the name spans of the service are reported under unless OTEL_SERVICE_NAME is set
+const serviceName = "payment-gateway"
+
+// W3C trace-context and baggage, the format read from incoming requests and written to Kafka headers
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// sets up trace propagation and, when an OTLP endpoint is configured, exports spans to the collector over OTLP/HTTP.
+// Without an endpoint spans aren't recorded but trace context is still passed on so callers' traces aren't cut.
+// The returned function flushes the spans still buffered and must be called on shutdown
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		slog.Info("no otlp endpoint configured, spans are not exported")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// the endpoint, headers and TLS settings are read from the standard OTEL_EXPORTER_OTLP_* variables
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv("OTEL_SERVICE_NAME") != "" {
+		res, err = resource.Merge(res, resource.Environment())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	slog.Info("exporting spans over otlp")
+	return provider.Shutdown, nil
+}
+
+// returns the tracer of the service, spans are dropped until Init sets up an exporter
+func Tracer() trace.Tracer {
+	return otel.Tracer(serviceName)
+}
+
+// records the error of the call a span covers and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// returns the trace context of ctx as W3C headers so it can be stored and picked up again later, such as with an outbox message
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// writes the trace context of ctx as W3C headers into a carrier such as the headers of a Kafka message
+func InjectInto(ctx context.Context, carrier propagation.TextMapCarrier) {
+	propagator.Inject(ctx, carrier)
+}
+
+// returns ctx carrying the trace context read from W3C headers
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
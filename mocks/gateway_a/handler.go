@@ -4,14 +4,22 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 )
 
+// an amount in integer minor units of its currency as published by the payment gateway
+type Money struct {
+	MinorUnits int64  `json:"minor_units"`
+	Currency   string `json:"currency"`
+}
+
 type TransactionRequest struct {
-	TransactionID string  `json:"transaction_id"`
-	Amount        float64 `json:"amount"`
-	Status        string  `json:"status"`
+	TransactionID string `json:"transaction_id"`
+	Amount        Money  `json:"amount"`
+	Status        string `json:"status"`
+	MessageType   string `json:"message_type"`
 }
 
 type CallbackRequest struct {
@@ -20,7 +28,7 @@ type CallbackRequest struct {
 }
 
 // processes the received transaction from Kafka.
-func ProcessTransaction(data []byte) {
+func ProcessTransaction(data []byte, trace map[string]string) {
 
 	unmaskedData, err := UnmaskData(string(data))
 	if err != nil {
@@ -37,7 +45,7 @@ func ProcessTransaction(data []byte) {
 
 	callbackRequest := CallbackRequest{
 		TransactionID: transaction.TransactionID,
-		Status:        "completed",
+		Status:        ResultStatus(transaction.MessageType),
 	}
 
 	callbackData, err := json.Marshal(callbackRequest)
@@ -46,15 +54,57 @@ func ProcessTransaction(data []byte) {
 		return
 	}
 
+	if err := SendResult(transaction.TransactionID, callbackData, "application/json", trace); err != nil {
+		log.Printf("Error reporting transaction result: %v", err)
+		return
+	}
+
+	log.Printf("Processed %s transaction from Gateway A: %s with status: %s", transaction.MessageType, transaction.TransactionID, callbackRequest.Status)
+}
+
+// returns the status the gateway reports for the operation requested by the message, authorizations are held and voids release the hold
+func ResultStatus(messageType string) string {
+	switch messageType {
+	case "authorize":
+		return "authorized"
+	case "void":
+		return "voided"
+	default:
+		return "completed"
+	}
+}
+
+// reports the result back to the payment gateway either through the callback endpoint or the Kafka results topic, passing on the trace context and request ID of the transaction
+func SendResult(transactionID string, data []byte, contentType string, trace map[string]string) error {
+	if CallbackMode() == "kafka" {
+		return PublishResult(transactionID, data, contentType, trace)
+	}
+
 	callbackURL := "http://payment_gateway_app:8080/callback"
-	resp, err := http.Post(callbackURL, "application/json", bytes.NewBuffer(callbackData))
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewBuffer(data))
 	if err != nil {
-		log.Printf("Error calling callback endpoint: %v", err)
-		return
+		return err
+	}
+
+	// sign the body so the payment gateway can verify the callback came from this gateway
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Gateway-ID", GatewayID())
+	req.Header.Set("X-Signature", CreateSignature(data))
+	for key, value := range trace {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
-	log.Printf("Processed transaction from Gateway A: %s with status: %s", transaction.TransactionID, transaction.Status)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("callback rejected with status %s", resp.Status)
+	}
+
+	return nil
 }
 
 func UnmaskData(maskedData string) ([]byte, error) {
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var resultsWriter = &kafka.Writer{
+	Addr:                   kafka.TCP("kafka-like:9092"),
+	Balancer:               &kafka.Hash{},
+	AllowAutoTopicCreation: true,
+	BatchTimeout:           10 * time.Millisecond,
+}
+
+// returns how results are reported back, either "http" for the callback endpoint or "kafka" for the results topic
+func CallbackMode() string {
+	mode := os.Getenv("CALLBACK_MODE")
+	if mode == "" {
+		mode = "http"
+	}
+	return mode
+}
+
+// returns the topic results are published to in kafka mode
+func ResultsTopic() string {
+	topic := os.Getenv("RESULTS_TOPIC")
+	if topic == "" {
+		topic = "transactions.results"
+	}
+	return topic
+}
+
+// publishes a transaction result to the results topic keyed by transaction ID to keep results of one transaction in order
+func PublishResult(transactionID string, data []byte, contentType string, trace map[string]string) error {
+	// results are signed like callbacks so the payment gateway can verify they came from this gateway
+	headers := []kafka.Header{
+		{Key: "Content-Type", Value: []byte(contentType)},
+		{Key: "X-Gateway-ID", Value: []byte(GatewayID())},
+		{Key: "X-Signature", Value: []byte(CreateSignature(data))},
+	}
+	for key, value := range trace {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+
+	err := resultsWriter.WriteMessages(context.Background(), kafka.Message{
+		Topic:   ResultsTopic(),
+		Key:     []byte(transactionID),
+		Value:   data,
+		Headers: headers,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published result for transaction %s from Gateway A to topic %s", transactionID, ResultsTopic())
+	return nil
+}
@@ -30,6 +30,17 @@ func StartKafkaConsumer(topic string) {
 		}
 		log.Printf("Received message on Gateway B: %s\n", string(msg.Value))
 
-		ProcessTransaction(msg.Value)
+		ProcessTransaction(msg.Value, TraceHeaders(msg.Headers))
 	}
 }
+
+// returns the W3C trace context and request ID headers of a message so the result is reported in the same trace and under the same request ID as the transaction
+func TraceHeaders(headers []kafka.Header) map[string]string {
+	trace := map[string]string{}
+	for _, header := range headers {
+		if header.Key == "traceparent" || header.Key == "tracestate" || header.Key == "X-Request-ID" {
+			trace[header.Key] = string(header.Value)
+		}
+	}
+	return trace
+}
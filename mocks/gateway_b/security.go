@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+)
+
+// returns the ID this gateway identifies itself with in callback requests and result messages
+func GatewayID() string {
+	id := os.Getenv("GATEWAY_ID")
+	if id == "" {
+		id = "gateway_b"
+	}
+	return id
+}
+
+// signs the callback body or result message with the gateway secret using the same HMAC scheme the payment gateway verifies
+func CreateSignature(data []byte) string {
+	h := hmac.New(sha256.New, []byte(os.Getenv("GATEWAY_SECRET")))
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}